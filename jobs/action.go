@@ -0,0 +1,91 @@
+package jobs
+
+import "time"
+
+// RetryPolicy computes the delay before a retry
+type RetryPolicy interface {
+	Backoff(retries uint) time.Duration
+}
+
+// ExponentialBackoff is a RetryPolicy doubling the delay on each retry
+type ExponentialBackoff struct {
+	Base time.Duration // delay of the first retry
+	Max  time.Duration // max delay, 0 means unlimited
+}
+
+// Backoff implements RetryPolicy
+func (b ExponentialBackoff) Backoff(retries uint) time.Duration {
+	if retries == 0 {
+		return 0
+	}
+	d := b.Base
+	for i := uint(1); i < retries; i++ {
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// ActionType indicates what should happen to a task next
+type ActionType int
+
+// Action types
+const (
+	ActionRun   ActionType = iota // run now
+	ActionRunAt                   // run at Action.When
+	ActionWait                    // wait for others to make progress
+	ActionDone                    // task completed, nothing to do
+	ActionDead                    // task stucked, requires intervention
+	ActionAbort                   // past the run window, abort as expired
+)
+
+// Action is the next action of a task
+type Action struct {
+	Type ActionType
+	When time.Time // when to run for ActionRunAt
+}
+
+// NextAction decides what should happen to the task next
+// A pending task runs at the latest of ScheduledAt, NotBefore and the
+// retry delay after the last error, which is RetryAfter of the error if
+// specified, otherwise the backoff of policy, and a task not running is
+// aborted after NotAfter
+func (t *Task) NextAction(now time.Time, policy RetryPolicy) Action {
+	switch {
+	case t.State == TaskCompleted:
+		return Action{Type: ActionDone}
+	case t.State != TaskRunning && t.expired(now):
+		return Action{Type: ActionAbort}
+	case t.State == TaskStucked:
+		return Action{Type: ActionDead}
+	case t.State != TaskPending:
+		return Action{Type: ActionWait}
+	}
+
+	var when time.Time
+	if t.Stats != nil {
+		when = t.Stats.ScheduledAt
+	}
+	if t.NotBefore.After(when) {
+		when = t.NotBefore
+	}
+	if t.Retries > 0 && len(t.Errors) > 0 {
+		last := t.Errors[len(t.Errors)-1]
+		delay := last.RetryAfter
+		if delay <= 0 && policy != nil {
+			delay = policy.Backoff(t.Retries)
+		}
+		if retryAt := last.HappenedAt.Add(delay); delay > 0 && retryAt.After(when) {
+			when = retryAt
+		}
+	}
+	if when.After(now) {
+		return Action{Type: ActionRunAt, When: when}
+	}
+	return Action{Type: ActionRun}
+}
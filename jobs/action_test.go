@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextAction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	policy := ExponentialBackoff{Base: time.Minute}
+	retried := func(retryAfter time.Duration) func(*Task) {
+		return func(t *Task) {
+			t.Retries = 2
+			t.Errors = []TaskError{{Type: TaskErrRetry, HappenedAt: now.Add(-time.Minute), RetryAfter: retryAfter}}
+		}
+	}
+	cases := []struct {
+		name  string
+		state TaskState
+		setup func(*Task)
+		want  Action
+	}{
+		{"pending", TaskPending, nil, Action{Type: ActionRun}},
+		{"scheduled", TaskPending, func(t *Task) { t.ensureStats().ScheduledAt = now.Add(time.Hour) },
+			Action{Type: ActionRunAt, When: now.Add(time.Hour)}},
+		{"scheduled passed", TaskPending, func(t *Task) { t.ensureStats().ScheduledAt = now.Add(-time.Hour) },
+			Action{Type: ActionRun}},
+		{"not before", TaskPending, func(t *Task) { t.NotBefore = now.Add(time.Minute) },
+			Action{Type: ActionRunAt, When: now.Add(time.Minute)}},
+		{"backoff", TaskPending, retried(0), Action{Type: ActionRunAt, When: now.Add(time.Minute)}},
+		{"retry after", TaskPending, retried(10 * time.Minute), Action{Type: ActionRunAt, When: now.Add(9 * time.Minute)}},
+		{"expired", TaskPending, func(t *Task) { t.NotAfter = now.Add(-time.Second) }, Action{Type: ActionAbort}},
+		{"expired waiting", TaskWaiting, func(t *Task) { t.NotAfter = now.Add(-time.Second) }, Action{Type: ActionAbort}},
+		{"expired running", TaskRunning, func(t *Task) { t.NotAfter = now.Add(-time.Second) }, Action{Type: ActionWait}},
+		{"created", TaskCreated, nil, Action{Type: ActionWait}},
+		{"running", TaskRunning, nil, Action{Type: ActionWait}},
+		{"waiting", TaskWaiting, nil, Action{Type: ActionWait}},
+		{"blocked", TaskBlocked, nil, Action{Type: ActionWait}},
+		{"stucked", TaskStucked, nil, Action{Type: ActionDead}},
+		{"succeeded", TaskCompleted, nil, Action{Type: ActionDone}},
+		{"failed", TaskCompleted, func(t *Task) { t.Result = TaskFailure }, Action{Type: ActionDone}},
+		{"aborted", TaskCompleted, func(t *Task) { t.Result = TaskAborted }, Action{Type: ActionDone}},
+		{"expired completed", TaskCompleted, func(t *Task) { t.NotAfter = now.Add(-time.Second) }, Action{Type: ActionDone}},
+	}
+	for _, c := range cases {
+		task := &Task{ID: c.name, State: c.state}
+		if c.setup != nil {
+			c.setup(task)
+		}
+		if got := task.NextAction(now, policy); got.Type != c.want.Type || !got.When.Equal(c.want.When) {
+			t.Errorf("%s: expect %+v, got %+v", c.name, c.want, got)
+		}
+	}
+
+	// the backoff is ignored without a policy
+	task := &Task{State: TaskPending}
+	retried(0)(task)
+	if got := task.NextAction(now, nil); got.Type != ActionRun {
+		t.Errorf("expect run without a policy, got %+v", got)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Second, Max: 5 * time.Second}
+	for retries, want := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b.Backoff(uint(retries)); got != want {
+			t.Errorf("retries %d: expect %s, got %s", retries, want, got)
+		}
+	}
+}
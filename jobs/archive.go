@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Entries in a task archive
+const (
+	archiveTasksDir   = "tasks/"
+	archiveOutputsDir = "outputs/"
+)
+
+// ExportTask writes a tar archive containing the task and recursively
+// its children, the outputs are written as separate entries, and the
+// payloads in Blobs are inlined
+func ExportTask(store Store, id string, w io.Writer) error {
+	task, err := LoadTask(store, id)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return ErrTaskNotFound
+	}
+	tw := tar.NewWriter(w)
+	if err = exportTaskTree(store, task, tw); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportTaskTree(store Store, task *Task, tw *tar.Writer) error {
+	output, err := loadPayload(task.Output, task.OutputRef)
+	if err != nil {
+		return err
+	}
+	params, err := loadPayload(task.Params, task.ParamsRef)
+	if err != nil {
+		return err
+	}
+	exported := *task
+	exported.Params, exported.ParamsRef, exported.ParamsDigest, exported.ParamsBytes = params, "", "", 0
+	exported.Output, exported.OutputRef, exported.OutputBytes = nil, "", 0
+	encoded, err := json.Marshal(&exported)
+	if err != nil {
+		return err
+	}
+	if err = writeArchiveEntry(tw, archiveTasksDir+task.ID+".json", encoded); err != nil {
+		return err
+	}
+	if output != nil {
+		if err = writeArchiveEntry(tw, archiveOutputsDir+task.ID, output); err != nil {
+			return err
+		}
+	}
+	children, err := ListTasks(store, Filter{ParentID: task.ID})
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err = exportTaskTree(store, child, tw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+// ImportTask saves the tasks in an archive written by ExportTask into
+// the store, existing tasks with the same ids are overwritten
+func ImportTask(store Store, r io.Reader) error {
+	var tasks []*Task
+	outputs := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		switch dir, name := path.Split(hdr.Name); dir {
+		case archiveTasksDir:
+			task := &Task{}
+			if err = json.Unmarshal(content, task); err != nil {
+				return fmt.Errorf("archive entry %s: %w", hdr.Name, err)
+			}
+			if task.ID != strings.TrimSuffix(name, ".json") {
+				return fmt.Errorf("archive entry %s: mismatched task id %s", hdr.Name, task.ID)
+			}
+			tasks = append(tasks, task)
+		case archiveOutputsDir:
+			outputs[name] = content
+		}
+	}
+	for _, task := range tasks {
+		var err error
+		if err = task.storeParams(task.Params); err != nil {
+			return err
+		}
+		if output, ok := outputs[task.ID]; ok {
+			if err = task.storeOutput(output); err != nil {
+				return err
+			}
+		}
+		// overwritten regardless of the stored Version
+		if err = putTask(store, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExportImportTree(t *testing.T) {
+	blobs := useBlobs(t, 32)
+	store := newMemStore()
+	root := NewTask("export-root").With(strings.Repeat("p", 64)).Build()
+	root.SetOutput(strings.Repeat("o", 64))
+	child := NewTask("export-child").Build()
+	child.ParentID = root.ID
+	child.SetOutput("child")
+	grandchild := NewTask("export-grandchild").Build()
+	grandchild.ParentID = child.ID
+	other := NewTask("export-other").Build()
+	saveTasks(t, store, root, child, grandchild, other)
+	if root.ParamsRef == "" || root.OutputRef == "" {
+		t.Fatal("expect the root payloads externalized")
+	}
+
+	var buf bytes.Buffer
+	if err := ExportTask(store, root.ID, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	want := []string{
+		"outputs/" + child.ID, "outputs/" + root.ID,
+		"tasks/" + child.ID + ".json", "tasks/" + grandchild.ID + ".json", "tasks/" + root.ID + ".json",
+	}
+	sort.Strings(want)
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("expect entries %v, got %v", want, names)
+	}
+
+	blobs.blobs = make(map[string][]byte)
+	imported := newMemStore()
+	if err := ImportTask(imported, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var params, output string
+	loaded := loadTask(t, imported, root.ID)
+	if err := loaded.GetParams(&params); err != nil || params != strings.Repeat("p", 64) {
+		t.Errorf("expect the params restored, got %q, %v", params, err)
+	}
+	if err := loaded.GetOutput(&output); err != nil || output != strings.Repeat("o", 64) {
+		t.Errorf("expect the output restored, got %q, %v", output, err)
+	}
+	if loaded = loadTask(t, imported, child.ID); loaded.ParentID != root.ID || loaded.GetOutput(&output) != nil || output != "child" {
+		t.Errorf("expect the child restored, got %+v", loaded)
+	}
+	if loaded = loadTask(t, imported, grandchild.ID); loaded.ParentID != child.ID {
+		t.Errorf("expect the grandchild restored, got %+v", loaded)
+	}
+	if task, _ := LoadTask(imported, other.ID); task != nil {
+		t.Error("expect unrelated tasks not exported")
+	}
+
+	if err := ExportTask(store, "unknown", io.Discard); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("expect ErrTaskNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package jobs
+
+import "sort"
+
+// CollectErrors gathers errors of all tasks selected by the filter,
+// sorted by the time the errors happened
+func CollectErrors(store Store, filter Filter) ([]TaskError, error) {
+	tasks, err := ListTasks(store, filter)
+	if err != nil {
+		return nil, err
+	}
+	var errs []TaskError
+	for _, task := range tasks {
+		errs = append(errs, task.Errors...)
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].HappenedAt.Before(errs[j].HappenedAt)
+	})
+	return errs, nil
+}
+
+// GroupErrorsByType groups errors by type, the order is preserved
+// within a group
+func GroupErrorsByType(errs []TaskError) map[TaskErrorType][]TaskError {
+	groups := make(map[TaskErrorType][]TaskError)
+	for _, e := range errs {
+		groups[e.Type] = append(groups[e.Type], e)
+	}
+	return groups
+}
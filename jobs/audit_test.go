@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectErrors(t *testing.T) {
+	store := newMemStore()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	withErrors := func(jobID string, errs ...TaskError) *Task {
+		task := newRunnable("audit")
+		task.JobID = jobID
+		for _, e := range errs {
+			e.TaskID = task.ID
+			task.AppendError(&e)
+		}
+		return task
+	}
+	at := func(minutes int, errType TaskErrorType, msg string) TaskError {
+		return TaskError{Type: errType, Message: msg, HappenedAt: base.Add(time.Duration(minutes) * time.Minute)}
+	}
+	saveTasks(t, store,
+		withErrors("j1", at(3, TaskErrRetry, "c"), at(5, TaskErrStuck, "e")),
+		withErrors("j1", at(1, TaskErrRetry, "a"), at(4, TaskErrFail, "d")),
+		withErrors("j1", at(2, TaskErrRetry, "b")),
+		withErrors("j2", at(0, TaskErrFail, "other job")),
+	)
+
+	errs, err := CollectErrors(store, Filter{JobID: "j1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs string
+	for _, e := range errs {
+		msgs += e.Message
+	}
+	if msgs != "abcde" {
+		t.Errorf("expect errors of the job sorted by time, got %q", msgs)
+	}
+
+	groups := GroupErrorsByType(errs)
+	if len(groups) != 3 || len(groups[TaskErrRetry]) != 3 || len(groups[TaskErrFail]) != 1 || len(groups[TaskErrStuck]) != 1 {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+	if retries := groups[TaskErrRetry]; retries[0].Message != "a" || retries[2].Message != "c" {
+		t.Errorf("expect the order kept in a group, got %v", retries)
+	}
+}
@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// BlobStore stores large payloads outside of tasks
+type BlobStore interface {
+	Put(data []byte) (ref string, err error)
+	Get(ref string) ([]byte, error)
+}
+
+// Blobs is the store for externalized payloads, nil keeps all
+// payloads inline
+var Blobs BlobStore
+
+// BlobThreshold is the size in bytes above which payloads are
+// stored in Blobs
+var BlobThreshold = 1 << 20
+
+// externalize saves the payload into Blobs if it exceeds BlobThreshold
+func externalize(data []byte) ([]byte, string, error) {
+	if Blobs == nil || len(data) <= BlobThreshold {
+		return data, "", nil
+	}
+	ref, err := Blobs.Put(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return nil, ref, nil
+}
+
+// storeParams keeps the encoded params inline, or in Blobs with the
+// digest recorded if large
+func (t *Task) storeParams(encoded []byte) error {
+	params, ref, err := externalize(encoded)
+	if err != nil {
+		return err
+	}
+	t.Params, t.ParamsRef, t.ParamsDigest, t.ParamsBytes = params, ref, "", 0
+	if ref != "" {
+		t.ParamsDigest, t.ParamsBytes = payloadDigest(encoded), len(encoded)
+	}
+	return nil
+}
+
+// storeOutput keeps the encoded output inline, or in Blobs with the size
+// recorded if large
+func (t *Task) storeOutput(encoded []byte) error {
+	output, ref, err := externalize(encoded)
+	if err != nil {
+		return err
+	}
+	t.Output, t.OutputRef, t.OutputBytes = output, ref, 0
+	if ref != "" {
+		t.OutputBytes = len(encoded)
+	}
+	return nil
+}
+
+// payloadDigest is the hex encoded sha256 of the payload
+func payloadDigest(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadPayload retrieves the payload either inline or from Blobs
+func loadPayload(inline []byte, ref string) ([]byte, error) {
+	if ref == "" {
+		return inline, nil
+	}
+	if Blobs == nil {
+		return nil, ErrNoBlobStore
+	}
+	return Blobs.Get(ref)
+}
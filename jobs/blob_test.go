@@ -0,0 +1,142 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBlobs is an in-memory BlobStore
+type fakeBlobs struct {
+	lock  sync.Mutex
+	blobs map[string][]byte
+}
+
+func (b *fakeBlobs) Put(data []byte) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ref := fmt.Sprintf("blob-%d", len(b.blobs))
+	b.blobs[ref] = append([]byte(nil), data...)
+	return ref, nil
+}
+
+func (b *fakeBlobs) Get(ref string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	data, ok := b.blobs[ref]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", ref)
+	}
+	return data, nil
+}
+
+// useBlobs installs a fake blob store with the threshold for the test
+func useBlobs(t *testing.T, threshold int) *fakeBlobs {
+	blobs, savedThreshold := Blobs, BlobThreshold
+	t.Cleanup(func() { Blobs, BlobThreshold = blobs, savedThreshold })
+	fake := &fakeBlobs{blobs: make(map[string][]byte)}
+	Blobs, BlobThreshold = fake, threshold
+	return fake
+}
+
+func TestBlobInline(t *testing.T) {
+	blobs := useBlobs(t, 64)
+	task := NewTask("a").With(map[string]string{"k": "v"}).Build()
+	task.SetOutput("small")
+	if task.ParamsRef != "" || task.OutputRef != "" || len(blobs.blobs) != 0 {
+		t.Fatalf("expect small payloads inline, got refs %q/%q", task.ParamsRef, task.OutputRef)
+	}
+	var params map[string]string
+	var output string
+	if err := task.GetParams(&params); err != nil || params["k"] != "v" {
+		t.Errorf("unexpected params %v, %v", params, err)
+	}
+	if err := task.GetOutput(&output); err != nil || output != "small" {
+		t.Errorf("unexpected output %q, %v", output, err)
+	}
+}
+
+func TestBlobExternalized(t *testing.T) {
+	blobs := useBlobs(t, 64)
+	large := strings.Repeat("x", 100)
+	task := NewTask("a").With(map[string]string{"k": large}).Build()
+	task.SetOutput(large)
+	if task.Params != nil || task.ParamsRef == "" || task.Output != nil || task.OutputRef == "" {
+		t.Fatalf("expect large payloads externalized, got refs %q/%q", task.ParamsRef, task.OutputRef)
+	}
+	if len(blobs.blobs) != 2 {
+		t.Errorf("expect 2 blobs, got %d", len(blobs.blobs))
+	}
+	var params map[string]string
+	var output string
+	if err := task.GetParams(&params); err != nil || params["k"] != large {
+		t.Errorf("unexpected params %v, %v", params, err)
+	}
+	if err := task.GetOutput(&output); err != nil || output != large {
+		t.Errorf("unexpected output %q, %v", output, err)
+	}
+
+	Blobs = nil
+	if err := task.GetOutput(&output); !errors.Is(err, ErrNoBlobStore) {
+		t.Errorf("expect ErrNoBlobStore, got %v", err)
+	}
+}
+
+func TestPayloadSizes(t *testing.T) {
+	blobs := useBlobs(t, 64)
+	large := strings.Repeat("x", 100)
+	task := NewTask("a").With("small").Build()
+	task.SetData(map[string]int{"n": 1})
+	task.SetOutput(large)
+
+	if size := task.ParamsSize(); size != 7 {
+		t.Errorf("expect inline params sized, got %d", size)
+	}
+	if size := task.DataSize(); size != 7 {
+		t.Errorf("unexpected data size %d", size)
+	}
+	// the size is recorded, never loaded from Blobs
+	Blobs = nil
+	if size := task.OutputSize(); size != 102 {
+		t.Errorf("expect externalized output sized as recorded, got %d", size)
+	}
+	if size := task.StoredSize(); size != 14 {
+		t.Errorf("expect only inline payloads stored in the task, got %d", size)
+	}
+
+	Blobs = blobs
+	encoded, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Task
+	if err = json.Unmarshal(encoded, &decoded); err != nil || decoded.OutputSize() != 102 {
+		t.Errorf("expect the recorded size persisted, got %d", decoded.OutputSize())
+	}
+	task.SetOutput("small")
+	if task.OutputSize() != 7 || task.OutputBytes != 0 {
+		t.Errorf("expect the size reset when inline again, got %d", task.OutputSize())
+	}
+}
+
+func TestFingerprintExternalized(t *testing.T) {
+	useBlobs(t, 64)
+	large := strings.Repeat("x", 100)
+	a, b := NewTask("a").With(large).Build(), NewTask("a").With(large).Build()
+	if a.ParamsRef == "" || a.ParamsRef == b.ParamsRef || a.ParamsDigest == "" {
+		t.Fatalf("expect params externalized by different refs, got %q/%q", a.ParamsRef, b.ParamsRef)
+	}
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Error("expect the same fingerprint of the same externalized params")
+	}
+	Blobs = nil
+	if inline := NewTask("a").With(large).Build(); inline.Fingerprint() != a.Fingerprint() {
+		t.Error("expect the same fingerprint whether the params are inline or externalized")
+	}
+	if other := NewTask("a").With(large + "y").Build(); other.Fingerprint() == a.Fingerprint() {
+		t.Error("expect different params fingerprinted differently")
+	}
+}
@@ -0,0 +1,126 @@
+package jobs
+
+import "errors"
+
+// Cancel requests cancellation of a task in the store with the reason
+func Cancel(store Store, id, reason string) error {
+	task, err := LoadTask(store, id)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return ErrTaskNotFound
+	}
+	return cancelTask(store, task, reason)
+}
+
+// CancelAndRevert requests cancellation of a task and compensation of its
+// completed stages, which run in reverse order and rollback direction on
+// the worker executing the task
+// The task completes with TaskAborted once compensated, or gets stucked
+// if the compensation fails
+func CancelAndRevert(store Store, id, reason string) error {
+	task, err := LoadTask(store, id)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return ErrTaskNotFound
+	}
+	if task.State.IsTerminal() {
+		return nil
+	}
+	task.Revert = true
+	return cancelTask(store, task, reason)
+}
+
+// CancelTree requests cancellation of a task and all its descendants
+// Completed tasks in the tree are skipped
+func CancelTree(store Store, id, reason string) error {
+	task, err := LoadTask(store, id)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return ErrTaskNotFound
+	}
+	return cancelTree(store, task, reason)
+}
+
+// CancelGroup requests cancellation of all non-terminal tasks in a group
+func CancelGroup(store Store, groupID, reason string) error {
+	if groupID == "" {
+		return nil
+	}
+	tasks, err := ListTasks(store, Filter{GroupID: groupID})
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if err = cancelTask(store, task, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cancelTree(store Store, task *Task, reason string) error {
+	if err := cancelTask(store, task, reason); err != nil {
+		return err
+	}
+	children, err := ListTasks(store, Filter{ParentID: task.ID})
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err = cancelTree(store, child, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelLocal cancels a task shared with the local workers, through the
+// guard of the worker if it's running, otherwise in place while holding
+// runningLock so no worker starts running it meanwhile
+func cancelLocal(task *Task, reason string) error {
+	cancel := func(t *Task) error {
+		if t.State.IsTerminal() {
+			return nil
+		}
+		return t.Cancel(reason)
+	}
+	runningLock.Lock()
+	g := runningTasks[task.ID]
+	if g == nil {
+		defer runningLock.Unlock()
+		return cancel(task)
+	}
+	runningLock.Unlock()
+	return g.Update(cancel)
+}
+
+// cancelTask saves the cancellation request, and retries with the task
+// reloaded if it's changed by others meanwhile, e.g. the worker
+func cancelTask(store Store, task *Task, reason string) error {
+	revert := task.Revert
+	for {
+		if task.State.IsTerminal() {
+			return nil
+		}
+		task.Revert = task.Revert || revert
+		if err := task.Cancel(reason); err != nil {
+			return err
+		}
+		err := SaveTask(store, task)
+		if !errors.Is(err, ErrStaleTask) {
+			return err
+		}
+		if task, err = LoadTask(store, task.ID); err != nil {
+			return err
+		}
+		if task == nil {
+			return ErrTaskNotFound
+		}
+	}
+}
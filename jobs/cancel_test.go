@@ -0,0 +1,273 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// saveTasks saves the tasks into the store
+func saveTasks(t *testing.T, store Store, tasks ...*Task) {
+	t.Helper()
+	for _, task := range tasks {
+		if err := SaveTask(store, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// loadTask loads an existing task from the store
+func loadTask(t *testing.T, store Store, id string) *Task {
+	t.Helper()
+	task, err := LoadTask(store, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task == nil {
+		t.Fatalf("task %s not found", id)
+	}
+	return task
+}
+
+func TestCancelTreeReason(t *testing.T) {
+	store := newMemStore()
+	parent := newRunnable("cancel-parent")
+	child := newRunnable("cancel-child")
+	child.ParentID = parent.ID
+	done := newRunnable("cancel-done")
+	done.ParentID = child.ID
+	done.Transition(TaskCompleted)
+	saveTasks(t, store, parent, child, done)
+
+	if err := CancelTree(store, parent.ID, "deploy"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{parent.ID, child.ID} {
+		if task := loadTask(t, store, id); !task.Canceling || task.CancelReason != "deploy" {
+			t.Errorf("task %s: expect canceling for deploy, got %v/%q", id, task.Canceling, task.CancelReason)
+		}
+	}
+	if task := loadTask(t, store, done.ID); task.Canceling || task.CancelReason != "" {
+		t.Error("expect a completed task not canceled")
+	}
+	if err := Cancel(store, "unknown", "deploy"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("expect ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestCancelReasonInError(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	d.AddTaskExecs(singleStage("cancel-run", func(ctx Context) error {
+		t.Error("expect a canceled task not run")
+		return nil
+	}))
+	task := newRunnable("cancel-run")
+	saveTasks(t, store, task)
+	if err := Cancel(store, task.ID, "quota"); err != nil {
+		t.Fatal(err)
+	}
+	h := runOnce(d, loadTask(t, store, task.ID))
+	if h.err == nil || h.err.Message != "canceled: quota" || !errors.Is(h.err, ErrTaskCanceled) {
+		t.Fatalf("expect the reason in the error, got %v", h.err)
+	}
+	stored := loadTask(t, store, task.ID)
+	if stored.Result != TaskAborted || stored.CancelReason != "quota" {
+		t.Errorf("expect aborted for quota, got %s/%q", stored.Result, stored.CancelReason)
+	}
+	if n := len(stored.Errors); n == 0 || stored.Errors[n-1].Message != "canceled: quota" {
+		t.Errorf("expect the reason persisted in the errors, got %v", stored.Errors)
+	}
+}
+
+func TestCancelGroup(t *testing.T) {
+	store := newMemStore()
+	var group []*Task
+	for i := 0; i < 3; i++ {
+		task := NewTask("grouped").InGroup("g1").Build()
+		task.enqueue()
+		group = append(group, task)
+	}
+	group[2].Transition(TaskRunning)
+	done := NewTask("grouped").InGroup("g1").Build()
+	done.enqueue()
+	done.Transition(TaskCompleted)
+	other := NewTask("grouped").InGroup("g2").Build()
+	saveTasks(t, store, append(group, done, other)...)
+
+	if err := CancelGroup(store, "g1", "rollout"); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range group {
+		if stored := loadTask(t, store, task.ID); !stored.Canceling || stored.CancelReason != "rollout" {
+			t.Errorf("task %s: expect canceling for rollout, got %v/%q", task.ID, stored.Canceling, stored.CancelReason)
+		}
+	}
+	for _, task := range []*Task{done, other} {
+		if stored := loadTask(t, store, task.ID); stored.Canceling {
+			t.Errorf("task %s: expect not canceled", task.ID)
+		}
+	}
+	if err := CancelGroup(store, "", "rollout"); err != nil {
+		t.Errorf("expect an empty group ignored, got %v", err)
+	}
+}
+
+func TestCancelAndRevert(t *testing.T) {
+	errUndo := errors.New("undo failed")
+	var runs []string
+	var undoErr error
+	record := func(name string) Stage {
+		return Stage{Name: name, Fn: func(ctx Context) error {
+			if !ctx.Current().Revert {
+				t.Errorf("stage %s: expect run in rollback direction", name)
+			}
+			runs = append(runs, name)
+			if name == "b" {
+				return undoErr
+			}
+			return nil
+		}}
+	}
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	d.AddTaskExecs(&TaskExec{Name: "compensated", Stages: []Stage{record("a"), record("b"), record("c")}})
+	run := func() *Task {
+		runs = nil
+		task := newRunnable("compensated")
+		task.Stage = "c"
+		saveTasks(t, store, task)
+		if err := CancelAndRevert(store, task.ID, "rollout"); err != nil {
+			t.Fatal(err)
+		}
+		runOnce(d, loadTask(t, store, task.ID))
+		return loadTask(t, store, task.ID)
+	}
+
+	task := run()
+	if got := strings.Join(runs, ""); got != "ba" {
+		t.Errorf("expect completed stages compensated in reverse, got %s", got)
+	}
+	if task.State != TaskCompleted || task.Result != TaskAborted || task.Canceling {
+		t.Errorf("expect aborted after compensation, got %s/%s", task.State, task.Result)
+	}
+	if n := len(task.Errors); n == 0 || task.Errors[n-1].Message != "canceled: rollout" || !errors.Is(&task.Errors[n-1], ErrTaskCanceled) {
+		t.Errorf("expect the cancellation recorded, got %v", task.Errors)
+	}
+
+	undoErr = errUndo
+	task = run()
+	if got := strings.Join(runs, ""); got != "b" {
+		t.Errorf("expect compensation stopped at the failure, got %s", got)
+	}
+	if task.State != TaskStucked {
+		t.Errorf("expect stucked when compensation fails, got %s/%s", task.State, task.Result)
+	}
+	if n := len(task.Errors); n == 0 || !strings.Contains(task.Errors[n-1].Error(), errUndo.Error()) {
+		t.Errorf("expect the compensation error recorded, got %v", task.Errors)
+	}
+
+	done := newRunnable("compensated")
+	done.Transition(TaskCompleted)
+	saveTasks(t, store, done)
+	if err := CancelAndRevert(store, done.ID, "late"); err != nil || loadTask(t, store, done.ID).Revert {
+		t.Errorf("expect a completed task untouched, got %v", err)
+	}
+}
+
+// waitCancelExec registers a task exec whose stage signals started and
+// runs until the task is cancelled
+func waitCancelExec(d *Dispatcher, name string, started chan struct{}) {
+	d.AddTaskExecs(singleStage(name, func(ctx Context) error {
+		close(started)
+		deadline := time.Now().Add(5 * time.Second)
+		for !ctx.IsCancelled() {
+			if time.Now().After(deadline) {
+				return errors.New("cancellation not observed")
+			}
+			if err := ctx.Heartbeat(); err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return ctx.Err()
+	}))
+}
+
+func TestSubmitCancelFuncStore(t *testing.T) {
+	store := enrichingStore{newMemStore()}
+	d := &Dispatcher{Store: store.memStore}
+	started := make(chan struct{})
+	waitCancelExec(d, "cancel-func-store", started)
+
+	// cancelled before running
+	task, cancel, err := (&TaskBuilder{Submitter: store, Name: "cancel-func-store"}).SubmitContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cancel("early"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadTask(t, store, task.ID); !loaded.Canceling || loaded.CancelReason != "early" {
+		t.Fatalf("expect the stored task cancelling, got %v/%q", loaded.Canceling, loaded.CancelReason)
+	}
+	if h := runOnce(d, loadTask(t, store, task.ID)); !errors.Is(h.err, ErrTaskCanceled) {
+		t.Errorf("expect canceled before running, got %v", h.err)
+	}
+
+	// cancelled while running
+	task, cancel, err = (&TaskBuilder{Submitter: store, Name: "cancel-func-store"}).SubmitContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-started
+		if err := cancel("late"); err != nil {
+			t.Error(err)
+		}
+	}()
+	h := runOnce(d, loadTask(t, store, task.ID))
+	if !errors.Is(h.err, ErrTaskCanceled) || h.task.Result != TaskAborted || h.task.CancelReason != "late" {
+		t.Errorf("expect canceled while running, got %v", h.err)
+	}
+	if err = cancel("again"); err != nil {
+		t.Errorf("expect cancelling a completed task a no-op, got %v", err)
+	}
+}
+
+func TestSubmitCancelFuncLocal(t *testing.T) {
+	d := &Dispatcher{}
+	started := make(chan struct{})
+	waitCancelExec(d, "cancel-func-local", started)
+	q := &MemQueue{}
+
+	task, cancel, err := (&TaskBuilder{Submitter: q, Name: "cancel-func-local"}).SubmitContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cancel("early"); err != nil {
+		t.Fatal(err)
+	}
+	if !task.Canceling || task.CancelReason != "early" {
+		t.Errorf("expect the submitted task cancelling in place, got %v/%q", task.Canceling, task.CancelReason)
+	}
+
+	task, cancel, err = (&TaskBuilder{Submitter: q, Name: "cancel-func-local"}).SubmitContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-started
+		if err := cancel("late"); err != nil {
+			t.Error(err)
+		}
+	}()
+	if h := runOnce(d, task); !errors.Is(h.err, ErrTaskCanceled) {
+		t.Errorf("expect canceled while running, got %v", h.err)
+	}
+	if task.Result != TaskAborted || task.CancelReason != "late" {
+		t.Errorf("expect aborted by the cancel func, got %s/%q", task.Result, task.CancelReason)
+	}
+}
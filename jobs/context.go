@@ -1,38 +1,169 @@
 package jobs
 
-import "encoding/json"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
 
 // Context provides the context for a running task
+//
+// A long running task function should periodically check cancellation
+// and bail out, e.g.
+//
+//	for _, item := range items {
+//		if ctx.IsCancelled() {
+//			return ctx.Err()
+//		}
+//		...
+//	}
+//
+// The task is then completed with TaskAborted result.
+//
+// Context implements context.Context, so it can be passed to functions
+// accepting context.Context directly. The deadline is the expiration of
+// the task. Done is closed on expiration or when the worker gives up the
+// task, while a cancellation request is only reflected by Err. Values are
+// looked up in the context the worker runs the task with, which is
+// shared by all tasks on the worker, so always use unexported key types.
 type Context struct {
+	ctx        context.Context
+	store      Store
 	strategy   WorkerStrategy
 	taskHandle TaskHandle
+	dryRun     bool
+
+	// guard serializes the access to the task from the runner and the
+	// goroutines spawned by the task, e.g. heartbeats
+	guard *GuardedTask
+	exec  *execution
+}
+
+// read invokes fn with the task under the read lock
+func (c Context) read(fn func(*Task)) {
+	if c.guard == nil {
+		fn(c.taskHandle.Task())
+		return
+	}
+	c.guard.Read(func(t *Task) {
+		fn(c.exec.view(t))
+	})
+}
+
+// update invokes fn with the task under the write lock, it fails with
+// ErrTaskDetached once the stage is abandoned or the execution ends
+func (c Context) update(fn func(*Task) error) error {
+	if c.guard == nil {
+		return fn(c.taskHandle.Task())
+	}
+	return c.guard.Update(func(t *Task) error {
+		if c.exec.view(t) != t {
+			return ErrTaskDetached
+		}
+		return fn(t)
+	})
+}
+
+func (c Context) newError(errType TaskErrorType) *TaskError {
+	return NewTaskError(c.TaskID(), errType)
 }
 
 // JobID retrieves the current job id
-func (c Context) JobID() string {
-	return c.Current().JobID
+func (c Context) JobID() (id string) {
+	c.read(func(t *Task) { id = t.JobID })
+	return
 }
 
 // TaskID retrieves the current task id
-func (c Context) TaskID() string {
-	return c.Current().ID
+func (c Context) TaskID() (id string) {
+	c.read(func(t *Task) { id = t.ID })
+	return
 }
 
 // IsRollback determines if the task is in rollback direction
-func (c Context) IsRollback() bool {
-	return c.Current().Revert
+func (c Context) IsRollback() (revert bool) {
+	c.read(func(t *Task) { revert = t.Revert })
+	return
+}
+
+// RevertCause returns the error triggered the rollback, which stays the
+// same when rollback stages retry, or nil if not in rollback direction
+func (c Context) RevertCause() (cause *TaskError) {
+	c.read(func(t *Task) {
+		if t.Revert && t.RevertCause != nil {
+			err := *t.RevertCause
+			cause = &err
+		}
+	})
+	return
+}
+
+// Flag determines if a feature flag of the task is on
+func (c Context) Flag(name string) (on bool) {
+	c.read(func(t *Task) { on = t.Flags[name] })
+	return
+}
+
+// IsDryRun determines if the task runs without persisting changes
+// Task functions should skip side effects in dry-run
+func (c Context) IsDryRun() bool {
+	return c.dryRun
 }
 
 // IsCanceling determines if cancellation is requested
-func (c Context) IsCanceling() bool {
-	// TODO
-	return false
+func (c Context) IsCanceling() (canceling bool) {
+	c.read(func(t *Task) { canceling = t.Canceling })
+	return
+}
+
+// Err returns a non-nil error if the task is cancelled, either from
+// the underlying context or by a cancellation request
+// It implements context.Context
+func (c Context) Err() error {
+	if err := c.context().Err(); err != nil {
+		return err
+	}
+	if c.IsCanceling() {
+		return context.Canceled
+	}
+	return nil
+}
+
+// Deadline implements context.Context
+func (c Context) Deadline() (time.Time, bool) {
+	return c.context().Deadline()
+}
+
+// Done implements context.Context
+func (c Context) Done() <-chan struct{} {
+	return c.context().Done()
+}
+
+// Value implements context.Context
+func (c Context) Value(key interface{}) interface{} {
+	return c.context().Value(key)
+}
+
+func (c Context) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// IsCancelled determines if the task should stop running
+func (c Context) IsCancelled() bool {
+	return c.Err() != nil
 }
 
 // Current returns a copy of current task
-func (c Context) Current() Task {
-	// TODO
-	return Task{}
+func (c Context) Current() (task Task) {
+	c.read(func(t *Task) { task = *t.Clone() })
+	return
 }
 
 // SubTasks retrieves sub tasks
@@ -42,65 +173,385 @@ func (c Context) SubTasks() ([]Task, error) {
 }
 
 // GetParams extracts the parameters for current task
-func (c Context) GetParams(p interface{}) error {
-	params := c.Current().Params
-	if params == nil {
-		return nil
-	}
-	return json.Unmarshal(params, p)
+func (c Context) GetParams(p interface{}) (err error) {
+	c.read(func(t *Task) { err = t.GetParams(p) })
+	return
+}
+
+// BindParams decodes and validates the parameters, see Task.BindParams
+func (c Context) BindParams(p interface{}) (err error) {
+	c.read(func(t *Task) { err = t.BindParams(p) })
+	return
 }
 
 // SetData saves the data of the task
+// The data is persisted at the next checkpoint
 func (c Context) SetData(p interface{}) error {
-	// TODO
-	return nil
+	return c.update(func(t *Task) error { return t.TrySetData(p) })
 }
 
 // SetOutput saves the output of the task
 func (c Context) SetOutput(p interface{}) error {
-	// TODO
-	return nil
+	return c.update(func(t *Task) error { return t.TrySetOutput(p) })
+}
+
+// Emit appends a chunk to the output of the task, see Task.Emit
+func (c Context) Emit(chunk []byte) error {
+	return c.update(func(t *Task) error { return t.TryEmit(chunk) })
+}
+
+// Heartbeat reports the task is alive and persists the task, and picks
+// up a cancellation requested in the store
+// A long running task should call it periodically, otherwise it may be
+// reclaimed by the Sweeper
+func (c Context) Heartbeat() error {
+	err := c.update(func(t *Task) error {
+		t.Heartbeat()
+		return nil
+	})
+	if err != nil || c.dryRun {
+		return err
+	}
+	if err = c.syncCancel(); err != nil {
+		return err
+	}
+	c.read(func(t *Task) { err = c.taskHandle.Update(t) })
+	return err
+}
+
+// syncCancel merges a cancellation requested in the store, e.g. by
+// Cancel, into the running task, which would be overwritten by the
+// worker otherwise
+func (c Context) syncCancel() error {
+	if c.store == nil || c.dryRun {
+		return nil
+	}
+	stored, err := LoadTask(c.store, c.TaskID())
+	if err != nil || stored == nil {
+		return err
+	}
+	return c.update(func(t *Task) error {
+		t.mergeCancel(stored)
+		return nil
+	})
+}
+
+// SetProgress reports the percentage of completion of the task, when
+// not reported by a stage, the runner sets it by completed stages
+func (c Context) SetProgress(percent int) {
+	c.update(func(t *Task) error {
+		t.SetProgress(percent)
+		return nil
+	})
+}
+
+// AddMetric accumulates delta to the usage counter of the key, which is
+// persisted with the task for cost accounting
+func (c Context) AddMetric(key string, delta float64) {
+	c.update(func(t *Task) error {
+		t.AddMetric(key, delta)
+		return nil
+	})
+}
+
+// PutOutput saves the named output of a stage for downstream stages
+// The output is persisted with the task and survives resuming
+func (c Context) PutOutput(stage string, p interface{}) error {
+	return c.update(func(t *Task) error { return t.PutStageOutput(stage, p) })
+}
+
+// StageOutput retrieves the named output of a previous stage
+func (c Context) StageOutput(stage string, p interface{}) (err error) {
+	c.read(func(t *Task) { err = t.GetStageOutput(stage, p) })
+	return
 }
 
 // ResumeTo specifies the next stage when sub tasks finish
+// The task stops running further stages and waits for sub tasks
 func (c Context) ResumeTo(stage string) error {
-	// TODO
-	return nil
+	return c.update(func(t *Task) error {
+		if err := t.Transition(TaskWaiting); err != nil {
+			return err
+		}
+		t.Stage = stage
+		return nil
+	})
+}
+
+// Goto requests the runner to continue at the named stage, the result
+// must be returned by the TaskFn
+func (c Context) Goto(stage string) error {
+	return GotoStage(stage)
+}
+
+// GotoStageError is returned by a TaskFn to continue at the named stage
+// instead of the next one
+type GotoStageError struct {
+	Stage string // name of the target stage
+}
+
+// GotoStage creates a GotoStageError
+func GotoStage(stage string) error {
+	return &GotoStageError{Stage: stage}
+}
+
+// Error implements error
+func (e *GotoStageError) Error() string {
+	return "goto stage " + e.Stage
 }
 
+// MaxStageJumps is the max number of stage jumps in an execution of a
+// task, when exceeded the task is stucked, 0 means unlimited
+var MaxStageJumps = 100
+
 // NewTask starts creating a new sub task
 func (c Context) NewTask(name string) *TaskBuilder {
 	return &TaskBuilder{Submitter: c, Name: name}
 }
 
-// Fail creates a task error
+// Complete saves the output and completes the task successfully, the
+// remaining stages are skipped, and the task is completed when the
+// worker hands it over by TaskHandle.Done
+func (c Context) Complete(output interface{}) error {
+	return c.update(func(t *Task) error {
+		if err := t.TrySetOutput(output); err != nil {
+			return err
+		}
+		t.Result = TaskSuccess
+		t.SetProgress(100)
+		t.completing = true
+		return nil
+	})
+}
+
+// Fail creates a task error, returning it from a TaskFn fails the task
+// and skips the remaining stages
 func (c Context) Fail(err error) *TaskError {
-	t := c.Current()
-	return t.NewError(TaskErrFail).SetMessage("failed").CausedBy(err)
+	return c.newError(TaskErrFail).SetMessage("failed").CausedBy(err)
 }
 
 // FailRetry creates a task error with retry
 func (c Context) FailRetry(err error) *TaskError {
-	t := c.Current()
-	return t.NewError(TaskErrRetry).SetMessage("error").CausedBy(err)
+	return c.newError(TaskErrRetry).SetMessage("error").CausedBy(err)
 }
 
 // FailRollback creates a task error and rollback
 func (c Context) FailRollback(err error) *TaskError {
-	t := c.Current()
-	return t.NewError(TaskErrRevert).SetMessage("error, rollback").CausedBy(err)
+	return c.newError(TaskErrRevert).SetMessage("error, rollback").CausedBy(err)
 }
 
 // Stuck creates a stuck error
 func (c Context) Stuck(err error) *TaskError {
-	t := c.Current()
-	return t.NewError(TaskErrStuck).SetMessage("stucked!!").CausedBy(err)
+	return c.newError(TaskErrStuck).SetMessage("stucked!!").CausedBy(err)
+}
+
+// taskError returns the TaskError wrapped in err, or classifies err
+func (c Context) taskError(err error) *TaskError {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr
+	}
+	return c.classify(err)
+}
+
+// classify creates a task error from a plain error using ClassifyError
+func (c Context) classify(err error) *TaskError {
+	switch errType := ClassifyError(err); errType {
+	case TaskErrFail:
+		return c.Fail(err)
+	case TaskErrRetry:
+		return c.FailRetry(err)
+	case TaskErrRevert:
+		return c.FailRollback(err)
+	case TaskErrStuck:
+		return c.Stuck(err)
+	default:
+		return c.newError(errType).CausedBy(err)
+	}
 }
 
 // SubmitTask implements TaskSubmitter
+// The sub task inherits the job and trace of current task
 func (c Context) SubmitTask(task *Task) error {
-	task.JobID = c.JobID()
-	task.ParentID = c.TaskID()
-	// TODO
+	if err := c.adopt(task); err != nil {
+		return err
+	}
+	if spawned, err := c.spawned(task); err != nil || spawned {
+		return err
+	}
+	if c.dryRun {
+		log.Printf("dry-run: task %s: submit sub task %q", task.ParentID, task.Name)
+		return nil
+	}
+	return c.taskHandle.SubmitTask(task)
+}
+
+// SpawnTx submits sub tasks all or none if the TaskHandle implements
+// TransactionalSubmitter, otherwise they are submitted one by one and
+// stop at the first failure
+func (c Context) SpawnTx(tasks ...*Task) error {
+	parentID := c.TaskID()
+	var children []*Task
+	for _, child := range tasks {
+		if err := c.adopt(child); err != nil {
+			return err
+		}
+		spawned, err := c.spawned(child)
+		if err != nil {
+			return err
+		}
+		if !spawned {
+			children = append(children, child)
+		}
+	}
+	if c.dryRun {
+		for _, child := range children {
+			log.Printf("dry-run: task %s: submit sub task %q", parentID, child.Name)
+		}
+		return nil
+	}
+	txSubmitter, ok := c.taskHandle.(TransactionalSubmitter)
+	if !ok {
+		if len(children) > 1 {
+			log.Printf("task %s: submitter is not transactional, sub tasks may be partially submitted", parentID)
+		}
+		for _, child := range children {
+			if err := c.taskHandle.SubmitTask(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tx, err := txSubmitter.Begin()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err = tx.SubmitTask(child); err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("task %s: rollback sub tasks failed: %v", parentID, rollbackErr)
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MaxDepth is the max depth of sub tasks in a task tree whose root is at
+// depth 0, 0 means unlimited
+var MaxDepth = 0
+
+// adopt makes the task a sub task of current task, it fails with
+// MaxDepthExceededError if the sub task is too deep
+func (c Context) adopt(task *Task) error {
+	err := c.update(func(parent *Task) error {
+		depth := parent.Depth + 1
+		if MaxDepth > 0 && depth > MaxDepth {
+			return &MaxDepthExceededError{ParentID: parent.ID, Depth: depth, MaxDepth: MaxDepth}
+		}
+		if parent.TraceID == "" {
+			parent.TraceID = newID()
+		}
+		task.JobID = parent.JobID
+		task.ParentID = parent.ID
+		task.TraceID = parent.TraceID
+		task.Depth = depth
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if task.IdempotencyKey != "" && (task.ID == "" || task.idGenerated) {
+		task.ID, task.idGenerated = childID(task.ParentID, task.IdempotencyKey), false
+	}
 	return nil
 }
+
+// spawned determines if an adopted sub task was submitted by a previous
+// attempt of current task and shouldn't be submitted again, which is the
+// case unless it's stucked or completed without success, only sub tasks
+// with an IdempotencyKey have stable IDs across attempts to be found
+// A sub task spawned again replaces the existing one
+func (c Context) spawned(task *Task) (bool, error) {
+	if task.IdempotencyKey == "" || c.store == nil {
+		return false, nil
+	}
+	existing, err := LoadTask(c.store, task.ID)
+	if err != nil || existing == nil {
+		return false, err
+	}
+	if existing.State == TaskStucked || (existing.State.IsTerminal() && existing.Result != TaskSuccess) {
+		task.Version = existing.Version
+		return false, nil
+	}
+	return true, nil
+}
+
+// childID derives the ID of a sub task from the parent ID and the
+// idempotency key of the sub task
+func childID(parentID, key string) string {
+	sum := sha256.Sum256([]byte(parentID + "/" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ReportToParent pushes a result of current task to its parent, which
+// reads the results of all sub tasks using ChildReports, both require
+// the Store of the Dispatcher
+func (c Context) ReportToParent(v interface{}) error {
+	var id, parentID string
+	c.read(func(t *Task) { id, parentID = t.ID, t.ParentID })
+	if parentID == "" {
+		return ErrNoParent
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		log.Printf("dry-run: task %s: report to parent %s", id, parentID)
+		return nil
+	}
+	if c.store == nil {
+		return ErrNoStore
+	}
+	report := &childReport{TaskID: id, Value: encoded}
+	return c.store.Bucket(reportsBucket(parentID)).Put(id, report)
+}
+
+// ChildReports retrieves the results reported by sub tasks, keyed by
+// the sub task ids
+func (c Context) ChildReports() (map[string]json.RawMessage, error) {
+	if c.store == nil {
+		return nil, ErrNoStore
+	}
+	enum := c.store.Bucket(reportsBucket(c.TaskID())).Enumerate(EnumOptions{PageSize: ListPageSize})
+	reports := make(map[string]json.RawMessage)
+	for {
+		vals, err := enum.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 {
+			return reports, nil
+		}
+		for _, val := range vals {
+			if !val.Valid() {
+				continue
+			}
+			var report childReport
+			if err = val.Unmarshal(&report); err != nil {
+				return nil, err
+			}
+			reports[report.TaskID] = report.Value
+		}
+	}
+}
+
+type childReport struct {
+	TaskID string          `json:"task-id"`
+	Value  json.RawMessage `json:"value"`
+}
+
+func reportsBucket(parentID string) string {
+	return "reports:" + parentID
+}
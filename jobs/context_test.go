@@ -0,0 +1,576 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStageOutputs(t *testing.T) {
+	type summary struct {
+		Count int `json:"count"`
+	}
+	d := &Dispatcher{}
+	var got summary
+	d.AddTaskExecs(&TaskExec{
+		Name: "outputs",
+		Stages: []Stage{
+			{Name: "count", Fn: func(ctx Context) error {
+				return ctx.PutOutput("count", summary{Count: 42})
+			}},
+			{Name: "report", Fn: func(ctx Context) error {
+				return ctx.StageOutput("count", &got)
+			}},
+		},
+	})
+	task := newRunnable("outputs")
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if got.Count != 42 {
+		t.Errorf("expect output of stage count, got %+v", got)
+	}
+	encoded, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Task
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var persisted summary
+	if err = decoded.GetStageOutput("count", &persisted); err != nil || persisted.Count != 42 {
+		t.Errorf("expect stage output persisted, got %+v, %v", persisted, err)
+	}
+	var missing summary
+	if err = decoded.GetStageOutput("unknown", &missing); err != nil || missing.Count != 0 {
+		t.Errorf("expect missing output left unchanged, got %+v, %v", missing, err)
+	}
+}
+
+func TestTraceIDShared(t *testing.T) {
+	d := &Dispatcher{}
+	spawn := func(name string) TaskFn {
+		return func(ctx Context) error {
+			return ctx.SubmitTask(ctx.NewTask(name).Build())
+		}
+	}
+	d.AddTaskExecs(
+		singleStage("trace-root", spawn("trace-child")),
+		singleStage("trace-child", spawn("trace-leaf")),
+	)
+	root := newRunnable("trace-root")
+	root.JobID = "job"
+	h := runOnce(d, root)
+	if h.err != nil || len(h.submitted) != 1 {
+		t.Fatalf("expect a child spawned, got %v, %v", h.submitted, h.err)
+	}
+	if root.TraceID == "" || root.TraceID == root.JobID {
+		t.Fatalf("expect a TraceID generated on the root, got %q", root.TraceID)
+	}
+	child := h.submitted[0]
+	child.enqueue()
+	if h = runOnce(d, child); h.err != nil || len(h.submitted) != 1 {
+		t.Fatalf("expect a grandchild spawned, got %v, %v", h.submitted, h.err)
+	}
+	leaf := h.submitted[0]
+	for _, task := range []*Task{child, leaf} {
+		if task.TraceID != root.TraceID || task.JobID != root.JobID {
+			t.Errorf("task %s: expect trace %s in job %s, got %s in %s", task.Name, root.TraceID, root.JobID, task.TraceID, task.JobID)
+		}
+	}
+	if leaf.Depth != 2 || leaf.ParentID != child.ID {
+		t.Errorf("expect the leaf at depth 2 under the child, got %d under %s", leaf.Depth, leaf.ParentID)
+	}
+}
+
+func TestCancelMidStage(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	started := make(chan struct{})
+	d.AddTaskExecs(&TaskExec{
+		Name: "cancel-mid",
+		Stages: []Stage{
+			{Name: "loop", Fn: func(ctx Context) error {
+				close(started)
+				deadline := time.Now().Add(5 * time.Second)
+				for !ctx.IsCancelled() {
+					if time.Now().After(deadline) {
+						return errors.New("cancellation not observed")
+					}
+					if err := ctx.Heartbeat(); err != nil {
+						return err
+					}
+					time.Sleep(time.Millisecond)
+				}
+				return ctx.Err()
+			}},
+			{Name: "next", Fn: func(ctx Context) error {
+				t.Error("expect no stage run after cancellation")
+				return nil
+			}},
+		},
+	})
+	task := newRunnable("cancel-mid")
+	saveTasks(t, store, task)
+	go func() {
+		<-started
+		if err := Cancel(store, task.ID, "user"); err != nil {
+			t.Error(err)
+		}
+	}()
+	h := runOnce(d, loadTask(t, store, task.ID))
+	if !errors.Is(h.err, ErrTaskCanceled) {
+		t.Fatalf("expect canceled, got %v", h.err)
+	}
+	if h.task.State != TaskCompleted || h.task.Result != TaskAborted {
+		t.Errorf("expect completed as aborted, got %s/%s", h.task.State, h.task.Result)
+	}
+}
+
+func TestReportToParent(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	var reports map[string]json.RawMessage
+	d.AddTaskExecs(
+		singleStage("report-child", func(ctx Context) error {
+			var n int
+			if err := ctx.GetParams(&n); err != nil {
+				return err
+			}
+			return ctx.ReportToParent(map[string]int{"n": n})
+		}),
+		singleStage("report-parent", func(ctx Context) (err error) {
+			reports, err = ctx.ChildReports()
+			return err
+		}),
+	)
+	parent := newRunnable("report-parent")
+	var wg sync.WaitGroup
+	children := make([]*Task, 3)
+	for i := range children {
+		child := NewTask("report-child").With(i).Build()
+		child.ParentID = parent.ID
+		child.enqueue()
+		children[i] = child
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h := runOnce(d, child); h.err != nil {
+				t.Error(h.err)
+			}
+		}()
+	}
+	wg.Wait()
+	if h := runOnce(d, parent); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("expect 3 reports, got %v", reports)
+	}
+	for i, child := range children {
+		if want := fmt.Sprintf(`{"n":%d}`, i); string(reports[child.ID]) != want {
+			t.Errorf("child %d: expect %s, got %s", i, want, reports[child.ID])
+		}
+	}
+}
+
+func TestReportToParentErrors(t *testing.T) {
+	var errs []error
+	fn := func(ctx Context) error {
+		errs = append(errs, ctx.ReportToParent(1))
+		_, err := ctx.ChildReports()
+		errs = append(errs, err)
+		return nil
+	}
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("report-errors", fn))
+	runOnce(d, newRunnable("report-errors"))
+	child := newRunnable("report-errors")
+	child.ParentID = "parent"
+	runOnce(d, child)
+	want := []error{ErrNoParent, ErrNoStore, ErrNoStore, ErrNoStore}
+	if len(errs) != len(want) {
+		t.Fatalf("expect %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, want[i]) {
+			t.Errorf("call %d: expect %v, got %v", i, want[i], err)
+		}
+	}
+}
+
+func TestContextAsContext(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	var deadline time.Time
+	var hasDeadline bool
+	var errBefore error
+	useContext := func(ctx context.Context) {
+		deadline, hasDeadline = ctx.Deadline()
+		errBefore = ctx.Err()
+		if ctx.Value("missing") != nil {
+			t.Error("expect no value")
+		}
+		select {
+		case <-ctx.Done():
+			t.Error("expect not done")
+		default:
+		}
+	}
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("as-context", func(ctx Context) error {
+		useContext(ctx)
+		return nil
+	}))
+	task := newRunnable("as-context")
+	task.ensureStats().ExpireAt = expireAt
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if !hasDeadline || !deadline.Equal(expireAt) || errBefore != nil {
+		t.Errorf("expect the deadline from ExpireAt, got %s/%v, %v", deadline, hasDeadline, errBefore)
+	}
+}
+
+func TestCompleteEarly(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	var runs []string
+	d.AddTaskExecs(&TaskExec{Name: "complete-early", Stages: []Stage{
+		{Name: "a", Fn: func(ctx Context) error {
+			runs = append(runs, "a")
+			return ctx.Complete("shortcut")
+		}},
+		{Name: "b", Fn: func(ctx Context) error {
+			runs = append(runs, "b")
+			return nil
+		}},
+	}})
+	task := newRunnable("complete-early")
+	if h := runOnce(d, task); h.err != nil || !h.done {
+		t.Fatalf("expect done without error, got %v", h.err)
+	}
+	if len(runs) != 1 {
+		t.Errorf("expect later stages skipped, got %v", runs)
+	}
+	stored := loadTask(t, store, task.ID)
+	var output string
+	if err := stored.GetOutput(&output); err != nil || output != "shortcut" {
+		t.Errorf("expect the output saved, got %q, %v", output, err)
+	}
+	if stored.State != TaskCompleted || stored.Result != TaskSuccess || stored.Progress != 100 {
+		t.Errorf("expect completed successfully, got %s/%s at %d%%", stored.State, stored.Result, stored.Progress)
+	}
+}
+
+func TestFailEarly(t *testing.T) {
+	errBad := errors.New("bad input")
+	d := &Dispatcher{}
+	later := false
+	d.AddTaskExecs(&TaskExec{Name: "fail-early", Stages: []Stage{
+		{Name: "a", Fn: func(ctx Context) error { return ctx.Fail(errBad) }},
+		{Name: "b", Fn: func(ctx Context) error {
+			later = true
+			return nil
+		}},
+	}})
+	task := newRunnable("fail-early")
+	task.MaxRetries = 3
+	h := runOnce(d, task)
+	if later {
+		t.Error("expect later stages skipped")
+	}
+	if h.err == nil || h.err.Type != TaskErrFail || !errors.Is(h.err, errBad) {
+		t.Fatalf("expect the failure recorded, got %v", h.err)
+	}
+	if task.State != TaskCompleted || task.Result != TaskFailure || len(task.Errors) != 1 {
+		t.Errorf("expect failed without retries, got %s/%s, %v", task.State, task.Result, task.Errors)
+	}
+}
+
+func TestAddMetric(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	errFlaky := errors.New("flaky")
+	failed := false
+	d.AddTaskExecs(&TaskExec{Name: "metered", Stages: []Stage{
+		{Name: "read", Fn: func(ctx Context) error {
+			ctx.AddMetric("bytes", 1024)
+			ctx.AddMetric("cpu-seconds", 0.5)
+			return nil
+		}},
+		{Name: "write", Fn: func(ctx Context) error {
+			ctx.AddMetric("bytes", 512)
+			ctx.AddMetric("cpu-seconds", 1.25)
+			if !failed {
+				failed = true
+				return ctx.FailRetry(errFlaky)
+			}
+			return nil
+		}},
+	}})
+	task := newRunnable("metered")
+	task.MaxRetries = 1
+	saveTasks(t, store, task)
+	runOnce(d, task)
+	// the retry resumes from the write stage
+	runOnce(d, loadTask(t, store, task.ID))
+	stored := loadTask(t, store, task.ID)
+	if stored.State != TaskCompleted {
+		t.Fatalf("expect completed, got %s", stored.State)
+	}
+	if stored.Metrics["bytes"] != 2048 || stored.Metrics["cpu-seconds"] != 3 {
+		t.Errorf("expect metrics accumulated across stages and attempts, got %v", stored.Metrics)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	var beta, legacy, unset bool
+	d.AddTaskExecs(singleStage("flagged", func(ctx Context) error {
+		beta, legacy, unset = ctx.Flag("beta"), ctx.Flag("legacy"), ctx.Flag("unset")
+		return nil
+	}))
+	task := NewTask("flagged").WithFlag("beta", true).WithFlag("legacy", false).Build()
+	task.enqueue()
+	saveTasks(t, store, task)
+	runOnce(d, loadTask(t, store, task.ID))
+	if !beta || legacy || unset {
+		t.Errorf("expect flags read in the stage, got beta=%v legacy=%v unset=%v", beta, legacy, unset)
+	}
+	if stored := loadTask(t, store, task.ID); !stored.Flags["beta"] || len(stored.Flags) != 2 {
+		t.Errorf("expect flags persisted, got %v", stored.Flags)
+	}
+}
+
+func TestEmitResumed(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	var crashed *Task
+	d.AddTaskExecs(&TaskExec{Name: "emit-resume", Stages: []Stage{
+		{Name: "a", Fn: func(ctx Context) error {
+			return ctx.Emit([]byte("a\n"))
+		}},
+		{Name: "b", Fn: func(ctx Context) error {
+			if err := ctx.Emit([]byte("b1\n")); err != nil {
+				return err
+			}
+			if crashed == nil {
+				// the worker crashes after the emitted output is persisted
+				if err := ctx.Heartbeat(); err != nil {
+					return err
+				}
+				crashed = loadTask(t, store, ctx.TaskID())
+				return ctx.FailRetry(errors.New("crash"))
+			}
+			return ctx.Emit([]byte("b2\n"))
+		}},
+	}})
+	task := newRunnable("emit-resume")
+	task.MaxRetries = 1
+	saveTasks(t, store, task)
+	runOnce(d, loadTask(t, store, task.ID))
+	if crashed == nil || string(crashed.Output) != "a\nb1\n" || crashed.OutputOffset != 2 {
+		t.Fatalf("expect the output persisted mid-stage, got %+v", crashed)
+	}
+
+	// another worker resumes from the snapshot persisted before the crash
+	crashed.State = TaskPending
+	h := runOnce(&Dispatcher{Tasks: d.Tasks}, crashed)
+	if h.err != nil {
+		t.Fatal(h.err)
+	}
+	if string(crashed.Output) != "a\nb1\nb2\n" {
+		t.Errorf("expect no duplicated output, got %q", crashed.Output)
+	}
+	if crashed.OutputOffset != len("a\nb1\nb2\n") {
+		t.Errorf("expect the offset at the end of the output, got %d", crashed.OutputOffset)
+	}
+}
+
+// txHandle is a testHandle submitting sub tasks in transactions, the
+// failAt-th submission in a transaction fails
+type txHandle struct {
+	*testHandle
+	failAt     int
+	rolledBack bool
+}
+
+func (h *txHandle) Begin() (SubmitTransaction, error) {
+	return &memTx{handle: h}, nil
+}
+
+type memTx struct {
+	handle *txHandle
+	tasks  []*Task
+}
+
+func (tx *memTx) SubmitTask(task *Task) error {
+	tx.tasks = append(tx.tasks, task)
+	if len(tx.tasks) == tx.handle.failAt {
+		return errors.New("submit failed")
+	}
+	return nil
+}
+
+func (tx *memTx) Commit() error {
+	for _, task := range tx.tasks {
+		if err := tx.handle.testHandle.SubmitTask(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	tx.handle.rolledBack = true
+	return nil
+}
+
+func TestSpawnTx(t *testing.T) {
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("spawn-tx", func(ctx Context) error {
+		var children []*Task
+		for i := 0; i < 3; i++ {
+			children = append(children, ctx.NewTask("spawn-tx-child").Build())
+		}
+		return ctx.SpawnTx(children...)
+	}))
+	run := func(h TaskHandle) {
+		(&localWorker{dispatcher: d}).runTaskByHandle(h)
+	}
+
+	store := newMemStore()
+	parent := newRunnable("spawn-tx")
+	failing := &txHandle{testHandle: newTestHandle(parent, store), failAt: 3}
+	run(failing)
+	if !failing.rolledBack || failing.err == nil || !strings.Contains(failing.err.Error(), "submit failed") {
+		t.Errorf("expect rolled back with the error, got %v", failing.err)
+	}
+	if children, err := ListTasks(store, Filter{ParentID: parent.ID}); err != nil || len(children) != 0 {
+		t.Errorf("expect no children persisted, got %d, %v", len(children), err)
+	}
+
+	parent = newRunnable("spawn-tx")
+	committed := &txHandle{testHandle: newTestHandle(parent, store)}
+	run(committed)
+	if committed.rolledBack || committed.err != nil {
+		t.Errorf("expect committed, got %v", committed.err)
+	}
+	if children, err := ListTasks(store, Filter{ParentID: parent.ID}); err != nil || len(children) != 3 {
+		t.Errorf("expect all children persisted, got %d, %v", len(children), err)
+	}
+
+	plain := newTestHandle(newRunnable("spawn-tx"), nil)
+	run(plain)
+	if plain.err != nil || len(plain.submitted) != 3 {
+		t.Errorf("expect submitted one by one without transactions, got %d, %v", len(plain.submitted), plain.err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	saved := MaxDepth
+	MaxDepth = 2
+	t.Cleanup(func() { MaxDepth = saved })
+
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("recurse", func(ctx Context) error {
+		_, err := ctx.NewTask("recurse").Submit()
+		return err
+	}))
+	task := newRunnable("recurse")
+	for depth := 0; depth < 2; depth++ {
+		h := runOnce(d, task)
+		if h.err != nil || len(h.submitted) != 1 {
+			t.Fatalf("depth %d: expect a sub task spawned, got %v", depth, h.err)
+		}
+		child := h.submitted[0]
+		if child.Depth != depth+1 || child.ParentID != task.ID {
+			t.Fatalf("depth %d: expect a child at depth %d, got %d", depth, depth+1, child.Depth)
+		}
+		task = child
+	}
+	h := runOnce(d, task)
+	var exceeded *MaxDepthExceededError
+	if !errors.As(h.err, &exceeded) || !errors.Is(h.err, ErrMaxDepthExceeded) || len(h.submitted) != 0 {
+		t.Fatalf("expect MaxDepthExceededError, got %v", h.err)
+	}
+	if exceeded.ParentID != task.ID || exceeded.Depth != 3 || exceeded.MaxDepth != 2 {
+		t.Errorf("unexpected %+v", exceeded)
+	}
+}
+
+func TestRespawnOnRetry(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	keys := []string{"succeeded", "failed", "stucked", "pending"}
+	attempts := 0
+	d.AddTaskExecs(singleStage("respawn", func(ctx Context) error {
+		attempts++
+		for _, key := range keys {
+			if err := ctx.SubmitTask(ctx.NewTask("respawn-child").SetIdempotencyKey(key).Build()); err != nil {
+				return err
+			}
+		}
+		if attempts == 1 {
+			return ctx.FailRetry(errors.New("flaky"))
+		}
+		return nil
+	}))
+	parent := newRunnable("respawn")
+	parent.MaxRetries = 1
+	first := runOnce(d, parent)
+	if len(first.submitted) != len(keys) {
+		t.Fatalf("expect all children spawned, got %d", len(first.submitted))
+	}
+	ids := make(map[string]string)
+	for _, child := range first.submitted {
+		ids[child.IdempotencyKey] = child.ID
+	}
+	if ids["failed"] != childID(parent.ID, "failed") {
+		t.Errorf("expect the child ID derived from the parent, got %s", ids["failed"])
+	}
+
+	finish := func(key string, state TaskState, result TaskResult) {
+		child := loadTask(t, store, ids[key])
+		child.Transition(TaskRunning)
+		child.Result = result
+		child.Transition(state)
+		saveTasks(t, store, child)
+	}
+	finish("succeeded", TaskCompleted, TaskSuccess)
+	finish("failed", TaskCompleted, TaskFailure)
+	finish("stucked", TaskStucked, TaskSuccess)
+
+	if parent.State != TaskPending {
+		t.Fatalf("expect the parent pending for a retry, got %s", parent.State)
+	}
+	second := runOnce(d, parent)
+	if second.err != nil {
+		t.Fatal(second.err)
+	}
+	var respawned []string
+	for _, child := range second.submitted {
+		respawned = append(respawned, child.IdempotencyKey)
+		if child.ID != ids[child.IdempotencyKey] {
+			t.Errorf("expect the same ID of %s, got %s", child.IdempotencyKey, child.ID)
+		}
+	}
+	if got := strings.Join(respawned, ","); got != "failed,stucked" {
+		t.Errorf("expect only unsuccessful children spawned again, got %s", got)
+	}
+	for _, key := range []string{"failed", "stucked"} {
+		if child := loadTask(t, store, ids[key]); child.State.IsTerminal() || child.State == TaskStucked {
+			t.Errorf("expect %s replaced by a new one, got %s", key, child.State)
+		}
+	}
+	if child := loadTask(t, store, ids["succeeded"]); child.State != TaskCompleted || child.Result != TaskSuccess {
+		t.Errorf("expect the succeeded child kept, got %s/%s", child.State, child.Result)
+	}
+}
@@ -0,0 +1,113 @@
+package jobs
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// KeyFunc derives the key identifying the same task
+type KeyFunc func(*Task) string
+
+// IdempotencyKeyOf is the default KeyFunc using Task.IdempotencyKey
+func IdempotencyKeyOf(t *Task) string {
+	return t.IdempotencyKey
+}
+
+// DefaultDedupeWindow is used by a Deduper without Window
+var DefaultDedupeWindow = time.Hour
+
+// DefaultDedupeKeys is used by a Deduper without MaxKeys
+var DefaultDedupeKeys = 10000
+
+// Deduper is a TaskSubmitter which drops tasks already submitted
+// within the window
+type Deduper struct {
+	Submitter TaskSubmitter
+	// KeyFunc identifies the same task, IdempotencyKeyOf is used if nil
+	// A task with an empty key is never deduped
+	KeyFunc KeyFunc
+	// Window is how long a key is remembered, DefaultDedupeWindow if 0
+	Window time.Duration
+	// MaxKeys is the max number of remembered keys, the oldest keys are
+	// forgotten first, DefaultDedupeKeys if 0
+	MaxKeys int
+	// Now returns the current time, time.Now is used if nil
+	Now func() time.Time
+
+	lock  sync.Mutex
+	seen  map[string]*list.Element
+	order list.List // of dedupeEntry, oldest first
+}
+
+type dedupeEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// SubmitTask implements TaskSubmitter
+func (d *Deduper) SubmitTask(task *Task) error {
+	keyFn := d.KeyFunc
+	if keyFn == nil {
+		keyFn = IdempotencyKeyOf
+	}
+	key := keyFn(task)
+	if key == "" {
+		return d.Submitter.SubmitTask(task)
+	}
+
+	now := d.now()
+	d.lock.Lock()
+	d.evict(now, 0)
+	if d.seen[key] != nil {
+		d.lock.Unlock()
+		return nil
+	}
+	if d.seen == nil {
+		d.seen = make(map[string]*list.Element)
+	}
+	d.evict(now, 1)
+	elem := d.order.PushBack(dedupeEntry{key: key, seenAt: now})
+	d.seen[key] = elem
+	d.lock.Unlock()
+
+	err := d.Submitter.SubmitTask(task)
+	if err != nil {
+		d.lock.Lock()
+		if d.seen[key] == elem {
+			d.forget(elem)
+		}
+		d.lock.Unlock()
+	}
+	return err
+}
+
+// evict forgets the keys out of the window, and the oldest keys
+// to leave room for the number of new ones
+func (d *Deduper) evict(now time.Time, room int) {
+	window, maxKeys := d.Window, d.MaxKeys
+	if window <= 0 {
+		window = DefaultDedupeWindow
+	}
+	if maxKeys <= 0 {
+		maxKeys = DefaultDedupeKeys
+	}
+	for elem := d.order.Front(); elem != nil; elem = d.order.Front() {
+		if d.order.Len()+room <= maxKeys && now.Sub(elem.Value.(dedupeEntry).seenAt) < window {
+			break
+		}
+		d.forget(elem)
+	}
+}
+
+func (d *Deduper) forget(elem *list.Element) {
+	delete(d.seen, elem.Value.(dedupeEntry).key)
+	d.order.Remove(elem)
+}
+
+func (d *Deduper) now() time.Time {
+	if d.Now != nil {
+		return d.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,92 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// taskRecorder records submitted tasks, failing with err if set
+type taskRecorder struct {
+	tasks []*Task
+	err   error
+}
+
+func (r *taskRecorder) SubmitTask(task *Task) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.tasks = append(r.tasks, task)
+	return nil
+}
+
+func TestDeduperKeyFunc(t *testing.T) {
+	r := &taskRecorder{}
+	d := &Deduper{Submitter: r, KeyFunc: func(t *Task) string {
+		return t.Name + "/" + t.Labels["tenant"] + "/" + t.Fingerprint()
+	}}
+	build := func(tenant string, priority int) *Task {
+		return NewTask("dedupe").With(map[string]int{"n": 1}).WithLabel("tenant", tenant).WithPriority(priority).Build()
+	}
+	for _, task := range []*Task{build("t1", 1), build("t1", 2), build("t2", 1)} {
+		if err := d.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.tasks) != 2 || r.tasks[1].Labels["tenant"] != "t2" {
+		t.Errorf("expect tasks of the same name, tenant and params deduped, got %d", len(r.tasks))
+	}
+}
+
+func TestDeduperIdempotencyKey(t *testing.T) {
+	errSubmit := errors.New("submit failed")
+	r := &taskRecorder{err: errSubmit}
+	d := &Deduper{Submitter: r}
+	if err := d.SubmitTask(NewTask("a").SetIdempotencyKey("k").Build()); !errors.Is(err, errSubmit) {
+		t.Fatalf("expect the submit error, got %v", err)
+	}
+	r.err = nil
+	for _, task := range []*Task{
+		NewTask("a").SetIdempotencyKey("k").Build(),
+		NewTask("b").SetIdempotencyKey("k").Build(),
+		NewTask("a").Build(),
+		NewTask("a").Build(),
+	} {
+		if err := d.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.tasks) != 3 {
+		t.Errorf("expect a failed submission retried and tasks without keys kept, got %d", len(r.tasks))
+	}
+}
+
+func TestDeduperEviction(t *testing.T) {
+	clock := newFakeClock()
+	r := &taskRecorder{}
+	d := &Deduper{Submitter: r, Window: time.Minute, MaxKeys: 2, Now: clock.Now}
+	submit := func(key string) {
+		if err := d.SubmitTask(NewTask("evicted").SetIdempotencyKey(key).Build()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	submit("a")
+	clock.Advance(30 * time.Second)
+	submit("a")
+	if len(r.tasks) != 1 {
+		t.Fatalf("expect deduped within the window, got %d", len(r.tasks))
+	}
+	clock.Advance(30 * time.Second)
+	if submit("a"); len(r.tasks) != 2 {
+		t.Fatalf("expect the key forgotten after the window, got %d", len(r.tasks))
+	}
+
+	submit("b")
+	submit("c")
+	if submit("a"); len(r.tasks) != 5 || len(d.seen) != 2 {
+		t.Errorf("expect the oldest key forgotten beyond MaxKeys, got %d submitted, %d remembered", len(r.tasks), len(d.seen))
+	}
+	if submit("c"); len(r.tasks) != 5 {
+		t.Errorf("expect recent keys remembered, got %d", len(r.tasks))
+	}
+}
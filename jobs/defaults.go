@@ -0,0 +1,69 @@
+package jobs
+
+import "sync"
+
+var (
+	defaultsLock      sync.RWMutex
+	defaultMaxRetries = make(map[string]uint)
+	errorClassifier   ErrorClassifier
+	nameNormalizer    func(string) string
+)
+
+// ErrorClassifier determines the TaskErrorType of a plain error
+// returned by a TaskFn
+type ErrorClassifier func(error) TaskErrorType
+
+// SetDefaultMaxRetries specifies MaxRetries of tasks with the name
+// which are built without an explicit value
+func SetDefaultMaxRetries(name string, n uint) {
+	name = NormalizeName(name)
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	defaultMaxRetries[name] = n
+}
+
+// DefaultMaxRetries returns the default MaxRetries of the task name
+func DefaultMaxRetries(name string) uint {
+	name = NormalizeName(name)
+	defaultsLock.RLock()
+	defer defaultsLock.RUnlock()
+	return defaultMaxRetries[name]
+}
+
+// SetErrorClassifier specifies the ErrorClassifier, nil classifies all
+// plain errors as TaskErrFail
+func SetErrorClassifier(fn ErrorClassifier) {
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	errorClassifier = fn
+}
+
+// ClassifyError determines the TaskErrorType of a plain error
+func ClassifyError(err error) TaskErrorType {
+	defaultsLock.RLock()
+	fn := errorClassifier
+	defaultsLock.RUnlock()
+	if fn == nil {
+		return TaskErrFail
+	}
+	return fn(err)
+}
+
+// SetNameNormalizer specifies the function canonicalizing task names when
+// tasks are built and task names are looked up, nil keeps names unchanged
+func SetNameNormalizer(fn func(string) string) {
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	nameNormalizer = fn
+}
+
+// NormalizeName canonicalizes a task name
+func NormalizeName(name string) string {
+	defaultsLock.RLock()
+	fn := nameNormalizer
+	defaultsLock.RUnlock()
+	if fn == nil {
+		return name
+	}
+	return fn(name)
+}
@@ -0,0 +1,129 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// setDefaultMaxRetries registers the default for the test
+func setDefaultMaxRetries(t *testing.T, name string, n uint) {
+	SetDefaultMaxRetries(name, n)
+	name = NormalizeName(name)
+	t.Cleanup(func() {
+		defaultsLock.Lock()
+		defer defaultsLock.Unlock()
+		delete(defaultMaxRetries, name)
+	})
+}
+
+func TestDefaultMaxRetries(t *testing.T) {
+	setDefaultMaxRetries(t, "defaults", 5)
+	r := &taskRecorder{}
+	implicit, err := (&TaskBuilder{Submitter: r, Name: "defaults"}).Submit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicit.MaxRetries != 5 {
+		t.Errorf("expect the default inherited, got %d", implicit.MaxRetries)
+	}
+	for _, n := range []uint{0, 2} {
+		explicit, err := (&TaskBuilder{Submitter: r, Name: "defaults"}).SetMaxRetries(n).Submit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explicit.MaxRetries != n {
+			t.Errorf("expect the explicit %d to win, got %d", n, explicit.MaxRetries)
+		}
+	}
+	if other := NewTask("defaults-other").Build(); other.MaxRetries != 0 {
+		t.Errorf("expect no default for other names, got %d", other.MaxRetries)
+	}
+}
+
+func TestErrorClassifier(t *testing.T) {
+	t.Cleanup(func() { SetErrorClassifier(nil) })
+	errInvalid := errors.New("invalid input")
+	errBusy := errors.New("busy")
+	var returned error
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("classified", func(ctx Context) error {
+		return returned
+	}))
+	run := func(err error) *TaskError {
+		returned = err
+		task := newRunnable("classified")
+		task.MaxRetries = 1
+		return runOnce(d, task).err
+	}
+
+	if taskErr := run(errBusy); taskErr == nil || taskErr.Type != TaskErrFail {
+		t.Errorf("expect plain errors failed without a classifier, got %v", taskErr)
+	}
+	SetErrorClassifier(func(err error) TaskErrorType {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errBusy):
+			return TaskErrRetry
+		case errors.Is(err, errInvalid):
+			return TaskErrFail
+		default:
+			return TaskErrStuck
+		}
+	})
+	for _, c := range []struct {
+		err  error
+		want TaskErrorType
+	}{
+		{context.DeadlineExceeded, TaskErrRetry},
+		{fmt.Errorf("call: %w", errBusy), TaskErrRetry},
+		{errInvalid, TaskErrFail},
+		{errors.New("unknown"), TaskErrStuck},
+	} {
+		if taskErr := run(c.err); taskErr == nil || taskErr.Type != c.want || !errors.Is(taskErr, c.err) {
+			t.Errorf("%v: expect type %d, got %v", c.err, c.want, taskErr)
+		}
+	}
+	explicit := run(NewTaskError("", TaskErrRevert))
+	if explicit == nil || explicit.Type != TaskErrRevert {
+		t.Errorf("expect a TaskError not classified, got %v", explicit)
+	}
+}
+
+func TestNameNormalizer(t *testing.T) {
+	if NormalizeName(" Import ") != " Import " {
+		t.Error("expect names unchanged by default")
+	}
+	SetNameNormalizer(func(name string) string {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "import-data" {
+			return "import"
+		}
+		return name
+	})
+	t.Cleanup(func() { SetNameNormalizer(nil) })
+
+	d := &Dispatcher{}
+	runs := 0
+	d.AddTaskExecs(singleStage("import", func(ctx Context) error {
+		runs++
+		return nil
+	}))
+	for _, name := range []string{"Import", " IMPORT ", "import-data"} {
+		task := NewTask(name).Build()
+		if task.Name != "import" {
+			t.Errorf("%q: expect the canonical name, got %q", name, task.Name)
+		}
+		task.enqueue()
+		if h := runOnce(d, task); h.err != nil {
+			t.Errorf("%q: expect resolved, got %v", name, h.err)
+		}
+		if d.findTaskExec(name) == nil {
+			t.Errorf("%q: expect found in the registry", name)
+		}
+	}
+	if runs != 3 {
+		t.Errorf("expect 3 runs, got %d", runs)
+	}
+}
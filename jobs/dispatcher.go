@@ -1,6 +1,14 @@
 package jobs
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
 
 // Strategy is the contract for scheduling strategy
 type Strategy interface {
@@ -9,11 +17,16 @@ type Strategy interface {
 }
 
 // WorkerStrategy is strategy instance per worker
+// FetchTask claims a pending task, the worker moves it to TaskRunning
+// when it starts running
 type WorkerStrategy interface {
 	FetchTask() (TaskHandle, error)
 }
 
 // TaskHandle is the handle of a running task owned by a worker
+// Done hands the task over when the execution ends, it makes the
+// terminal transition, e.g. TaskCompleted without an error, as the
+// worker never completes the task by itself
 type TaskHandle interface {
 	Task() *Task
 	SubmitTask(*Task) error
@@ -21,11 +34,120 @@ type TaskHandle interface {
 	Done(*TaskError) error
 }
 
+// WorkerFilter selects the tasks a worker runs
+type WorkerFilter struct {
+	Queues       []string          // queues of the tasks, all queues if empty
+	Capabilities map[string]string // capabilities satisfying the requirements
+}
+
+// Match determines if the task is in the queues and its requirements are
+// satisfied by the capabilities
+func (f WorkerFilter) Match(task *Task) bool {
+	return task.inQueues(f.Queues) && task.SatisfiedBy(f.Capabilities)
+}
+
+// FilteredStrategy is optionally implemented by Strategy to create workers
+// never claiming the tasks not matched by the filter, otherwise such
+// tasks are released by the worker after claimed
+type FilteredStrategy interface {
+	NewFilteredWorker(WorkerFilter) WorkerStrategy
+}
+
+// TaskReleaser is optionally implemented by TaskHandle to give up
+// a claimed task and leave it pending
+type TaskReleaser interface {
+	Release() error
+}
+
+// TransactionalSubmitter is optionally implemented by TaskHandle to
+// submit sub tasks atomically
+type TransactionalSubmitter interface {
+	Begin() (SubmitTransaction, error)
+}
+
+// SubmitTransaction submits tasks which are persisted only when committed
+type SubmitTransaction interface {
+	SubmitTask(*Task) error
+	Commit() error
+	Rollback() error
+}
+
+// PersistPolicy defines when a running task is persisted between stages
+type PersistPolicy int
+
+// Persist policies
+const (
+	PersistStages    PersistPolicy = iota // every CheckpointStages stages, the default
+	PersistDebounced                      // at most once per CheckpointInterval
+	PersistTerminal                       // only when the task finishes
+)
+
 // Dispatcher submits jobs and executes tasks
 type Dispatcher struct {
 	Strategy Strategy
 	Store    Store
 	Tasks    []*TaskExec
+
+	// DryRun runs tasks without persisting any changes, hooks are
+	// suppressed, the cache is bypassed, and a finished task is neither
+	// done nor released with its handle, so it's not run again
+	DryRun bool
+
+	// PersistPolicy trades durability of running tasks for throughput,
+	// a task is always persisted before a stage with Checkpoint set
+	PersistPolicy PersistPolicy
+	// CheckpointStages is the number of successful stages between
+	// persisting Data/Stage of a running task, 0 means every stage
+	CheckpointStages int
+	// CheckpointInterval is the min duration between persisting a running
+	// task with PersistDebounced
+	CheckpointInterval time.Duration
+
+	// Concurrency limits in-flight executions per task name across
+	// workers, names absent or 0 use DefaultConcurrency
+	Concurrency map[string]int
+	// DefaultConcurrency limits in-flight executions of other task
+	// names, 0 means unlimited
+	DefaultConcurrency int
+	// ConcurrencyKey derives a dynamic key from a task, e.g. a label
+	// value, tasks with the same non-empty key are limited by
+	// KeyConcurrency across workers
+	ConcurrencyKey func(*Task) string
+	// KeyConcurrency limits in-flight executions per ConcurrencyKey, 0
+	// means unlimited
+	KeyConcurrency int
+
+	// Timeouts are the default timeouts of tasks and stages, see
+	// Task.EffectiveDeadline
+	Timeouts Durations
+
+	// HardTimeout is the max duration of a stage, when exceeded, the
+	// stage is abandoned and the task is stucked, 0 means no limit
+	// The abandoned stage keeps running in a leaked goroutine which may
+	// still hold resources, though its Context fails with ErrTaskDetached
+	// on mutating the task, so only use it as the last resort against
+	// stages ignoring cancellation
+	HardTimeout time.Duration
+
+	// RetryWarnThreshold is the fraction of MaxRetries, e.g. 0.8, when
+	// first reached OnRetryWarn is invoked, 0 disables the warning
+	RetryWarnThreshold float64
+	// OnRetryWarn is invoked when a task is going to retry beyond
+	// RetryWarnThreshold
+	OnRetryWarn func(*Task)
+
+	// RetryPolicy delays retried tasks fetched by the workers, only
+	// RetryAfter of the errors applies if nil, see Task.NextAction
+	RetryPolicy RetryPolicy
+
+	// Now returns the current time for checking the run window of tasks,
+	// time.Now is used if nil
+	Now func() time.Time
+
+	lock      sync.Mutex
+	limits    map[string]chan struct{}
+	keyCounts map[string]int
+	keyFreed  *sync.Cond
 }
 
 // Worker executes tasks
@@ -50,72 +172,697 @@ func (d *Dispatcher) AddTaskExecs(execs ...*TaskExec) {
 }
 
 // Worker spawns a worker`
-func (d *Dispatcher) Worker() Worker {
-	return &localWorker{dispatcher: d, strategy: d.Strategy.NewWorker()}
+// The worker only runs tasks in the queues, all queues if none is
+// specified, other fetched tasks are released
+func (d *Dispatcher) Worker(queues ...string) Worker {
+	return d.newWorker(WorkerFilter{Queues: queues})
+}
+
+// CapableWorker spawns a worker only running tasks whose requirements are
+// satisfied by the capabilities, in the queues like Worker
+func (d *Dispatcher) CapableWorker(capabilities map[string]string, queues ...string) Worker {
+	return d.newWorker(WorkerFilter{Queues: queues, Capabilities: capabilities})
 }
 
-func (d *Dispatcher) findStage(name, stage string) *Stage {
+func (d *Dispatcher) newWorker(filter WorkerFilter) *localWorker {
+	w := &localWorker{dispatcher: d, filter: filter}
+	if strategy, ok := d.Strategy.(FilteredStrategy); ok {
+		w.strategy = strategy.NewFilteredWorker(filter)
+	} else {
+		w.strategy = d.Strategy.NewWorker()
+	}
+	return w
+}
+
+// ParamsSchema generates the JSON schema of params for the task name
+// It returns nil if the task doesn't specify a sample of params
+func (d *Dispatcher) ParamsSchema(name string) ([]byte, error) {
+	name = NormalizeName(name)
 	for _, t := range d.Tasks {
-		if t.Name != name || len(t.Stages) == 0 {
-			continue
-		}
-		if stage == "" {
-			return &t.Stages[0]
+		if NormalizeName(t.Name) == name {
+			return t.ParamsSchema()
 		}
-		for _, s := range t.Stages {
-			if s.Name == stage {
-				return &s
-			}
+	}
+	return nil, nil
+}
+
+func (d *Dispatcher) findTaskExec(name string) *TaskExec {
+	name = NormalizeName(name)
+	for _, t := range d.Tasks {
+		if NormalizeName(t.Name) == name {
+			return t
 		}
 	}
 	return nil
 }
 
+// shouldPersist determines if a running task is persisted according to
+// PersistPolicy, given the stages completed and the time since persisted
+func (d *Dispatcher) shouldPersist(completed int, persistedAt time.Time) bool {
+	switch d.PersistPolicy {
+	case PersistDebounced:
+		return time.Since(persistedAt) >= d.CheckpointInterval
+	case PersistTerminal:
+		return false
+	default:
+		return completed >= d.CheckpointStages
+	}
+}
+
+// limiter returns the semaphore limiting the task name, nil if unlimited
+func (d *Dispatcher) limiter(name string) chan struct{} {
+	limit := d.Concurrency[name]
+	if limit <= 0 {
+		limit = d.DefaultConcurrency
+	}
+	if limit <= 0 {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sem := d.limits[name]
+	if sem == nil {
+		if d.limits == nil {
+			d.limits = make(map[string]chan struct{})
+		}
+		sem = make(chan struct{}, limit)
+		d.limits[name] = sem
+	}
+	return sem
+}
+
+func (d *Dispatcher) now() time.Time {
+	if d.Now != nil {
+		return d.Now()
+	}
+	return time.Now()
+}
+
+// concurrencyKey returns the ConcurrencyKey of the task, empty if the
+// task is unlimited
+func (d *Dispatcher) concurrencyKey(task *Task) string {
+	if d.ConcurrencyKey == nil || d.KeyConcurrency <= 0 {
+		return ""
+	}
+	return d.ConcurrencyKey(task)
+}
+
+// acquireKey takes a slot of the concurrency key, it returns false if no
+// slot is available and wait is false
+func (d *Dispatcher) acquireKey(key string, wait bool) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.keyCounts == nil {
+		d.keyCounts = make(map[string]int)
+		d.keyFreed = sync.NewCond(&d.lock)
+	}
+	for d.keyCounts[key] >= d.KeyConcurrency {
+		if !wait {
+			return false
+		}
+		d.keyFreed.Wait()
+	}
+	d.keyCounts[key]++
+	return true
+}
+
+func (d *Dispatcher) releaseKey(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.keyCounts[key]--; d.keyCounts[key] <= 0 {
+		delete(d.keyCounts, key)
+	}
+	d.keyFreed.Broadcast()
+}
+
+// warnRetry invokes OnRetryWarn when the next retry of the task
+// crosses RetryWarnThreshold
+func (d *Dispatcher) warnRetry(task *Task) {
+	if d.OnRetryWarn == nil || d.RetryWarnThreshold <= 0 {
+		return
+	}
+	threshold := d.RetryWarnThreshold * float64(task.MaxRetries)
+	if float64(task.Retries) < threshold && float64(task.Retries+1) >= threshold {
+		d.OnRetryWarn(task)
+	}
+}
+
 type localWorker struct {
 	dispatcher *Dispatcher
 	strategy   WorkerStrategy
+	filter     WorkerFilter
 }
 
 func (w *localWorker) Run() {
 	for {
 		handle, err := w.strategy.FetchTask()
-		if err == nil && handle != nil {
-			w.runTaskByHandle(handle)
+		if err == nil && handle != nil && w.accepts(handle) {
+			w.runLimited(handle)
+		}
+	}
+}
+
+// accepts determines if the task is matched by the filter of the worker
+// and due to run by NextAction, an expired task is accepted so the runner
+// aborts it, otherwise the task is skipped
+// A FilteredStrategy never fetches unmatched tasks, the check is for
+// other strategies
+func (w *localWorker) accepts(handle TaskHandle) bool {
+	task := handle.Task()
+	if !task.inQueues(w.filter.Queues) {
+		return w.skip(handle, "not in the queues of the worker")
+	}
+	if !task.SatisfiedBy(w.filter.Capabilities) {
+		return w.skip(handle, "requirements not satisfied by the worker")
+	}
+	switch action := task.NextAction(w.dispatcher.now(), w.dispatcher.RetryPolicy); action.Type {
+	case ActionRun, ActionAbort:
+		return true
+	case ActionRunAt:
+		return w.skip(handle, "scheduled at "+action.When.Format(time.RFC3339))
+	default:
+		return w.skip(handle, "not runnable in state "+task.State.String())
+	}
+}
+
+// skip never runs the task, it's released if the handle supports it,
+// otherwise the claim is left to expire, e.g. reclaimed by the Sweeper
+func (w *localWorker) skip(handle TaskHandle, reason string) bool {
+	task := handle.Task()
+	log.Printf("task %s: skipped: %s", task.ID, reason)
+	if releaser, ok := handle.(TaskReleaser); ok {
+		if err := releaser.Release(); err != nil {
+			log.Printf("task %s: release failed: %v", task.ID, err)
+		}
+	}
+	return false
+}
+
+// runLimited runs the task if the concurrency limits of its key and name
+// allow, otherwise releases the task, or waits if the task can't be
+// released
+func (w *localWorker) runLimited(handle TaskHandle) {
+	if key := w.dispatcher.concurrencyKey(handle.Task()); key != "" {
+		if !w.dispatcher.acquireKey(key, false) {
+			if releaser, ok := handle.(TaskReleaser); ok && releaser.Release() == nil {
+				return
+			}
+			w.dispatcher.acquireKey(key, true)
+		}
+		defer w.dispatcher.releaseKey(key)
+	}
+	if sem := w.dispatcher.limiter(handle.Task().Name); sem != nil {
+		select {
+		case sem <- struct{}{}:
+		default:
+			if releaser, ok := handle.(TaskReleaser); ok && releaser.Release() == nil {
+				return
+			}
+			sem <- struct{}{}
 		}
+		defer func() { <-sem }()
 	}
+	w.runTaskByHandle(handle)
 }
 
 func (w *localWorker) runTaskByHandle(handle TaskHandle) {
+	task := handle.Task()
+	guard := Guard(task)
+	registerRunning(task.ID, guard)
+	defer unregisterRunning(task.ID, guard)
+	startedAt := time.Now()
+	var expireAt time.Time
+	guard.Update(func(t *Task) error {
+		t.dryRun = w.dispatcher.DryRun
+		t.claimed(startedAt)
+		expireAt = t.Stats.ExpireAt
+		if t.State == TaskPending {
+			return t.Transition(TaskRunning)
+		}
+		return nil
+	})
+
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+	if expireAt.IsZero() {
+		taskCtx, cancel = context.WithCancel(context.Background())
+	} else {
+		taskCtx, cancel = context.WithDeadline(context.Background(), expireAt)
+	}
+	defer cancel()
+	exec := &execution{}
 	ctx := Context{
+		ctx:        taskCtx,
+		store:      w.dispatcher.Store,
 		strategy:   w.strategy,
 		taskHandle: handle,
+		dryRun:     w.dispatcher.DryRun,
+		guard:      guard,
+		exec:       exec,
 	}
 
-	err := w.runTask(ctx)
+	var err error
+	now := w.dispatcher.now()
+	guard.Update(func(t *Task) error {
+		if t.expired(now) {
+			t.Result = TaskAborted
+			t.CancelReason = "expired"
+			err = t.NewError(TaskErrFail).SetMessage("expired").CausedBy(ErrTaskExpired)
+		}
+		return nil
+	})
+	if err == nil && !ctx.IsCancelled() {
+		err = w.runTask(ctx)
+	}
+	// a cancellation requested in the store meanwhile applies, and isn't
+	// overwritten when the task is handed over
+	if syncErr := ctx.syncCancel(); syncErr != nil {
+		log.Printf("task %s: check cancellation failed: %v", ctx.TaskID(), syncErr)
+	}
+	if cancelErr := ctx.Err(); cancelErr != nil {
+		var compensating bool
+		guard.Update(func(t *Task) error {
+			reason := t.CancelReason
+			if reason == "" {
+				reason = cancelErr.Error()
+			}
+			if compensating = t.Revert && t.Canceling; compensating {
+				// the cancellation is consumed by compensating in rollback direction
+				t.Canceling = false
+				return t.AppendError(t.NewError(TaskErrRevert).
+					SetMessage("canceled: " + reason).
+					CausedBy(ErrTaskCanceled))
+			}
+			t.Result = TaskAborted
+			err = t.NewError(TaskErrFail).
+				SetMessage("canceled: " + reason).
+				CausedBy(ErrTaskCanceled)
+			return nil
+		})
+		if compensating {
+			if err = w.compensate(ctx); err != nil {
+				err = ctx.Stuck(fmt.Errorf("compensation after cancel failed: %w", err))
+			} else {
+				guard.Update(func(t *Task) error {
+					t.Result = TaskAborted
+					return nil
+				})
+			}
+		}
+	}
+	var taskErr *TaskError
 	if err != nil {
-		taskErr, ok := err.(*TaskError)
-		if !ok {
-			taskErr = ctx.Fail(err)
+		taskErr = ctx.taskError(err)
+		if taskErr.Type == TaskErrRetry {
+			guard.Update(func(t *Task) error {
+				if taskErr = retryOrStuck(t, taskErr); taskErr.Type == TaskErrRetry {
+					w.dispatcher.warnRetry(t)
+				}
+				return nil
+			})
+		}
+	}
+	if finalErr := w.finalize(ctx, taskErr); finalErr != nil {
+		if taskErr == nil || taskErr.Type == TaskErrIgnored {
+			taskErr = ctx.Fail(finalErr)
+		} else {
+			guard.Update(func(t *Task) error {
+				t.Annotate("jobs", "finalizers failed: "+finalErr.Error())
+				return nil
+			})
 		}
-		err = handle.Done(taskErr)
-	} else {
-		err = handle.Done(nil)
 	}
+	err = guard.Update(func(t *Task) error {
+		t.recordAttempt(Attempt{
+			WorkerID:  t.ensureStats().WorkerID,
+			StartedAt: startedAt,
+			EndedAt:   time.Now(),
+			Err:       taskErr,
+		})
+		// goroutines of the task can't touch it once handed over
+		exec.revoke(t)
+		defer func() { t.dryRun, t.completing = false, false }()
+		return w.done(ctx, t, taskErr)
+	})
 	if err != nil {
-		// TODO
+		log.Printf("task %s: done failed: %v", task.ID, err)
 	}
 }
 
 func (w *localWorker) runTask(ctx Context) error {
-	task := ctx.Current()
-	stage := w.dispatcher.findStage(task.Name, task.Stage)
-	if stage == nil {
-		return fmt.Errorf("invalid task/stage: %s/%s", task.Name, task.Stage)
+	var name, current string
+	ctx.read(func(t *Task) { name, current = t.Name, t.Stage })
+	exec := w.dispatcher.findTaskExec(name)
+	if exec == nil {
+		return fmt.Errorf("invalid task: %s", name)
+	}
+	stages, err := exec.orderedStages()
+	if err != nil {
+		return ctx.Fail(err)
+	}
+	if len(stages) == 0 {
+		// a stageless task, e.g. a placeholder, succeeds immediately
+		return ctx.update(func(t *Task) error {
+			t.Result = TaskSuccess
+			t.SetProgress(100)
+			return nil
+		})
+	}
+	index := stageIndex(stages, current)
+	if index < 0 {
+		return fmt.Errorf("invalid task/stage: %s/%s", name, current)
+	}
+	if ctx.IsRollback() {
+		// rollback direction walks back from the failed stage
+		return w.revertStages(ctx, stages, index)
+	}
+	// a dry-run exercises the stages instead of the cache
+	if index == 0 && exec.CacheResults && !ctx.dryRun {
+		// the cache is an optimization, lookup failures fall back to executing
+		hit, err := w.useCachedResult(ctx)
+		if err != nil {
+			log.Printf("task %s: cache lookup failed: %v", ctx.TaskID(), err)
+		} else if hit {
+			return nil
+		}
 	}
 
-	if stage.Fn == nil {
+	// a retry resumes from the last checkpointed stage
+	completed, jumps, persistedAt := 0, 0, time.Now()
+	for index < len(stages) {
+		stage := stages[index]
+		var missing string
+		var progress int
+		var skipped bool
+		err := ctx.update(func(t *Task) error {
+			t.Stage = stage.Name
+			m, err := stage.missingRequired(t)
+			if missing = m; err != nil || missing != "" {
+				return err
+			}
+			progress = t.Progress
+			t.beginStage()
+			stageStarted(t, stage.Name)
+			// a stage completed before a replay is skipped
+			if skipped = stage.Fn == nil || t.CompletedStages[stage.Name]; skipped {
+				stageEnded(t, stage.Name, 0, ErrStageSkipped)
+			}
+			return nil
+		})
+		if err != nil {
+			return ctx.Fail(err)
+		}
+		if missing != "" {
+			return ctx.newError(TaskErrFail).
+				SetMessage(fmt.Sprintf("stage %s: missing required param %q", stage.Name, missing))
+		}
+		next := index + 1
+		if !skipped {
+			startedAt := time.Now()
+			err := w.runStage(ctx, stage, stage.Fn)
+			if err != nil && stage.Fallback != nil && exhaustsRetries(ctx, err) {
+				err = w.runStage(ctx, stage, stage.Fallback)
+			}
+			elapsed := time.Since(startedAt)
+			var jump *GotoStageError
+			if errors.As(err, &jump) {
+				// a jump isn't a failure of the stage
+				ctx.update(func(t *Task) error {
+					stageEnded(t, stage.Name, elapsed, nil)
+					return nil
+				})
+				if next = stageIndex(stages, jump.Stage); next < 0 {
+					return ctx.Fail(fmt.Errorf("stage %s: goto unknown stage %s", stage.Name, jump.Stage))
+				}
+				if jumps++; MaxStageJumps > 0 && jumps > MaxStageJumps {
+					return ctx.Stuck(fmt.Errorf("stage %s: exceeded %d stage jumps", stage.Name, MaxStageJumps))
+				}
+				// stages after the target run again
+				ctx.update(func(t *Task) error {
+					for _, s := range stages[next:] {
+						t.markStageCompleted(s.Name, false)
+					}
+					return nil
+				})
+			} else {
+				ctx.update(func(t *Task) error {
+					stageEnded(t, stage.Name, elapsed, err)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		var waiting, finished bool
+		ctx.update(func(t *Task) error {
+			t.endStage()
+			if waiting = t.State == TaskWaiting; waiting {
+				return nil
+			}
+			if next > index {
+				t.markStageCompleted(stage.Name, true)
+			}
+			if t.Progress == progress {
+				t.SetProgress(stagesProgress(stages, index))
+			}
+			finished = t.completing
+			return nil
+		})
+		if waiting {
+			return w.update(ctx)
+		}
+		if finished || ctx.IsCancelled() {
+			return nil
+		}
+		if next >= len(stages) {
+			break
+		}
+		ctx.update(func(t *Task) error {
+			t.Stage = stages[next].Name
+			return nil
+		})
+		index = next
+		completed++
+		if stages[next].Checkpoint || w.dispatcher.shouldPersist(completed, persistedAt) {
+			if err := w.update(ctx); err != nil {
+				return err
+			}
+			completed, persistedAt = 0, time.Now()
+		}
+	}
+	return nil
+}
+
+// finalize runs the finalizers of the task if the execution ends with
+// success or failure, all finalizers run and their errors are joined
+func (w *localWorker) finalize(ctx Context, taskErr *TaskError) error {
+	var name string
+	var waiting bool
+	ctx.read(func(t *Task) { name, waiting = t.Name, t.State == TaskWaiting })
+	if waiting {
 		return nil
 	}
+	if taskErr != nil && taskErr.Type != TaskErrFail && taskErr.Type != TaskErrIgnored {
+		return nil
+	}
+	exec := w.dispatcher.findTaskExec(name)
+	if exec == nil {
+		return nil
+	}
+	var errs []error
+	for i := len(exec.Finalizers) - 1; i >= 0; i-- {
+		if err := exec.Finalizers[i](ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	return stage.Fn(ctx)
+// compensate runs the stages completed before the current one in reverse
+// order, the task is expected in rollback direction
+func (w *localWorker) compensate(ctx Context) error {
+	var name, current string
+	ctx.read(func(t *Task) { name, current = t.Name, t.Stage })
+	exec := w.dispatcher.findTaskExec(name)
+	if exec == nil {
+		return fmt.Errorf("invalid task: %s", name)
+	}
+	stages, err := exec.orderedStages()
+	if err != nil || len(stages) == 0 {
+		return err
+	}
+	index := stageIndex(stages, current)
+	if index < 0 {
+		return fmt.Errorf("invalid task/stage: %s/%s", name, current)
+	}
+	return w.revertStages(ctx, stages, index-1)
+}
+
+// revertStages runs the stages from the index back to the first one, the
+// task is expected in rollback direction
+func (w *localWorker) revertStages(ctx Context, stages []*Stage, index int) error {
+	for ; index >= 0; index-- {
+		stage := stages[index]
+		ctx.update(func(t *Task) error {
+			t.Stage = stage.Name
+			return nil
+		})
+		if stage.Fn == nil {
+			continue
+		}
+		if err := w.runStage(ctx, stage, stage.Fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useCachedResult copies the output of a completed task with the same
+// fingerprint into the task
+func (w *localWorker) useCachedResult(ctx Context) (bool, error) {
+	if w.dispatcher.Store == nil {
+		return false, nil
+	}
+	task := ctx.Current()
+	cached, found, err := FindCachedResult(w.dispatcher.Store, &task)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, ctx.update(func(t *Task) error {
+		t.Output, t.OutputRef, t.OutputBytes = cloneBytes(cached.Output), cached.OutputRef, cached.OutputBytes
+		t.Result = TaskSuccess
+		t.Annotate("jobs", "output cached from task "+cached.ID)
+		return nil
+	})
+}
+
+// runStage runs a function of the stage with the effective deadline,
+// the function is abandoned when exceeding HardTimeout
+func (w *localWorker) runStage(ctx Context, stage *Stage, fn TaskFn) error {
+	var deadline time.Time
+	var ok bool
+	ctx.read(func(t *Task) { deadline, ok = t.EffectiveDeadline(stage, w.dispatcher.Timeouts) })
+	if ok {
+		stageCtx, cancel := context.WithDeadline(ctx.context(), deadline)
+		defer cancel()
+		ctx.ctx = stageCtx
+	}
+	timeout := w.dispatcher.HardTimeout
+	if timeout <= 0 {
+		return callStage(ctx, fn)
+	}
+	stageCtx, cancel := context.WithCancel(ctx.context())
+	defer cancel()
+	stageExec := &execution{parent: ctx.exec}
+	run := ctx
+	run.ctx, run.exec = stageCtx, stageExec
+	result := make(chan error, 1)
+	go func() {
+		result <- callStage(run, fn)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		// the abandoned goroutine can no longer mutate the task
+		ctx.guard.Update(func(t *Task) error {
+			stageExec.revoke(t)
+			return nil
+		})
+		return ctx.Stuck(fmt.Errorf("stage %s exceeded hard timeout %s", stage.Name, timeout))
+	}
+}
+
+// PanicErrorType is the type of the error converted from a panic in a
+// stage
+var PanicErrorType = TaskErrStuck
+
+// callStage invokes fn and converts a panic into an error of
+// PanicErrorType
+func callStage(ctx Context, fn TaskFn) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = ctx.newError(PanicErrorType).
+				SetMessage(fmt.Sprintf("panic: %v", r)).
+				SetOutput(debug.Stack())
+		}
+	}()
+	return fn(ctx)
+}
+
+// exhaustsRetries determines if err requests a retry which the task
+// can't afford, err is classified like the runner does if it doesn't
+// wrap a TaskError
+func exhaustsRetries(ctx Context, err error) bool {
+	taskErr := ctx.taskError(err)
+	if taskErr.Type != TaskErrRetry {
+		return false
+	}
+	var exhausted bool
+	ctx.read(func(t *Task) { exhausted = !canRetry(t, taskErr) })
+	return exhausted
+}
+
+// canRetry determines if the task can afford the retry requested by
+// taskErr, RemainingRetries in the error is the budget for this retry
+// only and leaves MaxRetries of the task unchanged
+func canRetry(task *Task, taskErr *TaskError) bool {
+	if taskErr.RemainingRetries != nil {
+		return *taskErr.RemainingRetries > 0
+	}
+	return task.Retries < task.MaxRetries
+}
+
+// retryOrStuck converts a retry error into a stuck error when the task
+// has exhausted its retries, the retry budget and delay in the error
+// take precedence
+func retryOrStuck(task *Task, taskErr *TaskError) *TaskError {
+	if canRetry(task, taskErr) {
+		if taskErr.RetryAfter > 0 {
+			task.ensureStats().ScheduledAt = time.Now().Add(taskErr.RetryAfter)
+		}
+		return taskErr
+	}
+	return task.NewError(TaskErrStuck).
+		SetMessage("max retries exceeded").
+		SetOutput(taskErr.Output).
+		CausedBy(&MaxRetriesExceededError{
+			TaskID:   task.ID,
+			Attempts: task.Retries + 1,
+		})
+}
+
+// update persists the running task with the cancellation requested in
+// the store merged
+func (w *localWorker) update(ctx Context) (err error) {
+	if err = ctx.syncCancel(); err != nil {
+		return err
+	}
+	ctx.read(func(t *Task) {
+		if ctx.dryRun {
+			log.Printf("dry-run: task %s: update stage=%q state=%d", t.ID, t.Stage, t.State)
+			return
+		}
+		err = ctx.taskHandle.Update(t)
+	})
+	return
+}
+
+// done hands the task over to the handle, it's called with the write
+// lock of the task held
+func (w *localWorker) done(ctx Context, task *Task, taskErr *TaskError) error {
+	if !ctx.dryRun {
+		return ctx.taskHandle.Done(taskErr)
+	}
+	// the task is neither persisted nor released, which would requeue
+	// it and run it over again
+	if taskErr != nil {
+		log.Printf("dry-run: task %s: done with error: %v", task.ID, taskErr)
+	} else {
+		log.Printf("dry-run: task %s: done", task.ID)
+	}
+	return nil
 }
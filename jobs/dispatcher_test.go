@@ -0,0 +1,959 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetriesExhausted(t *testing.T) {
+	errFlaky := errors.New("flaky")
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("flaky", func(ctx Context) error {
+		return ctx.FailRetry(errFlaky)
+	}))
+	task := newRunnable("flaky")
+	task.MaxRetries = 2
+	for i := 0; i < 3; i++ {
+		h := runOnce(d, task)
+		if i < 2 {
+			if h.err == nil || h.err.Type != TaskErrRetry {
+				t.Fatalf("attempt %d: expect retry error, got %v", i+1, h.err)
+			}
+			continue
+		}
+		if h.err == nil || h.err.Type != TaskErrStuck {
+			t.Fatalf("expect stuck error, got %v", h.err)
+		}
+		var exceeded *MaxRetriesExceededError
+		if !errors.As(h.err, &exceeded) {
+			t.Fatalf("expect MaxRetriesExceededError, got %v", h.err.Cause)
+		}
+		if exceeded.TaskID != task.ID || exceeded.Attempts != 3 {
+			t.Errorf("unexpected %+v", exceeded)
+		}
+		if !errors.Is(h.err, ErrMaxRetriesExceeded) {
+			t.Error("expect errors.Is to match ErrMaxRetriesExceeded")
+		}
+	}
+	if task.State != TaskStucked {
+		t.Errorf("expect stucked, got %s", task.State)
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	var runs []string
+	failed := false
+	d.AddTaskExecs(&TaskExec{
+		Name: "resume",
+		Stages: []Stage{
+			{Name: "a", Fn: func(ctx Context) error {
+				runs = append(runs, "a")
+				return ctx.SetData(map[string]int{"a": 1})
+			}},
+			{Name: "b", Fn: func(ctx Context) error {
+				runs = append(runs, "b")
+				stored, err := LoadTask(store, ctx.TaskID())
+				if err != nil || stored == nil || stored.Stage != "b" || string(stored.Data) != `{"a":1}` {
+					t.Errorf("expect checkpoint before stage b, got %v, %v", stored, err)
+				}
+				if !failed {
+					failed = true
+					return ctx.FailRetry(errors.New("transient"))
+				}
+				return nil
+			}},
+		},
+	})
+	task := newRunnable("resume")
+	task.MaxRetries = 1
+	if err := SaveTask(store, task); err != nil {
+		t.Fatal(err)
+	}
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrRetry {
+		t.Fatalf("expect retry, got %v", h.err)
+	}
+	reloaded, err := LoadTask(store, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := runOnce(d, reloaded); h.err != nil {
+		t.Fatalf("expect success, got %v", h.err)
+	}
+	if got := strings.Join(runs, ","); got != "a,b,b" {
+		t.Errorf("expect stage a not run again, got %s", got)
+	}
+	var data map[string]int
+	if err = reloaded.GetData(&data); err != nil || data["a"] != 1 {
+		t.Errorf("expect data kept, got %v, %v", data, err)
+	}
+	if reloaded.State != TaskCompleted || reloaded.Result != TaskSuccess {
+		t.Errorf("expect success, got %s/%s", reloaded.State, reloaded.Result)
+	}
+}
+
+func TestRollbackStages(t *testing.T) {
+	var runs []string
+	flaky := true
+	stage := func(name string) Stage {
+		return Stage{Name: name, Fn: func(ctx Context) error {
+			if !ctx.IsRollback() {
+				runs = append(runs, name)
+				if name == "b" {
+					return ctx.FailRollback(errors.New("bad"))
+				}
+				return nil
+			}
+			runs = append(runs, "rev-"+name)
+			if name == "a" && flaky {
+				flaky = false
+				return ctx.FailRetry(errors.New("flaky"))
+			}
+			return nil
+		}}
+	}
+	d := &Dispatcher{}
+	d.AddTaskExecs(&TaskExec{Name: "rollback", Stages: []Stage{stage("a"), stage("b"), stage("c")}})
+	task := newRunnable("rollback")
+	task.MaxRetries = 1
+
+	runOnce(d, task)
+	if !task.Revert || task.State != TaskPending || task.Stage != "b" {
+		t.Fatalf("expect requeued in rollback direction at b, got %v/%s/%s", task.Revert, task.State, task.Stage)
+	}
+	runOnce(d, task)
+	if task.State != TaskPending || task.Stage != "a" {
+		t.Fatalf("expect a retry resuming the rollback at a, got %s/%s", task.State, task.Stage)
+	}
+	runOnce(d, task)
+	if got := strings.Join(runs, ","); got != "a,b,rev-b,rev-a,rev-a" {
+		t.Errorf("expect stages reverted backwards from the failed one, got %s", got)
+	}
+	if task.State != TaskCompleted || task.Result != TaskFailure {
+		t.Errorf("expect failed after the rollback, got %s/%s", task.State, task.Result)
+	}
+}
+
+func TestConcurrencyPerName(t *testing.T) {
+	d := &Dispatcher{Concurrency: map[string]int{"single": 1, "wide": 2}}
+	started, release := make(chan string, 4), make(chan struct{})
+	block := func(ctx Context) error {
+		started <- ctx.Current().Name
+		<-release
+		return nil
+	}
+	d.AddTaskExecs(singleStage("single", block), singleStage("wide", block))
+	w := &localWorker{dispatcher: d}
+
+	var wg sync.WaitGroup
+	run := func(h *testHandle) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runLimited(h)
+		}()
+	}
+	run(newTestHandle(newRunnable("single"), nil))
+	run(newTestHandle(newRunnable("wide"), nil))
+	run(newTestHandle(newRunnable("wide"), nil))
+	counts := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		select {
+		case name := <-started:
+			counts[name]++
+		case <-time.After(time.Second):
+			t.Fatalf("expect 1 single and 2 wide running, got %v", counts)
+		}
+	}
+
+	h := newTestHandle(newRunnable("single"), nil)
+	w.runLimited(h)
+	if h.done || h.task.State != TaskPending {
+		t.Errorf("expect a singleton at its limit left pending, got %s", h.task.State)
+	}
+	select {
+	case name := <-started:
+		t.Errorf("unexpected %s started", name)
+	default:
+	}
+
+	close(release)
+	wg.Wait()
+	w.runLimited(h)
+	if !h.done || h.task.State != TaskCompleted {
+		t.Errorf("expect the singleton run when the slot frees, got %s", h.task.State)
+	}
+}
+
+func TestRetryOverrides(t *testing.T) {
+	var fail func(ctx Context) *TaskError
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("overrides", func(ctx Context) error {
+		return fail(ctx)
+	}))
+
+	fail = func(ctx Context) *TaskError {
+		return ctx.FailRetry(errors.New("throttled")).SetRetryAfter(30 * time.Second)
+	}
+	task := newRunnable("overrides")
+	task.MaxRetries = 3
+	before := time.Now()
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrRetry {
+		t.Fatalf("expect retry, got %v", h.err)
+	}
+	if at := task.Stats.ScheduledAt; at.Before(before.Add(30*time.Second)) || at.After(time.Now().Add(30*time.Second)) {
+		t.Errorf("expect retried after 30s, scheduled at %s", at)
+	}
+
+	fail = func(ctx Context) *TaskError {
+		return ctx.FailRetry(errors.New("more")).SetRemainingRetries(1)
+	}
+	task = newRunnable("overrides")
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrRetry {
+		t.Errorf("expect the error budget to allow a retry beyond MaxRetries, got %v", h.err)
+	}
+
+	fail = func(ctx Context) *TaskError {
+		return ctx.FailRetry(errors.New("fatal")).SetRemainingRetries(0)
+	}
+	task = newRunnable("overrides")
+	task.MaxRetries = 5
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrStuck || !errors.Is(h.err, ErrMaxRetriesExceeded) {
+		t.Errorf("expect the error budget to stop retries, got %v", h.err)
+	}
+	if task.MaxRetries != 5 {
+		t.Errorf("expect MaxRetries unchanged, got %d", task.MaxRetries)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store, DryRun: true}
+	d.AddTaskExecs(&TaskExec{
+		Name: "dry-run",
+		Stages: []Stage{
+			{Name: "a", Fn: func(ctx Context) error {
+				if !ctx.IsDryRun() {
+					t.Error("expect dry-run")
+				}
+				if err := ctx.Heartbeat(); err != nil {
+					return err
+				}
+				if err := ctx.SubmitTask(ctx.NewTask("dry-run-child").Build()); err != nil {
+					return err
+				}
+				return ctx.SetData("changed")
+			}},
+			{Name: "b", Fn: func(ctx Context) error {
+				return ctx.SetOutput("changed")
+			}},
+		},
+	})
+	task := newRunnable("dry-run")
+	saveTasks(t, store, task)
+	h := runOnce(d, loadTask(t, store, task.ID))
+	if h.updates != 0 || h.done || len(h.submitted) != 0 {
+		t.Errorf("expect nothing persisted, got %d updates, %d submitted, done %v", h.updates, len(h.submitted), h.done)
+	}
+	stored := loadTask(t, store, task.ID)
+	if stored.State != TaskPending || stored.Data != nil || stored.Output != nil || stored.Version != task.Version {
+		t.Errorf("expect the stored task unchanged, got %+v", stored)
+	}
+	if tasks, err := ListTasks(store, Filter{}); err != nil || len(tasks) != 1 {
+		t.Errorf("expect no sub task saved, got %d, %v", len(tasks), err)
+	}
+}
+
+func TestRetryWarn(t *testing.T) {
+	var warned []uint
+	d := &Dispatcher{
+		RetryWarnThreshold: 0.8,
+		OnRetryWarn:        func(task *Task) { warned = append(warned, task.Retries) },
+	}
+	d.AddTaskExecs(singleStage("warn", func(ctx Context) error {
+		return ctx.FailRetry(errors.New("flaky"))
+	}))
+	task := newRunnable("warn")
+	task.MaxRetries = 5
+	for i := 0; i < 6; i++ {
+		runOnce(d, task)
+	}
+	if task.State != TaskStucked {
+		t.Fatalf("expect stucked, got %s", task.State)
+	}
+	if len(warned) != 1 || warned[0] != 3 {
+		t.Errorf("expect warned once before the 4th retry, got %v", warned)
+	}
+}
+
+func TestStageRequires(t *testing.T) {
+	var ran []string
+	d := &Dispatcher{}
+	d.AddTaskExecs(&TaskExec{
+		Name: "requires",
+		Stages: []Stage{
+			{Name: "load", Fn: func(ctx Context) error {
+				ran = append(ran, "load")
+				return ctx.SetData(map[string]string{"token": "t"})
+			}},
+			{Name: "use", Requires: []string{"region", "token"}, Fn: func(ctx Context) error {
+				ran = append(ran, "use")
+				return nil
+			}},
+		},
+	})
+
+	task := newRunnable("requires")
+	task.setParams(map[string]string{"region": "us"})
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatalf("expect requirements satisfied by params and data, got %v", h.err)
+	}
+	if got := strings.Join(ran, ","); got != "load,use" {
+		t.Errorf("expect both stages run, got %s", got)
+	}
+
+	ran = nil
+	task = newRunnable("requires")
+	h := runOnce(d, task)
+	if h.err == nil || h.err.Type != TaskErrFail || !strings.Contains(h.err.Message, `missing required param "region"`) {
+		t.Fatalf("expect failed naming the missing key, got %v", h.err)
+	}
+	if got := strings.Join(ran, ","); got != "load" {
+		t.Errorf("expect the stage not invoked, got %s", got)
+	}
+}
+
+func TestStageDependencies(t *testing.T) {
+	var ran []string
+	record := func(name string) TaskFn {
+		return func(ctx Context) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+	exec := &TaskExec{
+		Name: "deps",
+		Stages: []Stage{
+			{Name: "deploy", After: []string{"build", "test"}, Fn: record("deploy")},
+			{Name: "test", After: []string{"build"}, Fn: record("test")},
+			{Name: "lint", Fn: record("lint")},
+			{Name: "build", Fn: record("build")},
+		},
+	}
+	if got := strings.Join(exec.StageNames(), ","); got != "lint,build,test,deploy" {
+		t.Errorf("unexpected order %s", got)
+	}
+	d := &Dispatcher{}
+	d.AddTaskExecs(exec, &TaskExec{
+		Name: "deps-cycle",
+		Stages: []Stage{
+			{Name: "a", After: []string{"c"}, Fn: record("a")},
+			{Name: "b", After: []string{"a"}, Fn: record("b")},
+			{Name: "c", After: []string{"b"}, Fn: record("c")},
+			{Name: "d", Fn: record("d")},
+		},
+	})
+	if h := runOnce(d, newRunnable("deps")); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if got := strings.Join(ran, ","); got != "lint,build,test,deploy" {
+		t.Errorf("expect dependencies respected, got %s", got)
+	}
+
+	ran = nil
+	h := runOnce(d, newRunnable("deps-cycle"))
+	if h.err == nil || h.err.Type != TaskErrFail || !strings.Contains(h.err.Error(), "cyclic dependency among stages [a b c]") {
+		t.Fatalf("expect a cycle error, got %v", h.err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("expect no stage run, got %v", ran)
+	}
+}
+
+func TestHardTimeout(t *testing.T) {
+	release, detached := make(chan struct{}), make(chan error, 1)
+	d := &Dispatcher{HardTimeout: 50 * time.Millisecond}
+	d.AddTaskExecs(singleStage("hard-timeout", func(ctx Context) error {
+		// ignores the cancellation of ctx
+		<-release
+		detached <- ctx.SetData("late")
+		return nil
+	}))
+	task := newRunnable("hard-timeout")
+	start := time.Now()
+	h := runOnce(d, task)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect the worker not blocked past HardTimeout, took %s", elapsed)
+	}
+	if h.err == nil || h.err.Type != TaskErrStuck || !strings.Contains(h.err.Error(), "exceeded hard timeout 50ms") {
+		t.Fatalf("expect a stuck error, got %v", h.err)
+	}
+	if task.State != TaskStucked {
+		t.Errorf("expect stucked, got %s", task.State)
+	}
+
+	close(release)
+	if err := <-detached; !errors.Is(err, ErrTaskDetached) {
+		t.Errorf("expect the abandoned stage detached, got %v", err)
+	}
+	if task.Data != nil {
+		t.Errorf("expect the task not mutated by the abandoned stage, got %s", task.Data)
+	}
+}
+
+func TestStageFallback(t *testing.T) {
+	errPrimary := errors.New("primary unavailable")
+	var ran []string
+	d := &Dispatcher{}
+	d.AddTaskExecs(&TaskExec{
+		Name: "fallback",
+		Stages: []Stage{{
+			Name: "fetch",
+			Fn: func(ctx Context) error {
+				ran = append(ran, "primary")
+				return errPrimary
+			},
+			Fallback: func(ctx Context) error {
+				ran = append(ran, "fallback")
+				return ctx.SetOutput("from fallback")
+			},
+		}},
+	})
+	SetErrorClassifier(func(err error) TaskErrorType {
+		if errors.Is(err, errPrimary) {
+			return TaskErrRetry
+		}
+		return TaskErrFail
+	})
+	t.Cleanup(func() { SetErrorClassifier(nil) })
+
+	task := newRunnable("fallback")
+	task.MaxRetries = 1
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrRetry {
+		t.Fatalf("expect a retry while retries are left, got %v", h.err)
+	}
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatalf("expect the fallback to succeed, got %v", h.err)
+	}
+	if got := strings.Join(ran, ","); got != "primary,primary,fallback" {
+		t.Errorf("expect the fallback after retries exhausted, got %s", got)
+	}
+	var output string
+	if err := task.GetOutput(&output); err != nil || output != "from fallback" || task.Result != TaskSuccess {
+		t.Errorf("expect the stage completed by the fallback, got %q/%s", output, task.Result)
+	}
+}
+
+func TestAttemptsPerRetry(t *testing.T) {
+	errFlaky := errors.New("flaky")
+	d := &Dispatcher{}
+	runs := 0
+	d.AddTaskExecs(singleStage("attempts", func(ctx Context) error {
+		if runs++; runs < 3 {
+			return ctx.FailRetry(errFlaky)
+		}
+		return nil
+	}))
+	task := newRunnable("attempts")
+	task.MaxRetries = 5
+	var started []time.Time
+	for i := 0; i < 3; i++ {
+		started = append(started, time.Now())
+		task.ensureStats().WorkerID = "w" + string(rune('1'+i))
+		runOnce(d, task)
+		time.Sleep(time.Millisecond)
+	}
+	if len(task.Attempts) != 3 {
+		t.Fatalf("expect an attempt per run, got %d", len(task.Attempts))
+	}
+	for i, a := range task.Attempts {
+		if a.Number != uint(i+1) || a.WorkerID != "w"+string(rune('1'+i)) {
+			t.Errorf("attempt %d: unexpected %+v", i+1, a)
+		}
+		if a.StartedAt.Before(started[i]) || a.EndedAt.Before(a.StartedAt) {
+			t.Errorf("attempt %d: unexpected timing %s - %s", i+1, a.StartedAt, a.EndedAt)
+		}
+		if i > 0 && a.StartedAt.Before(task.Attempts[i-1].EndedAt) {
+			t.Errorf("attempt %d: expect started after the previous one ended", i+1)
+		}
+		if retried := i < 2; retried != (a.Err != nil) || retried && !errors.Is(a.Err, errFlaky) {
+			t.Errorf("attempt %d: unexpected error %v", i+1, a.Err)
+		}
+	}
+	if task.PreviousWorker() != "w3" {
+		t.Errorf("expect the previous worker w3, got %q", task.PreviousWorker())
+	}
+}
+
+func TestAttemptsCapped(t *testing.T) {
+	saved := MaxAttempts
+	MaxAttempts = 2
+	t.Cleanup(func() { MaxAttempts = saved })
+
+	task := NewTask("a").Build()
+	for i := 0; i < 5; i++ {
+		task.recordAttempt(Attempt{})
+	}
+	if len(task.Attempts) != 2 || task.Attempts[0].Number != 4 || task.Attempts[1].Number != 5 {
+		t.Errorf("expect the latest 2 attempts kept, got %+v", task.Attempts)
+	}
+}
+
+func TestGotoStage(t *testing.T) {
+	d := &Dispatcher{}
+	var runs []string
+	record := func(name string, fn func(ctx Context) error) Stage {
+		return Stage{Name: name, Fn: func(ctx Context) error {
+			runs = append(runs, name)
+			return fn(ctx)
+		}}
+	}
+	pass := func(Context) error { return nil }
+	loops := 0
+	d.AddTaskExecs(&TaskExec{Name: "goto", Stages: []Stage{
+		record("a", func(ctx Context) error { return ctx.Goto("c") }),
+		record("b", pass),
+		record("c", func(ctx Context) error {
+			if loops++; loops < 3 {
+				return ctx.Goto("b")
+			}
+			return nil
+		}),
+		record("d", pass),
+	}})
+	task := newRunnable("goto")
+	if h := runOnce(d, task); h.err != nil || task.State != TaskCompleted {
+		t.Fatalf("expect completed, got %s, %v", task.State, h.err)
+	}
+	if got := strings.Join(runs, ""); got != "acbcbcd" {
+		t.Errorf("expect forward and backward jumps, got %s", got)
+	}
+}
+
+func TestGotoStageGuards(t *testing.T) {
+	saved := MaxStageJumps
+	MaxStageJumps = 5
+	t.Cleanup(func() { MaxStageJumps = saved })
+
+	d := &Dispatcher{}
+	runs := 0
+	d.AddTaskExecs(singleStage("goto-loop", func(ctx Context) error {
+		runs++
+		return ctx.Goto("run")
+	}), singleStage("goto-unknown", func(ctx Context) error {
+		return GotoStage("missing")
+	}))
+
+	task := newRunnable("goto-loop")
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrStuck || !strings.Contains(h.err.Error(), "exceeded 5 stage jumps") {
+		t.Errorf("expect stucked by the jump guard, got %v", h.err)
+	}
+	if runs != 6 {
+		t.Errorf("expect 6 runs before the guard, got %d", runs)
+	}
+
+	task = newRunnable("goto-unknown")
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrFail || !strings.Contains(h.err.Error(), "goto unknown stage missing") {
+		t.Errorf("expect failed on an unknown stage, got %v", h.err)
+	}
+}
+
+func TestStageProgress(t *testing.T) {
+	d := &Dispatcher{}
+	var seen []int
+	observe := func(ctx Context) error {
+		seen = append(seen, ctx.Current().Progress)
+		return nil
+	}
+	exec := &TaskExec{Name: "progress", Stages: []Stage{
+		{Name: "a", Fn: observe},
+		{Name: "b", Fn: func(ctx Context) error {
+			observe(ctx)
+			ctx.SetProgress(60)
+			return nil
+		}},
+		{Name: "c", Fn: observe},
+		{Name: "d", Fn: observe},
+	}}
+	d.AddTaskExecs(exec)
+	if names := strings.Join(exec.StageNames(), ","); names != "a,b,c,d" {
+		t.Errorf("expect stage names in order, got %s", names)
+	}
+	task := newRunnable("progress")
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if got := fmt.Sprint(seen); got != "[0 25 60 75]" {
+		t.Errorf("expect progress advanced per stage unless reported, got %s", got)
+	}
+	if task.Progress != 100 {
+		t.Errorf("expect 100%% when completed, got %d", task.Progress)
+	}
+}
+
+func TestPersistPolicy(t *testing.T) {
+	pass := func(Context) error { return nil }
+	stages := func(checkpoint int) []Stage {
+		s := make([]Stage, 5)
+		for i := range s {
+			s[i] = Stage{Name: fmt.Sprint(i), Fn: pass, Checkpoint: i == checkpoint}
+		}
+		return s
+	}
+	run := func(d *Dispatcher, checkpoint int) int {
+		d.AddTaskExecs(&TaskExec{Name: "persist", Stages: stages(checkpoint)})
+		h := runOnce(d, newRunnable("persist"))
+		if h.err != nil {
+			t.Fatal(h.err)
+		}
+		return h.updates
+	}
+	// writes counts the updates between stages
+	base := run(&Dispatcher{PersistPolicy: PersistTerminal}, -1)
+	writes := func(d *Dispatcher, checkpoint int) int {
+		return run(d, checkpoint) - base
+	}
+	cases := []struct {
+		name       string
+		d          *Dispatcher
+		checkpoint int
+		want       int
+	}{
+		{"every stage", &Dispatcher{}, -1, 4},
+		{"every 2 stages", &Dispatcher{CheckpointStages: 2}, -1, 2},
+		{"debounced", &Dispatcher{PersistPolicy: PersistDebounced, CheckpointInterval: time.Hour}, -1, 0},
+		{"debounced elapsed", &Dispatcher{PersistPolicy: PersistDebounced}, -1, 4},
+		{"terminal", &Dispatcher{PersistPolicy: PersistTerminal}, -1, 0},
+		{"terminal checkpoint", &Dispatcher{PersistPolicy: PersistTerminal}, 3, 1},
+		{"every 2 stages checkpoint", &Dispatcher{CheckpointStages: 2}, 1, 2},
+	}
+	for _, c := range cases {
+		if got := writes(c.d, c.checkpoint); got != c.want {
+			t.Errorf("%s: expect %d writes, got %d", c.name, c.want, got)
+		}
+	}
+}
+
+func TestStageWeights(t *testing.T) {
+	d := &Dispatcher{}
+	var seen []int
+	observe := func(ctx Context) error {
+		seen = append(seen, ctx.Current().Progress)
+		return nil
+	}
+	cases := []struct {
+		weights []float64
+		want    string
+	}{
+		{[]float64{0.8, 0.1, 0.1}, "[0 80 90]"},
+		{[]float64{2, 0, 1}, "[0 50 75]"},
+		{[]float64{3, 1}, "[0 75]"},
+	}
+	for i, c := range cases {
+		name := fmt.Sprintf("weighted-%d", i)
+		exec := &TaskExec{Name: name}
+		for j, w := range c.weights {
+			exec.Stages = append(exec.Stages, Stage{Name: fmt.Sprint(j), Fn: observe, Weight: w})
+		}
+		d.AddTaskExecs(exec)
+		seen = nil
+		task := newRunnable(name)
+		if h := runOnce(d, task); h.err != nil {
+			t.Fatal(h.err)
+		}
+		if got := fmt.Sprint(seen); got != c.want || task.Progress != 100 {
+			t.Errorf("weights %v: expect progress %s to 100, got %s to %d", c.weights, c.want, got, task.Progress)
+		}
+	}
+}
+
+func TestFinalizers(t *testing.T) {
+	errStage, errCleanup, errFlaky := errors.New("stage failed"), errors.New("cleanup failed"), errors.New("flaky")
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	var stageErr, cleanupErr error
+	var runs []string
+	d.AddTaskExecs(&TaskExec{
+		Name: "finalized",
+		Stages: []Stage{{Name: "run", Fn: func(ctx Context) error {
+			if stageErr == errFlaky {
+				return ctx.FailRetry(stageErr)
+			}
+			return stageErr
+		}}},
+		Finalizers: []TaskFn{
+			func(ctx Context) error {
+				runs = append(runs, "1")
+				return cleanupErr
+			},
+			func(ctx Context) error {
+				runs = append(runs, "2")
+				return nil
+			},
+		},
+	})
+	run := func(stage, cleanup error, cancel bool) (*Task, *testHandle) {
+		stageErr, cleanupErr, runs = stage, cleanup, nil
+		task := newRunnable("finalized")
+		task.MaxRetries = 1
+		saveTasks(t, store, task)
+		if cancel {
+			if err := Cancel(store, task.ID, "user"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h := runOnce(d, loadTask(t, store, task.ID))
+		return loadTask(t, store, task.ID), h
+	}
+
+	task, h := run(nil, nil, false)
+	if strings.Join(runs, "") != "21" || h.err != nil || task.Result != TaskSuccess {
+		t.Errorf("success: expect finalizers in reverse, got %v, %v", runs, h.err)
+	}
+	task, h = run(nil, errCleanup, false)
+	if h.err == nil || !errors.Is(h.err, errCleanup) || task.Result != TaskFailure {
+		t.Errorf("success: expect a finalizer error failing the task, got %v", h.err)
+	}
+
+	task, h = run(errStage, errCleanup, false)
+	if strings.Join(runs, "") != "21" || !errors.Is(h.err, errStage) || errors.Is(h.err, errCleanup) {
+		t.Errorf("failure: expect the primary error kept, got %v after %v", h.err, runs)
+	}
+	if n := len(task.Annotations); n == 0 || !strings.Contains(task.Annotations[n-1].Text, "cleanup failed") {
+		t.Errorf("failure: expect the finalizer error annotated, got %+v", task.Annotations)
+	}
+
+	task, h = run(nil, nil, true)
+	if strings.Join(runs, "") != "21" || !errors.Is(h.err, ErrTaskCanceled) || task.Result != TaskAborted {
+		t.Errorf("cancellation: expect finalizers run, got %v, %v", runs, h.err)
+	}
+
+	if _, h = run(errFlaky, nil, false); len(runs) != 0 || h.err == nil || h.err.Type != TaskErrRetry {
+		t.Errorf("expect no finalizers before retrying, got %v, %v", runs, h.err)
+	}
+}
+
+func TestReplaySkipsCompletedStages(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store, PersistPolicy: PersistTerminal}
+	var runs []string
+	charged := 0
+	var replay *Task
+	d.AddTaskExecs(&TaskExec{Name: "replayed", Stages: []Stage{
+		{Name: "a", Fn: func(ctx Context) error {
+			runs = append(runs, "a")
+			return nil
+		}},
+		{Name: "charge", Fn: func(ctx Context) error {
+			runs = append(runs, "charge")
+			charged++
+			return nil
+		}},
+		{Name: "c", Fn: func(ctx Context) error {
+			runs = append(runs, "c")
+			if replay == nil {
+				// the worker crashes with the stage cursor persisted
+				// behind the completed stages
+				current := ctx.Current()
+				replay = current.Clone()
+				replay.Stage = "a"
+				return ctx.FailRetry(errors.New("crash"))
+			}
+			return nil
+		}},
+	}})
+	task := newRunnable("replayed")
+	task.MaxRetries = 1
+	runOnce(d, task)
+	if !replay.CompletedStages["a"] || !replay.CompletedStages["charge"] || replay.CompletedStages["c"] {
+		t.Fatalf("expect the completed stages marked, got %v", replay.CompletedStages)
+	}
+
+	runs = nil
+	replay.State = TaskPending
+	if h := runOnce(d, replay); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if strings.Join(runs, ",") != "c" || charged != 1 {
+		t.Errorf("expect completed stages skipped on replay, got %v, charged %d times", runs, charged)
+	}
+	if replay.State != TaskCompleted || !replay.CompletedStages["c"] {
+		t.Errorf("expect completed, got %s, %v", replay.State, replay.CompletedStages)
+	}
+}
+
+func TestConcurrencyPerKey(t *testing.T) {
+	d := &Dispatcher{
+		ConcurrencyKey: func(task *Task) string { return task.Labels["tenant"] },
+		KeyConcurrency: 2,
+	}
+	started, release := make(chan string, 8), make(chan struct{})
+	d.AddTaskExecs(singleStage("tenant", func(ctx Context) error {
+		current := ctx.Current()
+		started <- current.Labels["tenant"]
+		<-release
+		return nil
+	}))
+	w := &localWorker{dispatcher: d}
+	tenantTask := func(tenant string) *testHandle {
+		task := NewTask("tenant").WithLabel("tenant", tenant).Build()
+		task.enqueue()
+		return newTestHandle(task, nil)
+	}
+
+	var wg sync.WaitGroup
+	run := func(h *testHandle) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runLimited(h)
+		}()
+	}
+	expectStarted := func(want map[string]int) {
+		t.Helper()
+		counts := make(map[string]int)
+		for n := 0; n < want["t1"]+want["t2"]; n++ {
+			select {
+			case tenant := <-started:
+				counts[tenant]++
+			case <-time.After(time.Second):
+				t.Fatalf("expect %v running, got %v", want, counts)
+			}
+		}
+		if counts["t1"] != want["t1"] || counts["t2"] != want["t2"] {
+			t.Fatalf("expect %v running, got %v", want, counts)
+		}
+	}
+	run(tenantTask("t1"))
+	run(tenantTask("t1"))
+	run(tenantTask("t2"))
+	expectStarted(map[string]int{"t1": 2, "t2": 1})
+
+	over := tenantTask("t1")
+	w.runLimited(over)
+	if over.done || over.task.State != TaskPending {
+		t.Errorf("expect a task over the tenant cap left pending, got %s", over.task.State)
+	}
+	run(tenantTask("t2"))
+	expectStarted(map[string]int{"t2": 1})
+	select {
+	case tenant := <-started:
+		t.Errorf("unexpected task of %s started", tenant)
+	default:
+	}
+
+	close(release)
+	wg.Wait()
+	w.runLimited(over)
+	if !over.done || over.task.State != TaskCompleted {
+		t.Errorf("expect the task run when the tenant frees a slot, got %s", over.task.State)
+	}
+}
+
+func TestRunWindow(t *testing.T) {
+	clock := newFakeClock()
+	d := &Dispatcher{Now: clock.Now}
+	runs := 0
+	d.AddTaskExecs(singleStage("promo", func(ctx Context) error {
+		runs++
+		return nil
+	}))
+	start, end := clock.Now().Add(time.Hour), clock.Now().Add(2*time.Hour)
+	windowed := func() *Task {
+		task := NewTask("promo").RunBetween(start, end).Build()
+		task.enqueue()
+		return task
+	}
+	w := &localWorker{dispatcher: d}
+
+	before := windowed()
+	if w.accepts(newTestHandle(before, nil)) || before.InWindow(clock.Now()) {
+		t.Error("expect a task before its window not run")
+	}
+	if before.Stats == nil || !before.Stats.ScheduledAt.Equal(start) {
+		t.Errorf("expect scheduled at the window start, got %+v", before.Stats)
+	}
+
+	clock.Advance(90 * time.Minute)
+	in := windowed()
+	if !w.accepts(newTestHandle(in, nil)) || !in.InWindow(clock.Now()) {
+		t.Fatal("expect a task in its window run")
+	}
+	if h := runOnce(d, in); h.err != nil || in.Result != TaskSuccess || runs != 1 {
+		t.Errorf("expect run in the window, got %v", h.err)
+	}
+
+	clock.Advance(time.Hour)
+	after := windowed()
+	if !w.accepts(newTestHandle(after, nil)) || after.InWindow(clock.Now()) {
+		t.Fatal("expect a task after its window accepted to abort")
+	}
+	h := runOnce(d, after)
+	if !errors.Is(h.err, ErrTaskExpired) || after.Result != TaskAborted || after.CancelReason != "expired" || runs != 1 {
+		t.Errorf("expect aborted as expired without running, got %v, %s/%q", h.err, after.Result, after.CancelReason)
+	}
+}
+
+func TestPanicErrorType(t *testing.T) {
+	saved := PanicErrorType
+	t.Cleanup(func() { PanicErrorType = saved })
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("panicky", func(ctx Context) error {
+		panic("boom")
+	}))
+	cases := []struct {
+		errType TaskErrorType
+		state   TaskState
+		result  TaskResult
+	}{
+		{TaskErrStuck, TaskStucked, TaskSuccess},
+		{TaskErrRetry, TaskPending, TaskSuccess},
+		{TaskErrFail, TaskCompleted, TaskFailure},
+	}
+	for _, c := range cases {
+		PanicErrorType = c.errType
+		task := newRunnable("panicky")
+		task.MaxRetries = 1
+		h := runOnce(d, task)
+		if h.err == nil || h.err.Type != c.errType || h.err.Message != "panic: boom" ||
+			!strings.Contains(string(h.err.Output), "goroutine") {
+			t.Errorf("type %d: expect the panic converted with the stack, got %v", c.errType, h.err)
+		}
+		if task.State != c.state || task.Result != c.result {
+			t.Errorf("type %d: expect %s/%s, got %s/%s", c.errType, c.state, c.result, task.State, task.Result)
+		}
+	}
+}
+
+func TestStagelessTask(t *testing.T) {
+	saveHooks(t)
+	var completed []string
+	AddCompletionHook(func(task *Task, summary string) {
+		completed = append(completed, task.Name)
+	})
+	d := &Dispatcher{Store: newMemStore()}
+	d.AddTaskExecs(&TaskExec{Name: "placeholder"})
+	task := newRunnable("placeholder")
+	before := time.Now()
+	h := runOnce(d, task)
+	if h.err != nil || !h.done {
+		t.Fatalf("expect the task done without error, got %v", h.err)
+	}
+	if task.State != TaskCompleted || task.Result != TaskSuccess || task.Progress != 100 {
+		t.Errorf("expect completed successfully, got %s/%s/%d", task.State, task.Result, task.Progress)
+	}
+	if task.UpdatedAt.Before(before) {
+		t.Errorf("expect UpdatedAt set on completion, got %s", task.UpdatedAt)
+	}
+	if len(completed) != 1 || completed[0] != "placeholder" {
+		t.Errorf("expect completion hooks fired once, got %v", completed)
+	}
+	if stored := loadTask(t, d.Store, task.ID); stored.State != TaskCompleted || stored.Result != TaskSuccess {
+		t.Errorf("expect the completed task saved, got %s/%s", stored.State, stored.Result)
+	}
+}
@@ -0,0 +1,405 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// KeyStyle defines the style of JSON keys when encoding tasks
+type KeyStyle int
+
+// Key styles
+const (
+	KeyKebabCase KeyStyle = iota // e.g. max-retries, the default
+	KeyCamelCase                 // e.g. maxRetries
+	KeySnakeCase                 // e.g. max_retries
+)
+
+// JSONKeyStyle is the style of keys used when encoding tasks
+// Decoding always accepts all the styles
+var JSONKeyStyle = KeyKebabCase
+
+// TimeFormat defines the encoding of time fields
+type TimeFormat int
+
+// Time formats
+const (
+	TimeRFC3339     TimeFormat = iota // RFC3339 string, the default
+	TimeEpochMillis                   // milliseconds since Unix epoch
+)
+
+// JSONTimeFormat is the format of time fields used when encoding tasks
+// Decoding always accepts all the formats
+var JSONTimeFormat = TimeRFC3339
+
+// StrictDecoding rejects unknown task states when decoding, otherwise
+// they are decoded as TaskStucked and noted in the task annotations
+var StrictDecoding = false
+
+// PanicOnCodecError panics on encoding errors in SetData, SetOutput and
+// TaskBuilder.Build, otherwise the error is logged and the value is left
+// unchanged
+var PanicOnCodecError = true
+
+// codecError handles an error of a chaining setter according to
+// PanicOnCodecError, TaskFrozenError always panics as a chaining setter
+// has no way to report it, see TrySetData and TrySetOutput
+func codecError(err error) {
+	if PanicOnCodecError || errors.Is(err, ErrTaskFrozen) {
+		panic(err)
+	}
+	log.Printf("jobs: encoding error ignored: %v", err)
+}
+
+// jsonField is a key/value pair of a JSON object, kept in order
+type jsonField struct {
+	key   string
+	value json.RawMessage
+}
+
+func decodeObject(data []byte) ([]jsonField, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var fields []jsonField
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, jsonField{key: key, value: value})
+	}
+	return fields, nil
+}
+
+func encodeObject(fields []jsonField) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(f.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// marshalStyled encodes a struct with kebab-case tags using JSONKeyStyle
+// and JSONTimeFormat
+func marshalStyled(v interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil || JSONKeyStyle == KeyKebabCase && JSONTimeFormat == TimeRFC3339 {
+		return encoded, err
+	}
+	fields, err := decodeObject(encoded)
+	if err != nil {
+		return nil, err
+	}
+	timeKeys := timeKeysOf(reflect.TypeOf(v))
+	for i := range fields {
+		if JSONTimeFormat == TimeEpochMillis && timeKeys[fields[i].key] {
+			if fields[i].value, err = timeToMillis(fields[i].value); err != nil {
+				return nil, err
+			}
+		}
+		fields[i].key = styleKey(fields[i].key, JSONKeyStyle)
+	}
+	return encodeObject(fields), nil
+}
+
+// unmarshalStyled decodes a struct with kebab-case tags from any key style
+// and time format
+func unmarshalStyled(data []byte, v interface{}) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil
+	}
+	fields, err := decodeObject(data)
+	if err != nil {
+		return err
+	}
+	timeKeys := timeKeysOf(reflect.TypeOf(v))
+	for i := range fields {
+		fields[i].key = kebabKey(fields[i].key)
+		if timeKeys[fields[i].key] {
+			if fields[i].value, err = millisToTime(fields[i].value); err != nil {
+				return err
+			}
+		}
+	}
+	return json.Unmarshal(encodeObject(fields), v)
+}
+
+// timeKeysOf finds the keys of time fields in a struct
+func timeKeysOf(t reflect.Type) map[string]bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	keys := make(map[string]bool)
+	for _, f := range paramFields(t) {
+		if f.Type == timeType {
+			keys[f.name] = true
+		}
+	}
+	return keys
+}
+
+// timeToMillis converts an encoded time to milliseconds since epoch,
+// zero time is encoded as 0
+func timeToMillis(value json.RawMessage) (json.RawMessage, error) {
+	var t time.Time
+	if err := json.Unmarshal(value, &t); err != nil {
+		return nil, err
+	}
+	if t.IsZero() {
+		return json.RawMessage("0"), nil
+	}
+	return json.Marshal(t.UnixMilli())
+}
+
+// millisToTime converts milliseconds since epoch to an encoded time,
+// values in other formats are kept unchanged
+func millisToTime(value json.RawMessage) (json.RawMessage, error) {
+	var millis int64
+	if json.Unmarshal(value, &millis) != nil {
+		return value, nil
+	}
+	var t time.Time
+	if millis != 0 {
+		t = time.UnixMilli(millis)
+	}
+	return json.Marshal(t)
+}
+
+func styleKey(key string, style KeyStyle) string {
+	switch style {
+	case KeyCamelCase:
+		parts := strings.Split(key, "-")
+		for i := 1; i < len(parts); i++ {
+			if parts[i] != "" {
+				parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+			}
+		}
+		return strings.Join(parts, "")
+	case KeySnakeCase:
+		return strings.ReplaceAll(key, "-", "_")
+	}
+	return key
+}
+
+func kebabKey(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		switch {
+		case r == '_':
+			b.WriteRune('-')
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+type taskJSON Task
+
+// MarshalJSON implements json.Marshaler
+func (t Task) MarshalJSON() ([]byte, error) {
+	return marshalStyled(taskJSON(t))
+}
+
+// EncodeOptions customizes the JSON encoding of a task, the zero value
+// produces the same encoding as json.Marshal
+type EncodeOptions struct {
+	Indent            string // indent of each level, compact if empty
+	DisableHTMLEscape bool   // keep <, > and & in strings unescaped
+}
+
+// Encode encodes the task into JSON with the options, keys and times are
+// styled the same as json.Marshal
+func (t *Task) Encode(opts EncodeOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(!opts.DisableHTMLEscape)
+	enc.SetIndent("", opts.Indent)
+	if err := enc.Encode(t); err != nil {
+		return nil, err
+	}
+	encoded := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	if opts.DisableHTMLEscape {
+		// MarshalJSON escapes HTML regardless of the encoder
+		encoded = unescapeHTML(encoded)
+	}
+	return encoded, nil
+}
+
+// unescapeHTML reverts the escapes of <, > and & in encoded JSON
+func unescapeHTML(encoded []byte) []byte {
+	out := make([]byte, 0, len(encoded))
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != '\\' || i+1 >= len(encoded) {
+			out = append(out, encoded[i])
+			continue
+		}
+		if encoded[i+1] == 'u' && i+6 <= len(encoded) {
+			switch string(encoded[i+2 : i+6]) {
+			case "003c":
+				out, i = append(out, '<'), i+5
+				continue
+			case "003e":
+				out, i = append(out, '>'), i+5
+				continue
+			case "0026":
+				out, i = append(out, '&'), i+5
+				continue
+			}
+		}
+		out, i = append(out, encoded[i], encoded[i+1]), i+1
+	}
+	return out
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *Task) UnmarshalJSON(data []byte) error {
+	if err := unmarshalStyled(data, (*taskJSON)(t)); err != nil {
+		return err
+	}
+	var raw struct {
+		State *int `json:"state"`
+	}
+	if json.Unmarshal(data, &raw) == nil && raw.State != nil && !TaskState(*raw.State).valid() {
+		t.Annotate("jobs", fmt.Sprintf("unknown state %d decoded as stucked", *raw.State))
+	}
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *TaskState) UnmarshalJSON(data []byte) error {
+	var v int
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	state := TaskState(v)
+	if !state.valid() {
+		if StrictDecoding {
+			return fmt.Errorf("unknown task state: %d", v)
+		}
+		state = TaskStucked
+	}
+	*s = state
+	return nil
+}
+
+type taskErrorFields TaskError
+
+// taskErrorJSON encodes the causes by their messages, as errors in
+// general can't be encoded and decoded
+type taskErrorJSON struct {
+	taskErrorFields
+	Cause  *CauseError   `json:"cause"`
+	Causes []*CauseError `json:"causes,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (e TaskError) MarshalJSON() ([]byte, error) {
+	encoded := taskErrorJSON{taskErrorFields: taskErrorFields(e), Cause: causeOf(e.Cause)}
+	for _, cause := range e.Causes {
+		if cause != nil {
+			encoded.Causes = append(encoded.Causes, causeOf(cause))
+		}
+	}
+	return marshalStyled(encoded)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+// The causes are decoded as CauseError
+func (e *TaskError) UnmarshalJSON(data []byte) error {
+	var decoded taskErrorJSON
+	if err := unmarshalStyled(data, &decoded); err != nil {
+		return err
+	}
+	*e = TaskError(decoded.taskErrorFields)
+	e.Cause, e.Causes = nil, nil
+	if decoded.Cause != nil {
+		e.Cause = decoded.Cause
+	}
+	for _, cause := range decoded.Causes {
+		if cause != nil {
+			e.Causes = append(e.Causes, cause)
+		}
+	}
+	return nil
+}
+
+// causeOf converts an error into its encodable form
+func causeOf(err error) *CauseError {
+	if err == nil {
+		return nil
+	}
+	if cause, ok := err.(*CauseError); ok {
+		return cause
+	}
+	cause := &CauseError{Message: err.Error()}
+	for _, sentinel := range causeSentinels {
+		if errors.Is(err, sentinel) {
+			cause.Matches = append(cause.Matches, sentinel.Error())
+		}
+	}
+	return cause
+}
+
+type taskStatsJSON TaskStats
+
+// MarshalJSON implements json.Marshaler
+func (s TaskStats) MarshalJSON() ([]byte, error) {
+	return marshalStyled(taskStatsJSON(s))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *TaskStats) UnmarshalJSON(data []byte) error {
+	return unmarshalStyled(data, (*taskStatsJSON)(s))
+}
+
+type annotationJSON Annotation
+
+// MarshalJSON implements json.Marshaler
+func (a Annotation) MarshalJSON() ([]byte, error) {
+	return marshalStyled(annotationJSON(a))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (a *Annotation) UnmarshalJSON(data []byte) error {
+	return unmarshalStyled(data, (*annotationJSON)(a))
+}
+
+type attemptJSON Attempt
+
+// MarshalJSON implements json.Marshaler
+func (a Attempt) MarshalJSON() ([]byte, error) {
+	return marshalStyled(attemptJSON(a))
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (a *Attempt) UnmarshalJSON(data []byte) error {
+	return unmarshalStyled(data, (*attemptJSON)(a))
+}
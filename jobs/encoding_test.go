@@ -0,0 +1,301 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setKeyStyle switches JSONKeyStyle for the test
+func setKeyStyle(t *testing.T, style KeyStyle) {
+	saved := JSONKeyStyle
+	JSONKeyStyle = style
+	t.Cleanup(func() { JSONKeyStyle = saved })
+}
+
+func TestKeyStyles(t *testing.T) {
+	task := &Task{ID: "t1", ParentID: "p1", MaxRetries: 3, Stats: &TaskStats{WorkerID: "w1"}}
+	cases := []struct {
+		style   KeyStyle
+		present []string
+	}{
+		{KeyKebabCase, []string{`"parent-id":"p1"`, `"max-retries":3`, `"worker-id":"w1"`}},
+		{KeyCamelCase, []string{`"parentId":"p1"`, `"maxRetries":3`, `"workerId":"w1"`}},
+		{KeySnakeCase, []string{`"parent_id":"p1"`, `"max_retries":3`, `"worker_id":"w1"`}},
+	}
+	for _, c := range cases {
+		setKeyStyle(t, c.style)
+		encoded, err := json.Marshal(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range c.present {
+			if !strings.Contains(string(encoded), s) {
+				t.Errorf("style %d: expect %s in %s", c.style, s, encoded)
+			}
+		}
+		var decoded Task
+		if err = json.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.ParentID != "p1" || decoded.MaxRetries != 3 || decoded.Stats == nil || decoded.Stats.WorkerID != "w1" {
+			t.Errorf("style %d: round-trip mismatch %+v", c.style, decoded)
+		}
+	}
+}
+
+func TestDecodeLegacyKeys(t *testing.T) {
+	setKeyStyle(t, KeyCamelCase)
+	var task Task
+	if err := json.Unmarshal([]byte(`{"id":"t1","parent-id":"p1","max-retries":2}`), &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.ParentID != "p1" || task.MaxRetries != 2 {
+		t.Errorf("expect kebab-case keys decoded, got %+v", task)
+	}
+}
+
+func TestDecodeUnknownState(t *testing.T) {
+	data := []byte(`{"id":"t1","state":99}`)
+	var task Task
+	if err := json.Unmarshal(data, &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.State != TaskStucked {
+		t.Errorf("expect stucked, got %s", task.State)
+	}
+	if len(task.Annotations) != 1 || !strings.Contains(task.Annotations[0].Text, "unknown state 99") {
+		t.Errorf("expect the unknown state noted, got %+v", task.Annotations)
+	}
+
+	saved := StrictDecoding
+	StrictDecoding = true
+	t.Cleanup(func() { StrictDecoding = saved })
+	if err := json.Unmarshal(data, &Task{}); err == nil || !strings.Contains(err.Error(), "unknown task state: 99") {
+		t.Errorf("expect a decode error, got %v", err)
+	}
+	var state TaskState
+	if err := json.Unmarshal([]byte(`-1`), &state); err == nil {
+		t.Error("expect a negative state rejected")
+	}
+	if err := json.Unmarshal([]byte(`3`), &state); err != nil || !state.valid() {
+		t.Errorf("expect a known state decoded, got %d, %v", state, err)
+	}
+}
+
+func setTimeFormat(t *testing.T, format TimeFormat) {
+	saved := JSONTimeFormat
+	JSONTimeFormat = format
+	t.Cleanup(func() { JSONTimeFormat = saved })
+}
+
+func TestTimeFormats(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	task := &Task{ID: "t1", CreatedAt: at, UpdatedAt: at.Add(time.Second),
+		Errors: []TaskError{{TaskID: "t1", Type: TaskErrRetry, HappenedAt: at}}}
+	millis := fmt.Sprint(at.UnixMilli())
+	cases := []struct {
+		format  TimeFormat
+		present []string
+	}{
+		{TimeRFC3339, []string{`"created-at":"2024-01-02T03:04:05.006Z"`, `"happened-at":"2024-01-02T03:04:05.006Z"`}},
+		{TimeEpochMillis, []string{`"created-at":` + millis, `"happened-at":` + millis, `"updated-at":` + fmt.Sprint(at.UnixMilli()+1000)}},
+	}
+	var encodings [][]byte
+	for _, c := range cases {
+		setTimeFormat(t, c.format)
+		encoded, err := json.Marshal(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range c.present {
+			if !strings.Contains(string(encoded), s) {
+				t.Errorf("format %d: expect %s in %s", c.format, s, encoded)
+			}
+		}
+		encodings = append(encodings, encoded)
+	}
+	// either format decodes regardless of the setting
+	for _, format := range []TimeFormat{TimeRFC3339, TimeEpochMillis} {
+		setTimeFormat(t, format)
+		for _, encoded := range encodings {
+			var decoded Task
+			if err := json.Unmarshal(encoded, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !decoded.CreatedAt.Equal(at) || !decoded.UpdatedAt.Equal(at.Add(time.Second)) ||
+				len(decoded.Errors) != 1 || !decoded.Errors[0].HappenedAt.Equal(at) {
+				t.Errorf("format %d: unexpected times decoded from %s", format, encoded)
+			}
+		}
+	}
+
+	setTimeFormat(t, TimeEpochMillis)
+	encoded, err := json.Marshal(&Task{ID: "t2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Task
+	if err = json.Unmarshal(encoded, &decoded); err != nil || !decoded.CreatedAt.IsZero() {
+		t.Errorf("expect zero time round-trip, got %s, %v", decoded.CreatedAt, err)
+	}
+}
+
+func TestErrorCausesRoundTrip(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("causes")
+	exceeded := task.NewError(TaskErrStuck).CausedBy(&MaxRetriesExceededError{TaskID: task.ID, Attempts: 3})
+	canceled := task.NewError(TaskErrFail).CausedBy(ErrTaskCanceled).AddCause(fmt.Errorf("quota: %w", ErrQuotaExceeded))
+	task.Errors = append(task.Errors, *exceeded, *canceled)
+	if err := SaveTask(store, task); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTask(store, task.ID)
+	if err != nil || loaded == nil || len(loaded.Errors) != 2 {
+		t.Fatalf("expect the errors loaded, got %v, %v", loaded, err)
+	}
+
+	first, second := &loaded.Errors[0], &loaded.Errors[1]
+	var cause *CauseError
+	if !errors.As(first.Cause, &cause) || cause.Message != exceeded.Cause.Error() {
+		t.Errorf("expect a CauseError keeping the message, got %#v", first.Cause)
+	}
+	if !errors.Is(first, ErrMaxRetriesExceeded) || errors.Is(first, ErrTaskCanceled) {
+		t.Errorf("expect only ErrMaxRetriesExceeded matched, got %v", first)
+	}
+	if !errors.Is(second, ErrTaskCanceled) || !errors.Is(second, ErrQuotaExceeded) {
+		t.Errorf("expect both causes matched, got %v", second)
+	}
+	if len(second.Causes) != 1 || second.Causes[0].Error() != "quota: "+ErrQuotaExceeded.Error() {
+		t.Errorf("expect the extra cause round-trip, got %v", second.Causes)
+	}
+}
+
+func TestDecodeNullPayloads(t *testing.T) {
+	for _, raw := range []string{
+		`{"id":"t1","name":"a","params":null,"data":null,"output":null}`,
+		`{"id":"t1","name":"a","params":"","data":"","output":""}`,
+		`{"id":"t1","name":"a"}`,
+	} {
+		var task Task
+		if err := json.Unmarshal([]byte(raw), &task); err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+		params, data, output := map[string]int{"kept": 1}, map[string]int{"kept": 1}, map[string]int{"kept": 1}
+		if err := task.GetParams(&params); err != nil || params["kept"] != 1 {
+			t.Errorf("%s: expect params unchanged, got %v, %v", raw, params, err)
+		}
+		if err := task.GetData(&data); err != nil || data["kept"] != 1 {
+			t.Errorf("%s: expect data unchanged, got %v, %v", raw, data, err)
+		}
+		if err := task.GetOutput(&output); err != nil || output["kept"] != 1 {
+			t.Errorf("%s: expect output unchanged, got %v, %v", raw, output, err)
+		}
+	}
+
+	task := NewTask("a").Build()
+	task.Params, task.Data, task.Output = []byte(" null\n"), []byte("null"), []byte("  ")
+	var params *struct{ N int }
+	if err := task.GetParams(&params); err != nil || params != nil {
+		t.Errorf("expect padded null decoded as absent, got %v, %v", params, err)
+	}
+}
+
+func TestPanicOnCodecError(t *testing.T) {
+	saved := PanicOnCodecError
+	t.Cleanup(func() { PanicOnCodecError = saved })
+	unencodable := func() {}
+	setters := []struct {
+		name string
+		fn   func(*Task)
+	}{
+		{"SetData", func(task *Task) { task.SetData(unencodable) }},
+		{"SetOutput", func(task *Task) { task.SetOutput(unencodable) }},
+		{"Build", func(task *Task) { NewTask("a").With(unencodable).Build() }},
+	}
+
+	PanicOnCodecError = true
+	for _, s := range setters {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expect panic", s.name)
+				}
+			}()
+			s.fn(NewTask("a").Build())
+		}()
+	}
+
+	PanicOnCodecError = false
+	for _, s := range setters {
+		task := NewTask("a").Build()
+		task.SetData(1).SetOutput("kept")
+		s.fn(task)
+		var data int
+		var output string
+		if task.GetData(&data); data != 1 {
+			t.Errorf("%s: expect the data unchanged, got %d", s.name, data)
+		}
+		if task.GetOutput(&output); output != "kept" {
+			t.Errorf("%s: expect the output unchanged, got %q", s.name, output)
+		}
+	}
+	if task := NewTask("a").With(unencodable).Build(); task.Params != nil {
+		t.Errorf("expect no params built, got %s", task.Params)
+	}
+
+	frozen := newRunnable("a")
+	frozen.Transition(TaskCompleted)
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrTaskFrozen) {
+			t.Errorf("expect a frozen task always panicking, got %v", err)
+		}
+	}()
+	frozen.SetData(1)
+}
+
+func TestEncodeOptions(t *testing.T) {
+	task := NewTask("encoded").WithLabel("html", "<b>&</b>").WithLabel("literal", `\u003c`).Build()
+	compact, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := task.Encode(EncodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, compact) {
+		t.Errorf("expect the zero options the same as json.Marshal, got %s", encoded)
+	}
+
+	indented, err := task.Encode(EncodeOptions{Indent: "  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(indented, []byte("\n  \"id\": ")) || !bytes.Contains(indented, []byte(`\u003cb\u003e\u0026`)) {
+		t.Errorf("expect indented and escaped, got %s", indented)
+	}
+	var buf bytes.Buffer
+	if err = json.Compact(&buf, indented); err != nil || !bytes.Equal(buf.Bytes(), compact) {
+		t.Errorf("expect only whitespace added by indent, got %s, %v", buf.Bytes(), err)
+	}
+
+	unescaped, err := task.Encode(EncodeOptions{DisableHTMLEscape: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(unescaped, []byte(`"<b>&</b>"`)) || bytes.Contains(unescaped, []byte("\n")) {
+		t.Errorf("expect compact without HTML escaped, got %s", unescaped)
+	}
+	var decoded Task
+	if err = json.Unmarshal(unescaped, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Labels["html"] != "<b>&</b>" || decoded.Labels["literal"] != `\u003c` {
+		t.Errorf("expect strings preserved, got %v", decoded.Labels)
+	}
+}
@@ -1,8 +1,202 @@
 package jobs
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
 
 // Common errors
 var (
-	ErrTaskNonRevertable = errors.New("task is not revertable")
+	ErrTaskNonRevertable  = errors.New("task is not revertable")
+	ErrMaxRetriesExceeded = errors.New("max retries exceeded")
+	ErrQueueFull          = errors.New("queue is full")
+	ErrWatchClosed        = errors.New("watch stream closed")
+	ErrNoBlobStore        = errors.New("blob store not configured")
+	ErrNoStore            = errors.New("store not configured")
+	ErrTaskFrozen         = errors.New("task is frozen")
+	ErrTaskNotFound       = errors.New("task not found")
+	ErrTaskCanceled       = errors.New("task canceled")
+	ErrTaskDetached       = errors.New("task detached from the execution")
+	ErrInvalidParams      = errors.New("invalid params")
+	ErrNoParent           = errors.New("task has no parent")
+	ErrTaskClaimed        = errors.New("task already claimed")
+	ErrTaskNotBlocked     = errors.New("task is not blocked")
+	ErrStaleTask          = errors.New("task is stale")
+	ErrLockBusy           = errors.New("lock is busy")
+	ErrFieldNotFound      = errors.New("field not found")
+	ErrMaxDepthExceeded   = errors.New("max task depth exceeded")
+	ErrTaskExpired        = errors.New("task expired")
+	ErrQuotaExceeded      = errors.New("submission quota exceeded")
+	ErrStageSkipped       = errors.New("stage skipped")
 )
+
+// CauseError is a cause of TaskError decoded from JSON, it keeps the
+// message of the original error and the common errors it matched, so
+// errors.Is still works after the task is saved and loaded
+type CauseError struct {
+	Message string   `json:"message"`
+	Matches []string `json:"matches,omitempty"` // messages of matched common errors
+}
+
+// causeSentinels are the common errors recorded in CauseError
+var causeSentinels = []error{
+	ErrTaskNonRevertable,
+	ErrMaxRetriesExceeded,
+	ErrQueueFull,
+	ErrTaskFrozen,
+	ErrTaskCanceled,
+	ErrInvalidParams,
+	ErrMaxDepthExceeded,
+	ErrTaskExpired,
+	ErrQuotaExceeded,
+	ErrTaskDetached,
+}
+
+// Error implements error
+func (e *CauseError) Error() string {
+	return e.Message
+}
+
+// Is matches an error with the same message, or a common error matched
+// by the original error
+func (e *CauseError) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+	msg := target.Error()
+	return msg == e.Message || containsString(e.Matches, msg)
+}
+
+// MaxRetriesExceededError indicates a task exhausted all retries
+type MaxRetriesExceededError struct {
+	TaskID   string // task id
+	Attempts uint   // number of attempts made
+}
+
+// Error implements error
+func (e *MaxRetriesExceededError) Error() string {
+	return fmt.Sprintf("task %s: %s after %d attempts",
+		e.TaskID, ErrMaxRetriesExceeded.Error(), e.Attempts)
+}
+
+// Is matches ErrMaxRetriesExceeded
+func (e *MaxRetriesExceededError) Is(target error) bool {
+	return target == ErrMaxRetriesExceeded
+}
+
+// MaxDepthExceededError indicates a sub task is too deep in the task tree
+type MaxDepthExceededError struct {
+	ParentID string // id of the parent task
+	Depth    int    // depth of the rejected sub task
+	MaxDepth int    // max depth allowed
+}
+
+// Error implements error
+func (e *MaxDepthExceededError) Error() string {
+	return fmt.Sprintf("task %s: %s: sub task depth %d > %d",
+		e.ParentID, ErrMaxDepthExceeded.Error(), e.Depth, e.MaxDepth)
+}
+
+// Is matches ErrMaxDepthExceeded
+func (e *MaxDepthExceededError) Is(target error) bool {
+	return target == ErrMaxDepthExceeded
+}
+
+// QuotaExceededError indicates a submission exceeded the quota of its key
+type QuotaExceededError struct {
+	Key        string        // quota key, e.g. tenant
+	RetryAfter time.Duration // when the next submission is allowed
+}
+
+// Error implements error
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %s", e.Key, ErrQuotaExceeded.Error(), e.RetryAfter)
+}
+
+// Is matches ErrQuotaExceeded
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// QueueFullError indicates a bounded queue rejected a task
+type QueueFullError struct {
+	Capacity int // capacity of the queue
+}
+
+// Error implements error
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("%s: capacity %d", ErrQueueFull.Error(), e.Capacity)
+}
+
+// Is matches ErrQueueFull
+func (e *QueueFullError) Is(target error) bool {
+	return target == ErrQueueFull
+}
+
+// TaskFrozenError indicates a mutation on a terminal task
+type TaskFrozenError struct {
+	TaskID string // task id
+}
+
+// Error implements error
+func (e *TaskFrozenError) Error() string {
+	return fmt.Sprintf("task %s: %s", e.TaskID, ErrTaskFrozen.Error())
+}
+
+// Is matches ErrTaskFrozen
+func (e *TaskFrozenError) Is(target error) bool {
+	return target == ErrTaskFrozen
+}
+
+// ValidationError reports invalid fields of params
+type ValidationError struct {
+	Fields map[string]string // field name to reason
+}
+
+// Error implements error
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + ": " + e.Fields[name]
+	}
+	return ErrInvalidParams.Error() + ": " + strings.Join(names, ", ")
+}
+
+// Is matches ErrInvalidParams
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidParams
+}
+
+// MarshalJSON implements json.Marshaler
+func (e *ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"error":  ErrInvalidParams.Error(),
+		"fields": e.Fields,
+	})
+}
+
+// BatchError reports the tasks failed in a batch operation
+type BatchError struct {
+	Failed map[string]error // task id to error
+}
+
+// Error implements error
+func (e *BatchError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, id := range ids {
+		ids[i] = id + ": " + e.Failed[id].Error()
+	}
+	return fmt.Sprintf("%d tasks failed: %s", len(ids), strings.Join(ids, "; "))
+}
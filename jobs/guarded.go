@@ -0,0 +1,163 @@
+package jobs
+
+import "sync"
+
+// GuardedTask serializes access to a task shared by goroutines
+// The task must only be accessed through the GuardedTask
+type GuardedTask struct {
+	lock sync.RWMutex
+	task *Task
+}
+
+// Guard wraps the task for concurrent access
+func Guard(task *Task) *GuardedTask {
+	return &GuardedTask{task: task}
+}
+
+// Read invokes fn with the task under read lock, fn must not mutate it
+func (g *GuardedTask) Read(fn func(*Task)) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	fn(g.task)
+}
+
+// Update invokes fn with the task under write lock
+func (g *GuardedTask) Update(fn func(*Task) error) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return fn(g.task)
+}
+
+// Snapshot returns a deep copy of the task
+func (g *GuardedTask) Snapshot() *Task {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.task.Clone()
+}
+
+// State returns the current state
+func (g *GuardedTask) State() TaskState {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.task.State
+}
+
+// GetData decodes the data
+func (g *GuardedTask) GetData(d interface{}) error {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.task.GetData(d)
+}
+
+// GetOutput decodes the output
+func (g *GuardedTask) GetOutput(p interface{}) error {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.task.GetOutput(p)
+}
+
+// SetData encodes and saves the data
+func (g *GuardedTask) SetData(d interface{}) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.task.TrySetData(d)
+}
+
+// SetOutput encodes and saves the output
+func (g *GuardedTask) SetOutput(p interface{}) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.task.TrySetOutput(p)
+}
+
+// SetProgress reports the percentage of completion
+func (g *GuardedTask) SetProgress(percent int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.task.SetProgress(percent)
+}
+
+// Emit appends a chunk to the output
+func (g *GuardedTask) Emit(chunk []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.task.TryEmit(chunk)
+}
+
+// AppendError records an error happened to the task
+func (g *GuardedTask) AppendError(err *TaskError) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.task.AppendError(err)
+}
+
+// Transition changes the state of the task
+func (g *GuardedTask) Transition(state TaskState) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.task.Transition(state)
+}
+
+// Heartbeat records the running task is alive
+func (g *GuardedTask) Heartbeat() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.task.Heartbeat()
+}
+
+// execution tracks the access of a Context to its task, the access is
+// revoked when the stage is abandoned or the execution ends, after which
+// the Context only sees a snapshot of the task
+// The fields are guarded by the lock of the GuardedTask
+type execution struct {
+	parent  *execution
+	revoked bool
+	final   *Task // snapshot of the task when revoked
+}
+
+// view returns the task accessible by the execution
+func (e *execution) view(task *Task) *Task {
+	for ; e != nil; e = e.parent {
+		if e.revoked {
+			return e.final
+		}
+	}
+	return task
+}
+
+// revoke must be called with the write lock held
+func (e *execution) revoke(task *Task) {
+	if !e.revoked {
+		e.revoked, e.final = true, task.Clone()
+	}
+}
+
+var (
+	runningLock sync.Mutex
+	// runningTasks are the tasks executed by local workers, keyed by ID
+	runningTasks = make(map[string]*GuardedTask)
+)
+
+// registerRunning makes a task executed by a local worker accessible by
+// other goroutines in this process, e.g. the Sweeper
+func registerRunning(id string, g *GuardedTask) {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	runningTasks[id] = g
+}
+
+func unregisterRunning(id string, g *GuardedTask) {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	if runningTasks[id] == g {
+		delete(runningTasks, id)
+	}
+}
+
+// runningGuard returns the guard of the task if it's executed by a local
+// worker, or nil
+func runningGuard(id string) *GuardedTask {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	return runningTasks[id]
+}
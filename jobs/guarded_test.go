@@ -0,0 +1,84 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestGuardedTaskConcurrent(t *testing.T) {
+	task := newRunnable("guarded")
+	task.Transition(TaskRunning)
+	g := Guard(task)
+	const workers, rounds = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				g.SetData(map[string]int{"worker": i, "round": j})
+				g.SetProgress(j)
+				g.Heartbeat()
+				g.Emit([]byte("."))
+				g.AppendError(NewTaskError(task.ID, TaskErrRetry).SetMessage(fmt.Sprint(i)))
+				g.Read(func(t *Task) { _ = t.Progress })
+				var data map[string]int
+				g.GetData(&data)
+				if _, err := json.Marshal(g.Snapshot()); err != nil {
+					t.Error(err)
+				}
+				_ = g.State()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(task.Errors); n != workers*rounds {
+		t.Errorf("expect %d errors, got %d", workers*rounds, n)
+	}
+	if n := len(task.Output); n != workers*rounds {
+		t.Errorf("expect %d bytes emitted, got %d", workers*rounds, n)
+	}
+	if err := g.Transition(TaskCompleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetData(1); err == nil {
+		t.Error("expect a completed task frozen through the guard")
+	}
+}
+
+func TestRunningTaskConcurrent(t *testing.T) {
+	d := &Dispatcher{}
+	s := &Sweeper{Store: newMemStore(), HeartbeatTimeout: 1 << 62}
+	d.AddTaskExecs(singleStage("guarded-run", func(ctx Context) error {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					ctx.SetProgress(j)
+					ctx.AddMetric("n", 1)
+					ctx.Emit([]byte("."))
+					ctx.Heartbeat()
+					_ = ctx.Current()
+				}
+			}()
+		}
+		task := ctx.Current()
+		for i := 0; i < 50; i++ {
+			// the sweeper reads the heartbeat of a local task through its guard
+			s.sweepHeartbeat(task.Clone(), task.Stats.ClaimedAt)
+		}
+		wg.Wait()
+		return nil
+	}))
+	task := newRunnable("guarded-run")
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatal(h.err)
+	}
+	if task.Metrics["n"] != 200 || len(task.Output) != 200 {
+		t.Errorf("expect all updates applied, got %v metrics, %d bytes", task.Metrics["n"], len(task.Output))
+	}
+}
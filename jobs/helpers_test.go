@@ -0,0 +1,266 @@
+package jobs
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store for tests, locks are acquired by
+// waiting until released
+type memStore struct {
+	lock    sync.Mutex
+	buckets map[string]*memBucket
+	locks   map[string]*sync.Mutex
+}
+
+func newMemStore() *memStore {
+	return &memStore{buckets: make(map[string]*memBucket), locks: make(map[string]*sync.Mutex)}
+}
+
+func (s *memStore) Bucket(name string) PartitionedStore {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b := s.buckets[name]
+	if b == nil {
+		b = &memBucket{items: make(map[string][]byte)}
+		s.buckets[name] = b
+	}
+	return b
+}
+
+func (s *memStore) OrderedList(name string) OrderedList {
+	return nil
+}
+
+func (s *memStore) Acquire(name string) Acquisition {
+	s.lock.Lock()
+	l := s.locks[name]
+	if l == nil {
+		l = &sync.Mutex{}
+		s.locks[name] = l
+	}
+	s.lock.Unlock()
+	l.Lock()
+	return &memLock{owner: name, lock: l}
+}
+
+// UpdateBatch implements BatchUpdater, the tasks are checked and saved
+// under a single lock of the bucket
+func (s *memStore) UpdateBatch(tasks []*Task) error {
+	failed := make(map[string]error)
+	defer lockTasks(s, tasks, failed)()
+	b := s.Bucket(TasksBucket).(*memBucket)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, task := range tasks {
+		if failed[task.ID] != nil {
+			continue
+		}
+		encoded := b.items[task.ID]
+		if encoded == nil {
+			failed[task.ID] = ErrTaskNotFound
+			continue
+		}
+		var stored Task
+		if err := json.Unmarshal(encoded, &stored); err != nil {
+			failed[task.ID] = err
+			continue
+		}
+		if stored.Version != task.Version {
+			failed[task.ID] = ErrStaleTask
+			continue
+		}
+		task.Version++
+		if encoded, err := json.Marshal(task); err != nil {
+			task.Version--
+			failed[task.ID] = err
+		} else {
+			b.items[task.ID] = encoded
+		}
+	}
+	return batchError(failed)
+}
+
+type memLock struct {
+	owner string
+	lock  *sync.Mutex
+}
+
+func (l *memLock) Acquired() bool { return true }
+func (l *memLock) Owner() string  { return l.owner }
+func (l *memLock) TTL() int       { return 0 }
+func (l *memLock) Refresh() error { return nil }
+func (l *memLock) Release()       { l.lock.Unlock() }
+
+type memBucket struct {
+	lock  sync.Mutex
+	items map[string][]byte
+}
+
+func (b *memBucket) Put(key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.items[key] = encoded
+	return nil
+}
+
+func (b *memBucket) Get(key string) (Value, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return memValue(b.items[key]), nil
+}
+
+func (b *memBucket) Remove(key string) (Value, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	v := b.items[key]
+	delete(b.items, key)
+	return memValue(v), nil
+}
+
+// Enumerate returns all values in a single page ordered by keys
+func (b *memBucket) Enumerate(EnumOptions) Enumerator {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	keys := make([]string, 0, len(b.items))
+	for key := range b.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	vals := make([]Value, 0, len(keys))
+	for _, key := range keys {
+		vals = append(vals, memValue(b.items[key]))
+	}
+	return &memEnumerator{vals: vals}
+}
+
+type memEnumerator struct {
+	vals []Value
+}
+
+func (e *memEnumerator) Next() ([]Value, error) {
+	vals := e.vals
+	e.vals = nil
+	return vals, nil
+}
+
+type memValue []byte
+
+func (v memValue) Valid() bool {
+	return v != nil
+}
+
+func (v memValue) Unmarshal(out interface{}) error {
+	return json.Unmarshal(v, out)
+}
+
+// testHandle is a TaskHandle completing the task like a MemQueue, it
+// records the calls and saves the task into store if any
+type testHandle struct {
+	memTaskHandle
+	store     Store
+	submitted []*Task
+	updates   int
+	done      bool
+	err       *TaskError
+}
+
+func newTestHandle(task *Task, store Store) *testHandle {
+	return &testHandle{memTaskHandle: memTaskHandle{queue: &MemQueue{}, task: task}, store: store}
+}
+
+func (h *testHandle) SubmitTask(task *Task) error {
+	h.submitted = append(h.submitted, task)
+	if h.store == nil {
+		return nil
+	}
+	return SaveTask(h.store, task)
+}
+
+func (h *testHandle) Update(task *Task) error {
+	h.updates++
+	if h.store == nil {
+		return nil
+	}
+	return SaveTask(h.store, task)
+}
+
+func (h *testHandle) Done(taskErr *TaskError) error {
+	h.done, h.err = true, taskErr
+	if err := h.memTaskHandle.Done(taskErr); err != nil || h.store == nil {
+		return err
+	}
+	return SaveTask(h.store, h.task)
+}
+
+// runOnce runs the task by a worker of the dispatcher
+func runOnce(d *Dispatcher, task *Task) *testHandle {
+	h := newTestHandle(task, d.Store)
+	w := &localWorker{dispatcher: d}
+	w.runTaskByHandle(h)
+	return h
+}
+
+// newRunnable builds a pending task of the name
+func newRunnable(name string) *Task {
+	task := NewTask(name).Build()
+	task.enqueue()
+	return task
+}
+
+// singleStage creates a TaskExec with a single stage
+func singleStage(name string, fn TaskFn) *TaskExec {
+	return &TaskExec{Name: name, Stages: []Stage{{Name: "run", Fn: fn}}}
+}
+
+// saveHooks restores the registered hooks when the test finishes
+func saveHooks(t *testing.T) {
+	hooksLock.Lock()
+	submit, completion, transition := submitHooks, completionHooks, transitionHooks
+	start, end := stageStartHooks, stageEndHooks
+	hooksLock.Unlock()
+	t.Cleanup(func() {
+		hooksLock.Lock()
+		defer hooksLock.Unlock()
+		submitHooks, completionHooks, transitionHooks = submit, completion, transition
+		stageStartHooks, stageEndHooks = start, end
+	})
+}
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// storeSubmitter submits tasks by saving them into the store
+type storeSubmitter struct {
+	store Store
+}
+
+func (s storeSubmitter) SubmitTask(task *Task) error {
+	return SaveTask(s.store, task)
+}
@@ -0,0 +1,183 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// SubmitHook is invoked before a task is submitted, it may mutate the
+// task, and an error aborts the submission
+type SubmitHook func(*Task) error
+
+// Summarizer produces a one-line summary of a terminal task
+type Summarizer func(*Task) string
+
+// CompletionHook is invoked when a task enters a terminal state
+type CompletionHook func(t *Task, summary string)
+
+// TransitionHook is invoked when a task changes state before it's
+// persisted, it may mutate the task
+type TransitionHook func(t *Task, from, to TaskState)
+
+// StageStartHook is invoked before the runner runs a stage
+type StageStartHook func(task *Task, stage string)
+
+// StageEndHook is invoked after the runner runs a stage with the
+// duration and the error of the stage, err is ErrStageSkipped if the
+// stage is skipped
+type StageEndHook func(task *Task, stage string, d time.Duration, err error)
+
+var (
+	hooksLock       sync.RWMutex
+	submitHooks     []SubmitHook
+	summarizers     = make(map[string]Summarizer)
+	completionHooks []CompletionHook
+	transitionHooks []TransitionHook
+	stageStartHooks []StageStartHook
+	stageEndHooks   []StageEndHook
+)
+
+// DefaultSummarizer is used for task names without a Summarizer
+var DefaultSummarizer Summarizer = SummarizeTask
+
+// SummarizeTask formats name, result, duration and error count
+func SummarizeTask(t *Task) string {
+	var d time.Duration
+	if !t.CreatedAt.IsZero() {
+		d = t.UpdatedAt.Sub(t.CreatedAt).Round(time.Millisecond)
+	}
+	return fmt.Sprintf("%s result=%s duration=%s errors=%d",
+		t.Name, t.Result, d, len(t.Errors))
+}
+
+// SetSummarizer specifies the Summarizer of a task name
+func SetSummarizer(name string, fn Summarizer) {
+	name = NormalizeName(name)
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	summarizers[name] = fn
+}
+
+// AddCompletionHook registers a CompletionHook, hooks run in
+// registration order
+func AddCompletionHook(hook CompletionHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	completionHooks = append(completionHooks, hook)
+}
+
+// AddTransitionHook registers a TransitionHook, hooks run in
+// registration order and a panic in a hook is recovered and logged
+func AddTransitionHook(hook TransitionHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	transitionHooks = append(transitionHooks, hook)
+}
+
+// OnStageStart registers a StageStartHook, hooks run in registration
+// order
+func OnStageStart(hook StageStartHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	stageStartHooks = append(stageStartHooks, hook)
+}
+
+// OnStageEnd registers a StageEndHook, hooks run in registration order
+func OnStageEnd(hook StageEndHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	stageEndHooks = append(stageEndHooks, hook)
+}
+
+// stageStarted runs stage start hooks
+func stageStarted(t *Task, stage string) {
+	if t.dryRun {
+		return
+	}
+	hooksLock.RLock()
+	hooks := stageStartHooks
+	hooksLock.RUnlock()
+	for _, hook := range hooks {
+		hook(t, stage)
+	}
+}
+
+// stageEnded runs stage end hooks
+func stageEnded(t *Task, stage string, d time.Duration, err error) {
+	if t.dryRun {
+		return
+	}
+	hooksLock.RLock()
+	hooks := stageEndHooks
+	hooksLock.RUnlock()
+	for _, hook := range hooks {
+		hook(t, stage, d, err)
+	}
+}
+
+// transitioned runs transition hooks
+func transitioned(t *Task, from, to TaskState) {
+	if t.dryRun {
+		return
+	}
+	hooksLock.RLock()
+	hooks := transitionHooks
+	hooksLock.RUnlock()
+	for _, hook := range hooks {
+		runTransitionHook(hook, t, from, to)
+	}
+}
+
+func runTransitionHook(hook TransitionHook, t *Task, from, to TaskState) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("task %s: transition hook panic: %v", t.ID, r)
+		}
+	}()
+	hook(t, from, to)
+}
+
+// completed summarizes the terminal task and runs completion hooks, the
+// hooks are suppressed in dry-run
+func completed(t *Task) {
+	name := NormalizeName(t.Name)
+	hooksLock.RLock()
+	fn := summarizers[name]
+	hooks := completionHooks
+	hooksLock.RUnlock()
+	if fn == nil {
+		fn = DefaultSummarizer
+	}
+	if fn != nil {
+		t.Summary = fn(t)
+	}
+	if t.dryRun {
+		return
+	}
+	for _, hook := range hooks {
+		hook(t, t.Summary)
+	}
+}
+
+// AddSubmitHook registers a SubmitHook, hooks run in registration order
+func AddSubmitHook(hook SubmitHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	submitHooks = append(submitHooks, hook)
+}
+
+func runSubmitHooks(task *Task) error {
+	if task.dryRun {
+		return nil
+	}
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+	for _, hook := range submitHooks {
+		if err := hook(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
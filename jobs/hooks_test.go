@@ -0,0 +1,179 @@
+package jobs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmitHooks(t *testing.T) {
+	saveHooks(t)
+	var order []string
+	AddSubmitHook(func(task *Task) error {
+		order = append(order, "label")
+		if task.Labels["tenant"] == "" {
+			task.Labels = map[string]string{"tenant": "default"}
+		}
+		return nil
+	})
+	errDenied := errors.New("denied")
+	AddSubmitHook(func(task *Task) error {
+		order = append(order, "deny")
+		if task.Name == "denied" {
+			return errDenied
+		}
+		return nil
+	})
+
+	r := &taskRecorder{}
+	task, err := (&TaskBuilder{Submitter: r, Name: "hooked"}).Submit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Labels["tenant"] != "default" || len(r.tasks) != 1 || r.tasks[0].Labels["tenant"] != "default" {
+		t.Errorf("expect a default label injected, got %v", task.Labels)
+	}
+	if len(order) != 2 || order[0] != "label" || order[1] != "deny" {
+		t.Errorf("expect hooks run in registration order, got %v", order)
+	}
+
+	if _, err = (&TaskBuilder{Submitter: r, Name: "denied"}).Submit(); !errors.Is(err, errDenied) {
+		t.Errorf("expect the hook error, got %v", err)
+	}
+	if len(r.tasks) != 1 {
+		t.Errorf("expect the submission blocked, got %d submitted", len(r.tasks))
+	}
+}
+
+func TestSummarizers(t *testing.T) {
+	saveHooks(t)
+	var summaries []string
+	AddCompletionHook(func(task *Task, summary string) {
+		summaries = append(summaries, summary)
+	})
+
+	task := newRunnable("summarized")
+	task.CreatedAt = task.UpdatedAt.Add(-1500 * time.Millisecond)
+	task.AppendError(task.NewError(TaskErrRetry))
+	task.Result = TaskFailure
+	task.Transition(TaskCompleted)
+	if !strings.HasPrefix(task.Summary, "summarized result=") || !strings.HasSuffix(task.Summary, " errors=1") ||
+		!strings.Contains(task.Summary, "duration=1.5") {
+		t.Errorf("unexpected default summary %q", task.Summary)
+	}
+
+	SetSummarizer("summarized-custom", func(task *Task) string { return "custom " + task.ID })
+	t.Cleanup(func() {
+		hooksLock.Lock()
+		defer hooksLock.Unlock()
+		delete(summarizers, "summarized-custom")
+	})
+	custom := newRunnable("summarized-custom")
+	custom.Transition(TaskCompleted)
+	if custom.Summary != "custom "+custom.ID {
+		t.Errorf("expect the custom summary, got %q", custom.Summary)
+	}
+	if len(summaries) != 2 || summaries[0] != task.Summary || summaries[1] != custom.Summary {
+		t.Errorf("expect summaries passed to completion hooks, got %v", summaries)
+	}
+}
+
+func TestTransitionHooks(t *testing.T) {
+	saveHooks(t)
+	var transitions []string
+	AddTransitionHook(func(task *Task, from, to TaskState) {
+		if task.Name != "transitioned" {
+			return
+		}
+		transitions = append(transitions, from.String()+">"+to.String())
+		if task.Labels == nil {
+			task.Labels = make(map[string]string)
+		}
+		task.Labels["processed-by"] = "v2"
+	})
+	AddTransitionHook(func(task *Task, from, to TaskState) {
+		if task.Name == "transitioned" {
+			panic("broken hook")
+		}
+	})
+	AddTransitionHook(func(task *Task, from, to TaskState) {
+		if task.Name == "transitioned" {
+			task.Labels["last"] = to.String()
+		}
+	})
+
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	d.AddTaskExecs(singleStage("transitioned", func(ctx Context) error { return nil }))
+	task := newRunnable("transitioned")
+	saveTasks(t, store, task)
+	runOnce(d, loadTask(t, store, task.ID))
+	stored := loadTask(t, store, task.ID)
+	if stored.Labels["processed-by"] != "v2" || stored.Labels["last"] != TaskCompleted.String() {
+		t.Errorf("expect the mutations persisted, got %v", stored.Labels)
+	}
+	want := []string{
+		TaskCreated.String() + ">" + TaskPending.String(),
+		TaskPending.String() + ">" + TaskRunning.String(),
+		TaskRunning.String() + ">" + TaskCompleted.String(),
+	}
+	if strings.Join(transitions, ",") != strings.Join(want, ",") {
+		t.Errorf("expect %v, got %v", want, transitions)
+	}
+}
+
+func TestStageHooks(t *testing.T) {
+	saveHooks(t)
+	type record struct {
+		stage string
+		d     time.Duration
+		err   error
+	}
+	var started []string
+	var ended []record
+	OnStageStart(func(task *Task, stage string) {
+		started = append(started, stage)
+	})
+	OnStageEnd(func(task *Task, stage string, d time.Duration, err error) {
+		ended = append(ended, record{stage, d, err})
+	})
+	errBroken := errors.New("broken")
+	d := &Dispatcher{}
+	d.AddTaskExecs(&TaskExec{Name: "staged", Stages: []Stage{
+		{Name: "fetch", Fn: func(ctx Context) error {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}},
+		{Name: "marker"},
+		{Name: "replayed", Fn: func(ctx Context) error {
+			t.Error("expect a completed stage not run")
+			return nil
+		}},
+		{Name: "apply", Fn: func(ctx Context) error { return errBroken }},
+		{Name: "never", Fn: func(ctx Context) error { return nil }},
+	}})
+	task := newRunnable("staged")
+	task.CompletedStages = map[string]bool{"replayed": true}
+	if h := runOnce(d, task); h.err == nil {
+		t.Fatal("expect the task failed")
+	}
+
+	if got := strings.Join(started, ","); got != "fetch,marker,replayed,apply" {
+		t.Errorf("expect start hooks up to the failed stage, got %s", got)
+	}
+	if len(ended) != 4 {
+		t.Fatalf("expect an end hook per started stage, got %v", ended)
+	}
+	if ended[0].stage != "fetch" || ended[0].err != nil || ended[0].d < 20*time.Millisecond {
+		t.Errorf("expect fetch timed without error, got %v", ended[0])
+	}
+	for _, r := range ended[1:3] {
+		if !errors.Is(r.err, ErrStageSkipped) || r.d != 0 {
+			t.Errorf("expect %s reported skipped, got %v", r.stage, r)
+		}
+	}
+	if ended[3].stage != "apply" || !errors.Is(ended[3].err, errBroken) {
+		t.Errorf("expect the error of apply reported, got %v", ended[3])
+	}
+}
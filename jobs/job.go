@@ -58,8 +58,25 @@ func (b *JobBuilder) Submit() (*Job, error) {
 		Task: b.Task,
 	}
 	if job.ID == "" {
-		// TODO generate ID
+		job.ID = newID()
 	}
 	job.Task.JobID = job.ID
-	return job, b.Submitter.SubmitJob(job)
+	if job.Task.TraceID == "" {
+		job.Task.TraceID = newID()
+	}
+	if err := runSubmitHooks(job.Task); err != nil {
+		return job, err
+	}
+	if err := job.Task.enqueue(); err != nil {
+		return job, err
+	}
+	quota := Quota
+	if err := quota.Consume(job.Task); err != nil {
+		return job, err
+	}
+	err := b.Submitter.SubmitJob(job)
+	if err != nil {
+		quota.Refund(job.Task)
+	}
+	return job, err
 }
@@ -0,0 +1,26 @@
+package jobs
+
+import "testing"
+
+type jobRecorder struct {
+	jobs []*Job
+}
+
+func (r *jobRecorder) SubmitJob(job *Job) error {
+	r.jobs = append(r.jobs, job)
+	return nil
+}
+
+func TestJobBuilderGeneratesID(t *testing.T) {
+	r := &jobRecorder{}
+	job, err := (&JobBuilder{Submitter: r}).SetTask(NewTask("entry").Build()).Submit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" || job.Task.JobID != job.ID {
+		t.Errorf("expect the job ID assigned to the entry task, got %q/%q", job.ID, job.Task.JobID)
+	}
+	if job.Task.State != TaskPending {
+		t.Errorf("expect the entry task pending, got %s", job.Task.State)
+	}
+}
@@ -0,0 +1,66 @@
+package jobtest
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/evo-cloud/cloudrt/jobs"
+)
+
+// AssertOutputEqual fails the test if the output of the task is not
+// semantically equal to want in JSON, e.g. key ordering is ignored
+func AssertOutputEqual(tb testing.TB, task *jobs.Task, want interface{}) {
+	tb.Helper()
+	var actual interface{}
+	if err := task.GetOutput(&actual); err != nil {
+		tb.Fatalf("task %s: decode output: %v", task.ID, err)
+	}
+	assertJSONEqual(tb, "output", task, actual, want)
+}
+
+// AssertParamsEqual fails the test if the params of the task are not
+// semantically equal to want in JSON, e.g. key ordering is ignored
+func AssertParamsEqual(tb testing.TB, task *jobs.Task, want interface{}) {
+	tb.Helper()
+	var actual interface{}
+	if err := task.GetParams(&actual); err != nil {
+		tb.Fatalf("task %s: decode params: %v", task.ID, err)
+	}
+	assertJSONEqual(tb, "params", task, actual, want)
+}
+
+func assertJSONEqual(tb testing.TB, what string, task *jobs.Task, actual, want interface{}) {
+	tb.Helper()
+	expected, err := normalizeJSON(want)
+	if err != nil {
+		tb.Fatalf("task %s: encode expected %s: %v", task.ID, what, err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		actualJSON, _ := json.Marshal(actual)
+		expectedJSON, _ := json.Marshal(expected)
+		tb.Errorf("task %s: %s mismatch\n got: %s\nwant: %s", task.ID, what, actualJSON, expectedJSON)
+	}
+}
+
+// normalizeJSON converts v to the generic form decoded from its JSON
+// encoding, raw JSON in []byte or json.RawMessage is decoded directly
+func normalizeJSON(v interface{}) (interface{}, error) {
+	var encoded []byte
+	switch raw := v.(type) {
+	case json.RawMessage:
+		encoded = raw
+	case []byte:
+		encoded = raw
+	default:
+		var err error
+		if encoded, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
@@ -0,0 +1,97 @@
+package jobtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/evo-cloud/cloudrt/jobs"
+)
+
+// recordingTB records failures instead of failing the test
+type recordingTB struct {
+	testing.TB
+	failures []string
+	fatal    bool
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	r.fatal = true
+	runtime.Goexit()
+}
+
+// record runs the assertion and returns the failures
+func record(fn func(tb testing.TB)) *recordingTB {
+	r := &recordingTB{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn(r)
+	}()
+	wg.Wait()
+	return r
+}
+
+// payloadTask builds a task with the params and the raw output
+func payloadTask(output string) *jobs.Task {
+	task := jobs.NewTask("assert").With(json.RawMessage(`{"b":[1,2],"a":{"y":"v","x":1.5}}`)).Build()
+	task.Output = []byte(output)
+	return task
+}
+
+func TestAssertEqual(t *testing.T) {
+	task := payloadTask(`{"b":[1,2],"a":{"y":"v","x":1.5}}`)
+	type inner struct {
+		X float64 `json:"x"`
+		Y string  `json:"y"`
+	}
+	for _, want := range []interface{}{
+		json.RawMessage(`{"a":{"x":1.5,"y":"v"},"b":[1,2]}`),
+		[]byte(` { "a" : { "y" : "v", "x" : 1.50 }, "b" : [ 1, 2 ] } `),
+		map[string]interface{}{"a": inner{X: 1.5, Y: "v"}, "b": []int{1, 2}},
+	} {
+		if r := record(func(tb testing.TB) { AssertOutputEqual(tb, task, want) }); len(r.failures) != 0 {
+			t.Errorf("output %s: expect equal, got %v", want, r.failures)
+		}
+		if r := record(func(tb testing.TB) { AssertParamsEqual(tb, task, want) }); len(r.failures) != 0 {
+			t.Errorf("params %s: expect equal, got %v", want, r.failures)
+		}
+	}
+}
+
+func TestAssertNotEqual(t *testing.T) {
+	task := payloadTask(`{"b":[1,2],"a":{"y":"v","x":1.5}}`)
+	for _, want := range []string{
+		`{"a":{"x":1.5,"y":"v"},"b":[2,1]}`,
+		`{"a":{"x":1.5,"y":"v"},"b":[1,2],"c":null}`,
+		`{"a":{"x":"1.5","y":"v"},"b":[1,2]}`,
+		`null`,
+	} {
+		r := record(func(tb testing.TB) { AssertOutputEqual(tb, task, json.RawMessage(want)) })
+		if len(r.failures) != 1 || r.fatal {
+			t.Errorf("output %s: expect a mismatch, got %v", want, r.failures)
+		}
+		r = record(func(tb testing.TB) { AssertParamsEqual(tb, task, json.RawMessage(want)) })
+		if len(r.failures) != 1 || r.fatal {
+			t.Errorf("params %s: expect a mismatch, got %v", want, r.failures)
+		}
+	}
+
+	broken := payloadTask(`{"a":`)
+	if r := record(func(tb testing.TB) { AssertOutputEqual(tb, broken, nil) }); !r.fatal {
+		t.Errorf("expect an undecodable output fatal, got %v", r.failures)
+	}
+	if r := record(func(tb testing.TB) { AssertOutputEqual(tb, task, func() {}) }); !r.fatal {
+		t.Errorf("expect an unencodable expectation fatal, got %v", r.failures)
+	}
+}
@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Kind is a strongly-typed identifier of a task name
+type Kind int
+
+var (
+	kindsLock sync.RWMutex
+	kindNames = make(map[Kind]string)
+)
+
+// RegisterKind associates the kind with a task name
+func RegisterKind(k Kind, name string) {
+	kindsLock.Lock()
+	defer kindsLock.Unlock()
+	kindNames[k] = name
+}
+
+// Name returns the registered task name of the kind
+func (k Kind) Name() (string, bool) {
+	kindsLock.RLock()
+	defer kindsLock.RUnlock()
+	name, ok := kindNames[k]
+	return name, ok
+}
+
+// String implements fmt.Stringer
+func (k Kind) String() string {
+	if name, ok := k.Name(); ok {
+		return name
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// OfKind specifies the task name from the registered kind
+// An unknown kind fails Submit, or panics in Build
+func (b *TaskBuilder) OfKind(k Kind) *TaskBuilder {
+	name, ok := k.Name()
+	if !ok {
+		b.err = fmt.Errorf("unknown task kind: %d", int(k))
+		return b
+	}
+	b.Name = name
+	return b
+}
@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	kindBuild Kind = iota + 1000
+	kindDeploy
+	kindUnknown
+)
+
+func TestOfKind(t *testing.T) {
+	RegisterKind(kindBuild, "kind-build")
+	RegisterKind(kindDeploy, "kind-deploy")
+	t.Cleanup(func() {
+		kindsLock.Lock()
+		defer kindsLock.Unlock()
+		delete(kindNames, kindBuild)
+		delete(kindNames, kindDeploy)
+	})
+
+	if task := NewTask("").OfKind(kindDeploy).Build(); task.Name != "kind-deploy" {
+		t.Errorf("expect the name of the kind, got %q", task.Name)
+	}
+	if kindBuild.String() != "kind-build" || kindUnknown.String() != "Kind(1002)" {
+		t.Errorf("unexpected names %s, %s", kindBuild, kindUnknown)
+	}
+
+	r := &taskRecorder{}
+	_, err := (&TaskBuilder{Submitter: r}).OfKind(kindUnknown).Submit()
+	if err == nil || !strings.Contains(err.Error(), "unknown task kind: 1002") || len(r.tasks) != 0 {
+		t.Errorf("expect an unknown kind to fail Submit, got %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expect an unknown kind to panic in Build")
+		}
+	}()
+	NewTask("").OfKind(kindUnknown).Build()
+}
@@ -0,0 +1,127 @@
+package jobs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LogsHandler serves GET /tasks/{id}/logs streaming the emitted output
+// of a task as Server-Sent Events until the task is terminal
+// It uses the watch stream if store implements TaskWatcher, otherwise
+// polls the store in the specified interval, FuturePollInterval if
+// poll is not positive
+func LogsHandler(store Store, poll time.Duration) http.Handler {
+	if poll <= 0 {
+		poll = FuturePollInterval
+	}
+	return &logsHandler{store: store, poll: poll}
+}
+
+type logsHandler struct {
+	store Store
+	poll  time.Duration
+}
+
+func (h *logsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseLogsPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	task, err := LoadTask(h.store, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if task == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	var updates <-chan *Task
+	if watcher, ok := h.store.(TaskWatcher); ok {
+		if updates, err = watcher.WatchTask(ctx, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var tick <-chan time.Time
+	if updates == nil {
+		ticker := time.NewTicker(h.poll)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	sent := 0
+	for {
+		if task != nil {
+			sent = writeLogEvents(w, task, sent)
+			if task.State.IsTerminal() {
+				fmt.Fprint(w, "event: end\ndata: completed\n\n")
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			task = update
+		case <-tick:
+			if task, err = LoadTask(h.store, id); err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+				return
+			}
+		}
+	}
+}
+
+// writeLogEvents writes the output after the offset sent as events, and
+// returns the new offset
+func writeLogEvents(w http.ResponseWriter, task *Task, sent int) int {
+	start, body := task.emittedOutput()
+	if sent < start {
+		sent = start
+	}
+	if sent >= start+len(body) {
+		return sent
+	}
+	chunk := body[sent-start:]
+	for _, line := range bytes.Split(chunk, []byte("\n")) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+	return start + len(body)
+}
+
+func parseLogsPath(path string) (string, bool) {
+	if !strings.HasPrefix(path, "/tasks/") || !strings.HasSuffix(path, "/logs") {
+		return "", false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(path, "/tasks/"), "/logs")
+	if id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,136 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogsHandlerStream(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("logs")
+	task.Transition(TaskRunning)
+	task.Emit([]byte("hello"))
+	saveTasks(t, store, task)
+	srv := httptest.NewServer(LogsHandler(store, time.Millisecond))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/tasks/" + task.ID + "/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expect event stream, got %s", ct)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	next := func() string {
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return ""
+				}
+				if line != "" {
+					return line
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout reading events")
+			}
+		}
+	}
+	if line := next(); line != "data: hello" {
+		t.Fatalf("expect the existing output, got %q", line)
+	}
+	task.Emit([]byte(" world\nbye"))
+	saveTasks(t, store, task)
+	for _, want := range []string{"data:  world", "data: bye"} {
+		if line := next(); line != want {
+			t.Fatalf("expect %q, got %q", want, line)
+		}
+	}
+	task.Transition(TaskCompleted)
+	saveTasks(t, store, task)
+	for _, want := range []string{"event: end", "data: completed", ""} {
+		if line := next(); line != want {
+			t.Fatalf("expect %q, got %q", want, line)
+		}
+	}
+}
+
+func TestLogsHandlerClientClosed(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("logs")
+	saveTasks(t, store, task)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/tasks/"+task.ID+"/logs", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		LogsHandler(store, time.Millisecond).ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect the stream stopped when the client is gone")
+	}
+}
+
+func TestLogsHandlerErrors(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("logs")
+	saveTasks(t, store, task)
+	h := LogsHandler(store, time.Millisecond)
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/tasks/unknown/logs", http.StatusNotFound},
+		{http.MethodGet, "/tasks/" + task.ID, http.StatusNotFound},
+		{http.MethodGet, "/tasks/a/b/logs", http.StatusNotFound},
+		{http.MethodPost, "/tasks/" + task.ID + "/logs", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expect %d, got %d", c.method, c.path, c.status, rec.Code)
+		}
+	}
+}
+
+func TestLogsHandlerDefaultPoll(t *testing.T) {
+	saved := FuturePollInterval
+	FuturePollInterval = time.Millisecond
+	t.Cleanup(func() { FuturePollInterval = saved })
+	store := newMemStore()
+	task := newRunnable("logs-default-poll")
+	task.Transition(TaskRunning)
+	saveTasks(t, store, task)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		task.Emit([]byte("done"))
+		task.Transition(TaskCompleted)
+		saveTasks(t, store, task)
+	}()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/tasks/"+task.ID+"/logs", nil)
+	LogsHandler(store, 0).ServeHTTP(rec, req)
+	if body := rec.Body.String(); !strings.Contains(body, "data: done") || !strings.Contains(body, "event: end") {
+		t.Errorf("expect polled until completed, got %q", body)
+	}
+}
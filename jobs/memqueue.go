@@ -0,0 +1,381 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// QueuePolicy defines the behavior when a bounded queue is full
+type QueuePolicy int
+
+// Queue policies
+const (
+	QueueBlock  QueuePolicy = iota // block until space is available
+	QueueReject                    // return QueueFullError
+)
+
+// MemQueue is an in-memory task submitter with bounded capacity, and a
+// Strategy running the tasks by the workers in the same process
+type MemQueue struct {
+	Capacity int         // max number of queued tasks, 0 means unlimited
+	Policy   QueuePolicy // behavior when the queue is full
+	// Scheduler picks the next task to fetch, FIFO if nil
+	Scheduler SchedulingStrategy
+	// Affinity is the duration since a retried task is enqueued in which
+	// PeekFor only offers it to the worker of its previous attempt, so it
+	// prefers the warm caches of that worker, 0 disables the affinity
+	Affinity time.Duration
+	// RetryPolicy delays retried tasks, only RetryAfter of the errors
+	// applies if nil
+	RetryPolicy RetryPolicy
+	// PollInterval is the max duration FetchTask of a worker waits for a
+	// runnable task, DefaultPollInterval if 0
+	PollInterval time.Duration
+
+	lock   sync.Mutex
+	tasks  []*Task
+	popped chan struct{} // closed when tasks are dequeued
+	pushed chan struct{} // closed when tasks are enqueued
+}
+
+// DefaultPollInterval is the default PollInterval of MemQueue
+var DefaultPollInterval = 100 * time.Millisecond
+
+// NewMemQueue creates a MemQueue
+func NewMemQueue(capacity int, policy QueuePolicy) *MemQueue {
+	return &MemQueue{Capacity: capacity, Policy: policy}
+}
+
+// SubmitTask implements TaskSubmitter
+func (q *MemQueue) SubmitTask(task *Task) error {
+	return q.SubmitTaskContext(context.Background(), task)
+}
+
+// SubmitTaskContext enqueues a task, a created task becomes pending,
+// when the queue is full, it blocks until space is available or ctx is
+// done, or returns QueueFullError according to Policy
+func (q *MemQueue) SubmitTaskContext(ctx context.Context, task *Task) error {
+	if err := task.enqueue(); err != nil {
+		return err
+	}
+	for {
+		q.lock.Lock()
+		if q.Capacity <= 0 || len(q.tasks) < q.Capacity {
+			q.push(task)
+			q.lock.Unlock()
+			return nil
+		}
+		if q.Policy == QueueReject {
+			q.lock.Unlock()
+			return &QueueFullError{Capacity: q.Capacity}
+		}
+		if q.popped == nil {
+			q.popped = make(chan struct{})
+		}
+		popped := q.popped
+		q.lock.Unlock()
+
+		select {
+		case <-popped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Fetch dequeues the next task in the queues runnable now, all queues if
+// none is specified, returns nil if there's no such task
+func (q *MemQueue) Fetch(queues ...string) *Task {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	var candidates []*Task
+	var indices []int
+	for i, task := range q.tasks {
+		if task.inQueues(queues) && q.runnableAt(task, now) {
+			candidates = append(candidates, task)
+			indices = append(indices, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	index := 0
+	if q.Scheduler != nil {
+		index = q.Scheduler.Pick(candidates)
+	}
+	return q.remove(indices[index])
+}
+
+// runnableAt determines if a queued task is runnable at the time by
+// NextAction, an expired task is offered so the worker aborts it, and a
+// blocked task isn't runnable until signaled
+func (q *MemQueue) runnableAt(task *Task, now time.Time) bool {
+	switch task.NextAction(now, q.RetryPolicy).Type {
+	case ActionRun, ActionAbort:
+		return true
+	}
+	return false
+}
+
+// Peek inspects the next task in the queues runnable at the time without
+// dequeuing it, all queues if none is specified
+func (q *MemQueue) Peek(now time.Time, queues ...string) (*Task, bool) {
+	return q.PeekFor(now, "", queues...)
+}
+
+// PeekFor is Peek on behalf of a worker, a retried task is skipped if
+// it's within Affinity of another worker
+func (q *MemQueue) PeekFor(now time.Time, workerID string, queues ...string) (*Task, bool) {
+	return q.peek(now, workerID, WorkerFilter{Queues: queues})
+}
+
+// peek finds the next runnable task matched by the filter and offered to
+// the worker
+func (q *MemQueue) peek(now time.Time, workerID string, filter WorkerFilter) (*Task, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var runnable []*Task
+	for _, task := range q.tasks {
+		if !filter.Match(task) || !q.offers(task, workerID, now) {
+			continue
+		}
+		if q.runnableAt(task, now) {
+			runnable = append(runnable, task)
+		}
+	}
+	if len(runnable) == 0 {
+		return nil, false
+	}
+	index := 0
+	if q.Scheduler != nil {
+		index = q.Scheduler.Pick(runnable)
+	}
+	return runnable[index], true
+}
+
+// offers determines if the task is offered to the worker at the time
+// according to Affinity, the task is offered to any worker after it
+func (q *MemQueue) offers(task *Task, workerID string, now time.Time) bool {
+	if q.Affinity <= 0 || workerID == "" {
+		return true
+	}
+	previous := task.PreviousWorker()
+	return previous == "" || previous == workerID || !now.Before(task.EnqueuedAt.Add(q.Affinity))
+}
+
+// Claim dequeues a task returned by Peek and assigns it to the worker
+// It fails with ErrTaskClaimed if the task is no longer in the queue
+func (q *MemQueue) Claim(task *Task, workerID string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, t := range q.tasks {
+		if t == task {
+			q.remove(i)
+			task.claimed(time.Now())
+			task.ensureStats().WorkerID = workerID
+			return nil
+		}
+	}
+	return ErrTaskClaimed
+}
+
+// Signal unblocks a blocked task in the queue like Signal on a Store
+func (q *MemQueue) Signal(taskID string, payload []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, task := range q.tasks {
+		if task.ID == taskID {
+			if err := signalTask(task, payload); err != nil {
+				return err
+			}
+			// wake up the workers waiting for a runnable task
+			q.notifyPushed()
+			return nil
+		}
+	}
+	return ErrTaskNotFound
+}
+
+// Len returns the number of queued tasks
+func (q *MemQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.tasks)
+}
+
+// push enqueues the task regardless of Capacity, it must be called with
+// lock held
+func (q *MemQueue) push(task *Task) {
+	q.tasks = append(q.tasks, task)
+	q.notifyPushed()
+}
+
+func (q *MemQueue) notifyPushed() {
+	if q.pushed != nil {
+		close(q.pushed)
+		q.pushed = nil
+	}
+}
+
+// requeue puts a claimed task back, a claimed task always fits though
+// the queue may be full meanwhile
+func (q *MemQueue) requeue(task *Task) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.push(task)
+}
+
+// pushedChan returns a channel closed when a task is enqueued
+func (q *MemQueue) pushedChan() <-chan struct{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.pushed == nil {
+		q.pushed = make(chan struct{})
+	}
+	return q.pushed
+}
+
+func (q *MemQueue) remove(index int) *Task {
+	task := q.tasks[index]
+	copy(q.tasks[index:], q.tasks[index+1:])
+	q.tasks[len(q.tasks)-1] = nil
+	q.tasks = q.tasks[:len(q.tasks)-1]
+	q.notifyPopped()
+	return task
+}
+
+func (q *MemQueue) notifyPopped() {
+	if q.popped != nil {
+		close(q.popped)
+		q.popped = nil
+	}
+}
+
+// SubmitJob implements Strategy
+func (q *MemQueue) SubmitJob(job *Job) error {
+	return q.SubmitTask(job.Task)
+}
+
+// NewWorker implements Strategy, the worker peeks the next runnable task
+// and claims it, so a task peeked by two workers only runs on one
+func (q *MemQueue) NewWorker() WorkerStrategy {
+	return q.NewFilteredWorker(WorkerFilter{})
+}
+
+// NewFilteredWorker implements FilteredStrategy, the worker only peeks
+// the tasks matched by the filter, others are left in place
+func (q *MemQueue) NewFilteredWorker(filter WorkerFilter) WorkerStrategy {
+	return &memWorker{queue: q, id: newID(), filter: filter}
+}
+
+type memWorker struct {
+	queue  *MemQueue
+	id     string
+	filter WorkerFilter
+}
+
+// FetchTask implements WorkerStrategy, it waits up to PollInterval for a
+// runnable task and returns nil if there's none
+func (w *memWorker) FetchTask() (TaskHandle, error) {
+	interval := w.queue.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		pushed := w.queue.pushedChan()
+		if task, ok := w.queue.peek(time.Now(), w.id, w.filter); ok {
+			err := w.queue.Claim(task, w.id)
+			if err == nil {
+				return &memTaskHandle{queue: w.queue, task: task}, nil
+			}
+			if !errors.Is(err, ErrTaskClaimed) {
+				return nil, err
+			}
+			// claimed by another worker after peeked
+			continue
+		}
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+// memTaskHandle is the handle of a task claimed from a MemQueue, the task
+// only lives in memory so there's nothing to persist
+type memTaskHandle struct {
+	queue *MemQueue
+	task  *Task
+}
+
+// Task implements TaskHandle
+func (h *memTaskHandle) Task() *Task {
+	return h.task
+}
+
+// SubmitTask implements TaskHandle
+func (h *memTaskHandle) SubmitTask(task *Task) error {
+	return h.queue.SubmitTask(task)
+}
+
+// Update implements TaskHandle
+func (h *memTaskHandle) Update(*Task) error {
+	return nil
+}
+
+// Done implements TaskHandle, the task is completed without an error,
+// requeued on a retry or rollback error, stucked on a stuck error, and
+// completed with TaskFailure on other errors
+// A task waiting for sub tasks is left as is, and a task completed in
+// rollback direction fails
+func (h *memTaskHandle) Done(taskErr *TaskError) error {
+	task := h.task
+	if task.State == TaskWaiting {
+		return nil
+	}
+	if taskErr == nil || taskErr.Type == TaskErrIgnored {
+		if task.Revert && task.Result == TaskSuccess {
+			task.Result = TaskFailure
+		}
+		return task.Transition(TaskCompleted)
+	}
+	if err := task.AppendError(taskErr); err != nil {
+		return err
+	}
+	switch taskErr.Type {
+	case TaskErrRetry:
+		task.Retries++
+		return h.requeue()
+	case TaskErrRevert:
+		task.Revert = true
+		return h.requeue()
+	case TaskErrStuck:
+		return task.Transition(TaskStucked)
+	}
+	if task.Result == TaskSuccess {
+		task.Result = TaskFailure
+	}
+	return task.Transition(TaskCompleted)
+}
+
+// Release implements TaskReleaser, the task stays pending
+func (h *memTaskHandle) Release() error {
+	h.task.ensureStats().WorkerID = ""
+	h.queue.requeue(h.task)
+	return nil
+}
+
+func (h *memTaskHandle) requeue() error {
+	h.task.ensureStats().WorkerID = ""
+	if err := h.task.Transition(TaskPending); err != nil {
+		return err
+	}
+	h.queue.requeue(h.task)
+	return nil
+}
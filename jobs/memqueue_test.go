@@ -0,0 +1,307 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemQueueReject(t *testing.T) {
+	q := NewMemQueue(2, QueueReject)
+	for i := 0; i < 2; i++ {
+		if err := q.SubmitTask(NewTask("a").Build()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := q.SubmitTask(NewTask("a").Build())
+	var full *QueueFullError
+	if !errors.As(err, &full) || full.Capacity != 2 || !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expect QueueFullError, got %v", err)
+	}
+	if q.Fetch() == nil {
+		t.Fatal("expect a task fetched")
+	}
+	if err = q.SubmitTask(NewTask("a").Build()); err != nil {
+		t.Errorf("expect accepted after fetched, got %v", err)
+	}
+}
+
+func TestMemQueueBlock(t *testing.T) {
+	q := NewMemQueue(1, QueueBlock)
+	if err := q.SubmitTask(NewTask("a").Build()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.SubmitTaskContext(ctx, NewTask("a").Build()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect blocked until ctx is done, got %v", err)
+	}
+
+	submitted := make(chan error, 1)
+	go func() {
+		submitted <- q.SubmitTaskContext(context.Background(), NewTask("b").Build())
+	}()
+	select {
+	case err := <-submitted:
+		t.Fatalf("expect blocked while full, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if task := q.Fetch(); task == nil || task.Name != "a" {
+		t.Fatalf("expect task a fetched, got %v", task)
+	}
+	select {
+	case err := <-submitted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect unblocked when space is available")
+	}
+	if q.Len() != 1 {
+		t.Errorf("expect 1 queued, got %d", q.Len())
+	}
+}
+
+func TestMemQueuePeekClaim(t *testing.T) {
+	q := &MemQueue{}
+	now := time.Now()
+	delayed := NewTask("delayed").ScheduleAt(now.Add(time.Hour)).Build()
+	if err := q.SubmitTask(delayed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.Peek(now); ok {
+		t.Fatal("expect a delayed task not runnable before scheduled")
+	}
+	if task, ok := q.Peek(now.Add(time.Hour)); !ok || task != delayed {
+		t.Fatal("expect the delayed task runnable when scheduled")
+	}
+
+	task := NewTask("peeked").Build()
+	if err := q.SubmitTask(task); err != nil {
+		t.Fatal(err)
+	}
+	a, okA := q.Peek(now)
+	b, okB := q.Peek(now)
+	if !okA || !okB || a != task || b != task || q.Len() != 2 {
+		t.Fatalf("expect peeking without dequeuing, got %d queued", q.Len())
+	}
+	if task.Stats != nil && task.Stats.WorkerID != "" {
+		t.Error("expect the peeked task not mutated")
+	}
+	if err := q.Claim(a, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Claim(b, "w2"); !errors.Is(err, ErrTaskClaimed) {
+		t.Errorf("expect ErrTaskClaimed, got %v", err)
+	}
+	if task.Stats.WorkerID != "w1" || task.Stats.ClaimedAt.IsZero() || q.Len() != 1 {
+		t.Errorf("expect claimed by w1, got %q", task.Stats.WorkerID)
+	}
+}
+
+func TestMemQueueClaimRace(t *testing.T) {
+	q := &MemQueue{}
+	if err := q.SubmitTask(NewTask("raced").Build()); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	claimed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			task, ok := q.Peek(time.Now())
+			if !ok {
+				return
+			}
+			if err := q.Claim(task, fmt.Sprint("w", i)); err == nil {
+				lock.Lock()
+				claimed++
+				lock.Unlock()
+			} else if !errors.Is(err, ErrTaskClaimed) {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Errorf("expect claimed exactly once, got %d", claimed)
+	}
+}
+
+func TestQueueRouting(t *testing.T) {
+	q := &MemQueue{}
+	for _, queue := range []string{"", "gpu", "gpu"} {
+		if err := q.SubmitTask(NewTask("routed").InQueue(queue).Build()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if task := q.Fetch("gpu"); task == nil || task.Queue != "gpu" {
+		t.Errorf("expect a gpu task fetched, got %+v", task)
+	}
+	if task := q.Fetch(DefaultQueue); task == nil || task.QueueName() != DefaultQueue {
+		t.Errorf("expect the task without a queue in the default queue, got %+v", task)
+	}
+	if task := q.Fetch("cpu"); task != nil {
+		t.Errorf("expect nothing in an empty queue, got %+v", task)
+	}
+	if task := q.Fetch(); task == nil || task.Queue != "gpu" {
+		t.Errorf("expect any queue fetched without queues, got %+v", task)
+	}
+}
+
+// fetchOnce fetches a task by the worker, nil if there's none
+func fetchOnce(t *testing.T, w Worker) *Task {
+	t.Helper()
+	handle, err := w.(*localWorker).strategy.FetchTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle == nil {
+		return nil
+	}
+	return handle.Task()
+}
+
+// untouched determines if the queued task was never claimed
+func untouched(task *Task) bool {
+	return task.State == TaskPending && (task.Stats == nil || task.Stats.ClaimedAt.IsZero() && task.Stats.ExpireAt.IsZero())
+}
+
+func TestWorkerQueues(t *testing.T) {
+	q := &MemQueue{PollInterval: time.Millisecond}
+	d := &Dispatcher{Strategy: q}
+	plain := NewTask("routed").WithTTL(time.Minute).Build()
+	gpu, later := NewTask("routed").InQueue("gpu").Build(), NewTask("routed").Build()
+	for _, task := range []*Task{plain, gpu, later} {
+		if err := q.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if task := fetchOnce(t, d.Worker("gpu")); task != gpu {
+		t.Errorf("expect the gpu worker claiming the gpu task, got %+v", task)
+	}
+	if task := fetchOnce(t, d.Worker("gpu")); task != nil {
+		t.Errorf("expect nothing left for the gpu worker, got %+v", task)
+	}
+	if !untouched(plain) || !untouched(later) {
+		t.Errorf("expect other tasks never claimed, got %+v", plain.Stats)
+	}
+	w := d.Worker(DefaultQueue)
+	if task := fetchOnce(t, w); task != plain {
+		t.Errorf("expect the task without a queue claimed in order, got %+v", task)
+	}
+	if task := fetchOnce(t, w); task != later {
+		t.Errorf("expect the later task claimed next, got %+v", task)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expect all tasks claimed, %d left", q.Len())
+	}
+}
+
+// plainHandle hides the optional interfaces of a TaskHandle
+type plainHandle struct {
+	TaskHandle
+}
+
+func TestWorkerCapabilities(t *testing.T) {
+	q := &MemQueue{PollInterval: time.Millisecond}
+	d := &Dispatcher{Strategy: q}
+	gpu := NewTask("capable").Require("gpu", "a100").Require("region", "us").Build()
+	unrestricted := NewTask("capable").Build()
+	for _, task := range []*Task{gpu, unrestricted} {
+		if err := q.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cpu := d.CapableWorker(map[string]string{"region": "us"})
+	if task := fetchOnce(t, cpu); task != unrestricted {
+		t.Errorf("expect the cpu worker claiming the task without requirements, got %+v", task)
+	}
+	if task := fetchOnce(t, cpu); task != nil || !untouched(gpu) || q.Len() != 1 {
+		t.Errorf("expect the gpu task left untouched, got %+v", task)
+	}
+	other := d.CapableWorker(map[string]string{"gpu": "a100", "region": "eu"})
+	if task := fetchOnce(t, other); task != nil {
+		t.Errorf("expect requirements matched by value, got %+v", task)
+	}
+	full := d.CapableWorker(map[string]string{"gpu": "a100", "region": "us", "disk": "ssd"})
+	if task := fetchOnce(t, full); task != gpu {
+		t.Errorf("expect a worker with a superset of capabilities claiming the gpu task, got %+v", task)
+	}
+
+	// a skipped task which can't be released is left to the claim expiry
+	pinned := NewTask("capable").Require("gpu", "h100").Build()
+	pinned.enqueue()
+	if cpu.(*localWorker).accepts(plainHandle{&memTaskHandle{queue: q, task: pinned}}) || q.Len() != 0 {
+		t.Error("expect an unreleasable task skipped without requeuing")
+	}
+}
+
+// unfilteredQueue hides FilteredStrategy of a MemQueue
+type unfilteredQueue struct {
+	queue *MemQueue
+}
+
+func (q unfilteredQueue) SubmitJob(job *Job) error {
+	return q.queue.SubmitJob(job)
+}
+
+func (q unfilteredQueue) NewWorker() WorkerStrategy {
+	return q.queue.NewWorker()
+}
+
+func TestWorkerReleasesUnmatched(t *testing.T) {
+	q := &MemQueue{PollInterval: time.Millisecond}
+	d := &Dispatcher{Strategy: unfilteredQueue{q}}
+	gpu := NewTask("routed").InQueue("gpu").Build()
+	if err := q.SubmitTask(gpu); err != nil {
+		t.Fatal(err)
+	}
+	w := d.Worker("cpu").(*localWorker)
+	handle, err := w.strategy.FetchTask()
+	if err != nil || handle == nil {
+		t.Fatalf("expect the task fetched by a worker without filtering, got %v", err)
+	}
+	if w.accepts(handle) || gpu.State != TaskPending || gpu.Stats.WorkerID != "" || q.Len() != 1 {
+		t.Errorf("expect the unmatched task released, got %s by %q", gpu.State, gpu.Stats.WorkerID)
+	}
+}
+
+func TestMemQueueAffinity(t *testing.T) {
+	q := &MemQueue{Affinity: time.Minute}
+	retried := NewTask("retried").Build()
+	retried.Attempts = []Attempt{{Number: 1, WorkerID: "w1"}}
+	fresh := NewTask("fresh").Build()
+	if fresh.PreviousWorker() != "" || retried.PreviousWorker() != "w1" {
+		t.Fatalf("expect the previous worker from attempts, got %q/%q", fresh.PreviousWorker(), retried.PreviousWorker())
+	}
+	for _, task := range []*Task{retried, fresh} {
+		if err := q.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := retried.EnqueuedAt
+
+	if task, ok := q.PeekFor(now, "w1"); !ok || task != retried {
+		t.Errorf("expect the retried task offered to its previous worker, got %v", task)
+	}
+	if task, ok := q.PeekFor(now, "w2"); !ok || task != fresh {
+		t.Errorf("expect the retried task held for its previous worker, got %v", task)
+	}
+	if task, ok := q.Peek(now); !ok || task != retried {
+		t.Errorf("expect no affinity without a worker, got %v", task)
+	}
+	if task, ok := q.PeekFor(now.Add(time.Minute), "w2"); !ok || task != retried {
+		t.Errorf("expect the retried task offered to any worker after the window, got %v", task)
+	}
+
+	q.Affinity = 0
+	if task, ok := q.PeekFor(now, "w2"); !ok || task != retried {
+		t.Errorf("expect no preference when disabled, got %v", task)
+	}
+}
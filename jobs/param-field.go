@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParamField decodes a single value in params into out without decoding
+// the whole params, the path is dotted keys with optional array indices,
+// e.g. "source.files[2].name"
+// It fails with ErrFieldNotFound if the path doesn't exist
+func (t *Task) ParamField(path string, out interface{}) error {
+	segments, err := parseFieldPath(path)
+	if err != nil {
+		return err
+	}
+	params, err := loadPayload(t.Params, t.ParamsRef)
+	if err != nil {
+		return err
+	}
+	value := json.RawMessage(params)
+	for i, seg := range segments {
+		if value, err = seg.lookup(value); err != nil {
+			return fmt.Errorf("%s: %w", fieldPathString(segments[:i+1]), err)
+		}
+	}
+	return json.Unmarshal(value, out)
+}
+
+// fieldSegment is either a key of an object or an index of an array
+type fieldSegment struct {
+	key   string
+	index int // used when key is empty
+}
+
+func (s fieldSegment) lookup(value json.RawMessage) (json.RawMessage, error) {
+	if s.key == "" {
+		var elems []json.RawMessage
+		if json.Unmarshal(value, &elems) != nil || s.index >= len(elems) {
+			return nil, ErrFieldNotFound
+		}
+		return elems[s.index], nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(value, &fields) != nil {
+		return nil, ErrFieldNotFound
+	}
+	found, ok := fields[s.key]
+	if !ok {
+		return nil, ErrFieldNotFound
+	}
+	return found, nil
+}
+
+// parseFieldPath parses a path like "a.b[2].c"
+func parseFieldPath(path string) ([]fieldSegment, error) {
+	var segments []fieldSegment
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		if pos := strings.IndexByte(part, '['); pos >= 0 {
+			key = part[:pos]
+		}
+		if key != "" {
+			segments = append(segments, fieldSegment{key: key})
+		}
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid field path %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid field path %q", path)
+			}
+			segments = append(segments, fieldSegment{index: index})
+			rest = rest[end+1:]
+		}
+		if key == "" && part == "" {
+			return nil, fmt.Errorf("invalid field path %q", path)
+		}
+	}
+	return segments, nil
+}
+
+func fieldPathString(segments []fieldSegment) string {
+	var b strings.Builder
+	for _, s := range segments {
+		if s.key == "" {
+			fmt.Fprintf(&b, "[%d]", s.index)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(s.key)
+	}
+	return b.String()
+}
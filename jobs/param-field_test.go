@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParamField(t *testing.T) {
+	task := NewTask("a").With(map[string]interface{}{
+		"source": map[string]interface{}{
+			"bucket": "logs",
+			"files": []map[string]interface{}{
+				{"name": "a.log", "size": 1},
+				{"name": "b.log", "size": 2},
+			},
+		},
+		"matrix": [][]int{{1, 2}, {3, 4}},
+	}).Build()
+
+	var name string
+	if err := task.ParamField("source.bucket", &name); err != nil || name != "logs" {
+		t.Errorf("expect a nested field, got %q, %v", name, err)
+	}
+	if err := task.ParamField("source.files[1].name", &name); err != nil || name != "b.log" {
+		t.Errorf("expect an array-indexed field, got %q, %v", name, err)
+	}
+	var n int
+	if err := task.ParamField("matrix[1][0]", &n); err != nil || n != 3 {
+		t.Errorf("expect nested indices, got %d, %v", n, err)
+	}
+	var file struct{ Name string }
+	if err := task.ParamField("source.files[0]", &file); err != nil || file.Name != "a.log" {
+		t.Errorf("expect an object decoded, got %+v, %v", file, err)
+	}
+
+	for _, path := range []string{"target", "source.files[2].name", "source.bucket.name", "matrix[0].x"} {
+		if err := task.ParamField(path, &name); !errors.Is(err, ErrFieldNotFound) {
+			t.Errorf("%s: expect ErrFieldNotFound, got %v", path, err)
+		}
+	}
+	if err := task.ParamField("source.files[2].name", &name); err == nil || err.Error() != "source.files[2]: field not found" {
+		t.Errorf("expect the missing prefix of the path reported, got %v", err)
+	}
+	for _, path := range []string{"", "a..b", "files[x]", "files[-1]", "files[1"} {
+		if err := task.ParamField(path, &name); err == nil || errors.Is(err, ErrFieldNotFound) {
+			t.Errorf("%q: expect an invalid path, got %v", path, err)
+		}
+	}
+}
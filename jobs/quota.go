@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+)
+
+// Quota limits the rate of submissions when set, nil is unlimited
+var Quota *SubmitQuota
+
+// SubmitQuota limits the rate of submissions per key using token buckets,
+// a token is only charged when the submission succeeds
+type SubmitQuota struct {
+	// Key derives the quota key of a task, the label "tenant" if nil,
+	// tasks with an empty key are unlimited
+	Key func(*Task) string
+	// Burst is the max number of submissions at once per key
+	Burst int
+	// Rate is the number of submissions refilled per second per key
+	Rate float64
+	// Now returns the current time, time.Now is used if nil
+	Now func() time.Time
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens     float64
+	refilledAt time.Time
+}
+
+// Consume takes a token from the bucket of the task key, it fails with
+// QuotaExceededError if the bucket is empty, a nil quota is unlimited
+func (q *SubmitQuota) Consume(task *Task) error {
+	if q == nil || task.dryRun {
+		return nil
+	}
+	key := q.key(task)
+	if key == "" {
+		return nil
+	}
+	now := q.now()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.buckets == nil {
+		q.buckets = make(map[string]*tokenBucket)
+	}
+	bucket := q.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(q.Burst), refilledAt: now}
+		q.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.refilledAt); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * q.Rate
+		if bucket.tokens > float64(q.Burst) {
+			bucket.tokens = float64(q.Burst)
+		}
+		bucket.refilledAt = now
+	}
+	if bucket.tokens < 1 {
+		var retryAfter time.Duration
+		if q.Rate > 0 {
+			retryAfter = time.Duration((1 - bucket.tokens) / q.Rate * float64(time.Second))
+		}
+		return &QuotaExceededError{Key: key, RetryAfter: retryAfter}
+	}
+	bucket.tokens--
+	return nil
+}
+
+// Refund returns the token taken by Consume when the submission fails
+func (q *SubmitQuota) Refund(task *Task) {
+	if q == nil || task.dryRun {
+		return
+	}
+	key := q.key(task)
+	if key == "" {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if bucket := q.buckets[key]; bucket != nil && bucket.tokens < float64(q.Burst) {
+		bucket.tokens++
+	}
+}
+
+func (q *SubmitQuota) key(task *Task) string {
+	if q.Key != nil {
+		return q.Key(task)
+	}
+	return task.Labels["tenant"]
+}
+
+func (q *SubmitQuota) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubmitQuota(t *testing.T) {
+	clock := newFakeClock()
+	useQuota(t, &SubmitQuota{Burst: 2, Rate: 0.5, Now: clock.Now})
+	r := &taskRecorder{}
+	submit := func(tenant string) error {
+		_, err := (&TaskBuilder{Submitter: r, Name: "quota"}).WithLabel("tenant", tenant).Submit()
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := submit("noisy"); err != nil {
+			t.Fatalf("expect submission %d within the burst, got %v", i, err)
+		}
+	}
+	err := submit("noisy")
+	var exceeded *QuotaExceededError
+	if !errors.As(err, &exceeded) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect QuotaExceededError, got %v", err)
+	}
+	if exceeded.Key != "noisy" || exceeded.RetryAfter != 2*time.Second {
+		t.Errorf("expect retry after 2s for noisy, got %s/%s", exceeded.Key, exceeded.RetryAfter)
+	}
+	if err = submit("quiet"); err != nil {
+		t.Errorf("expect another tenant unaffected, got %v", err)
+	}
+	if err = submit(""); err != nil {
+		t.Errorf("expect unlimited without a tenant, got %v", err)
+	}
+	if len(r.tasks) != 4 {
+		t.Errorf("expect the rejected task not submitted, got %d", len(r.tasks))
+	}
+
+	clock.Advance(time.Second)
+	if err = submit("noisy"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expect exceeded before refilled, got %v", err)
+	}
+	clock.Advance(time.Second)
+	if err = submit("noisy"); err != nil {
+		t.Errorf("expect a submission after refilled, got %v", err)
+	}
+}
+
+// useQuota installs the quota for the test
+func useQuota(t *testing.T, quota *SubmitQuota) {
+	saved := Quota
+	t.Cleanup(func() { Quota = saved })
+	Quota = quota
+}
+
+func TestSubmitQuotaFailedSubmission(t *testing.T) {
+	useQuota(t, &SubmitQuota{Burst: 1, Now: newFakeClock().Now})
+	errDown := errors.New("down")
+	r := &taskRecorder{err: errDown}
+	submit := func() error {
+		_, err := (&TaskBuilder{Submitter: r, Name: "quota-failed"}).WithLabel("tenant", "t").Submit()
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := submit(); !errors.Is(err, errDown) {
+			t.Fatalf("expect the submission failed, got %v", err)
+		}
+	}
+	r.err = nil
+	if err := submit(); err != nil {
+		t.Fatalf("expect failed submissions not charged, got %v", err)
+	}
+	if err := submit(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expect the successful submission charged, got %v", err)
+	}
+	job := &JobBuilder{Submitter: &MemQueue{}, Task: NewTask("quota-job").WithLabel("tenant", "t").Build()}
+	if _, err := job.Submit(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expect jobs limited by the quota, got %v", err)
+	}
+}
+
+func TestSubmitQuotaKey(t *testing.T) {
+	quota := &SubmitQuota{Key: func(task *Task) string { return task.Name }, Burst: 1, Now: newFakeClock().Now}
+	if err := quota.Consume(NewTask("a").Build()); err != nil {
+		t.Fatal(err)
+	}
+	var exceeded *QuotaExceededError
+	if err := quota.Consume(NewTask("a").Build()); !errors.As(err, &exceeded) || exceeded.RetryAfter != 0 {
+		t.Errorf("expect exceeded without refill, got %v", err)
+	}
+	if err := quota.Consume(NewTask("b").Build()); err != nil {
+		t.Errorf("expect a separate bucket per key, got %v", err)
+	}
+}
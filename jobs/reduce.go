@@ -0,0 +1,136 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+)
+
+// ReduceFn merges the output of a child task into the accumulator,
+// acc is nil for the first child
+type ReduceFn func(acc, childOutput []byte) ([]byte, error)
+
+// Reducer incrementally reduces the outputs of child tasks into the
+// output of their parent as each child completes, so the outputs of all
+// children are never loaded at once
+// The parent is completed once the expected number of children are
+// reduced, children without a successful result are counted but not
+// fed into Fn, and the parent fails if any of them didn't succeed
+type Reducer struct {
+	Store Store
+	Fn    ReduceFn
+}
+
+type reduceState struct {
+	Expected int             `json:"expected"`
+	Reduced  map[string]bool `json:"reduced"`
+	Failed   int             `json:"failed"` // reduced children without success
+}
+
+// Expect sets the number of children to reduce into the parent, it must
+// be called before the children complete
+func (r *Reducer) Expect(parentID string, children int) error {
+	return r.Store.Bucket(reduceBucket(parentID)).Put(reduceStateKey, &reduceState{Expected: children})
+}
+
+// Reduce feeds the output of a completed child into its parent, a child
+// already reduced is ignored
+func (r *Reducer) Reduce(child *Task) error {
+	if child.ParentID == "" {
+		return ErrNoParent
+	}
+	if lock := r.Store.Acquire(reduceBucket(child.ParentID)); lock != nil {
+		if !lock.Acquired() {
+			return ErrLockBusy
+		}
+		defer lock.Release()
+	}
+	bucket := r.Store.Bucket(reduceBucket(child.ParentID))
+	var state reduceState
+	val, err := bucket.Get(reduceStateKey)
+	if err != nil {
+		return err
+	}
+	if val != nil && val.Valid() {
+		if err = val.Unmarshal(&state); err != nil {
+			return err
+		}
+	}
+	if state.Reduced[child.ID] {
+		return nil
+	}
+	parent, err := LoadTask(r.Store, child.ParentID)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		return ErrTaskNotFound
+	}
+	if err = parent.checkFrozen(); err != nil {
+		return err
+	}
+	if child.Result == TaskSuccess {
+		if err = r.feed(parent, child); err != nil {
+			return err
+		}
+	} else {
+		state.Failed++
+	}
+	if state.Reduced == nil {
+		state.Reduced = make(map[string]bool)
+	}
+	state.Reduced[child.ID] = true
+	finished := state.Expected > 0 && len(state.Reduced) >= state.Expected
+	if finished {
+		parent.Result = TaskSuccess
+		if state.Failed > 0 {
+			parent.Result = TaskFailure
+			parent.Annotate("reducer", fmt.Sprintf("%d/%d children failed", state.Failed, len(state.Reduced)))
+		}
+		if err = parent.Transition(TaskCompleted); err != nil {
+			return err
+		}
+	}
+	if err = SaveTask(r.Store, parent); err != nil {
+		return err
+	}
+	if finished {
+		_, err = bucket.Remove(reduceStateKey)
+		return err
+	}
+	return bucket.Put(reduceStateKey, &state)
+}
+
+// feed reduces the output of child into the output of parent
+func (r *Reducer) feed(parent, child *Task) error {
+	output, err := loadPayload(child.Output, child.OutputRef)
+	if err != nil {
+		return err
+	}
+	acc, err := loadPayload(parent.Output, parent.OutputRef)
+	if err != nil {
+		return err
+	}
+	if acc, err = r.Fn(acc, output); err != nil {
+		return err
+	}
+	return parent.storeOutput(acc)
+}
+
+// Hook creates a CompletionHook reducing the completed tasks of the name
+// Failures are logged, use Reduce directly to handle them
+func (r *Reducer) Hook(name string) CompletionHook {
+	return func(t *Task, summary string) {
+		if t.Name != name || t.ParentID == "" {
+			return
+		}
+		if err := r.Reduce(t); err != nil {
+			log.Printf("task %s: reduce into %s failed: %v", t.ID, t.ParentID, err)
+		}
+	}
+}
+
+const reduceStateKey = "state"
+
+func reduceBucket(parentID string) string {
+	return "reduce:" + parentID
+}
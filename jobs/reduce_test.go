@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sumReducer sums the integer outputs of children
+func sumReducer(store Store) *Reducer {
+	return &Reducer{Store: store, Fn: func(acc, childOutput []byte) ([]byte, error) {
+		var sum, n int
+		if acc != nil {
+			if err := json.Unmarshal(acc, &sum); err != nil {
+				return nil, err
+			}
+		}
+		if err := json.Unmarshal(childOutput, &n); err != nil {
+			return nil, err
+		}
+		return json.Marshal(sum + n)
+	}}
+}
+
+// completedChild builds a completed child task of the parent
+func completedChild(parentID string, result TaskResult, output int) *Task {
+	child := newRunnable("mapper")
+	child.ParentID = parentID
+	child.SetOutput(output)
+	child.Result = result
+	child.Transition(TaskCompleted)
+	return child
+}
+
+func TestReducerSum(t *testing.T) {
+	store := newMemStore()
+	parent := newRunnable("reduce-parent")
+	saveTasks(t, store, parent)
+	r := sumReducer(store)
+	if err := r.Expect(parent.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		child := completedChild(parent.ID, TaskSuccess, i)
+		if err := r.Reduce(child); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// a child reduced again is ignored
+			if err := r.Reduce(child); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stored := loadTask(t, store, parent.ID); (stored.State == TaskCompleted) != (i == 10) {
+			t.Fatalf("child %d: unexpected parent state %s", i, stored.State)
+		}
+	}
+	stored := loadTask(t, store, parent.ID)
+	var sum int
+	if err := stored.GetOutput(&sum); err != nil || sum != 55 || stored.Result != TaskSuccess {
+		t.Errorf("expect the sum 55 succeeded, got %d, %s, %v", sum, stored.Result, err)
+	}
+	if err := r.Reduce(completedChild(parent.ID, TaskSuccess, 1)); !errors.Is(err, ErrTaskFrozen) {
+		t.Errorf("expect a completed parent frozen, got %v", err)
+	}
+	if err := r.Reduce(newRunnable("orphan")); !errors.Is(err, ErrNoParent) {
+		t.Errorf("expect ErrNoParent, got %v", err)
+	}
+}
+
+func TestReducerFailedChild(t *testing.T) {
+	store := newMemStore()
+	parent := newRunnable("reduce-parent")
+	saveTasks(t, store, parent)
+	r := sumReducer(store)
+	if err := r.Expect(parent.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	hook := r.Hook("mapper")
+	for i, result := range []TaskResult{TaskSuccess, TaskFailure, TaskSuccess} {
+		hook(completedChild(parent.ID, result, i+1), "")
+	}
+	stored := loadTask(t, store, parent.ID)
+	var sum int
+	if err := stored.GetOutput(&sum); err != nil || sum != 4 {
+		t.Errorf("expect only succeeded children reduced, got %d, %v", sum, err)
+	}
+	if stored.State != TaskCompleted || stored.Result != TaskFailure {
+		t.Fatalf("expect the parent failed, got %s/%s", stored.State, stored.Result)
+	}
+	if n := len(stored.Annotations); n == 0 || !strings.Contains(stored.Annotations[n-1].Text, "1/3 children failed") {
+		t.Errorf("expect the failures annotated, got %+v", stored.Annotations)
+	}
+}
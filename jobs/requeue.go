@@ -0,0 +1,61 @@
+package jobs
+
+import (
+	"errors"
+	"time"
+)
+
+// RequeueResetsRetries determines if RequeueStuck resets the retries
+var RequeueResetsRetries = true
+
+// RequeueStuck makes stucked tasks selected by the filter pending again,
+// and returns the number of tasks requeued
+// The states in the filter are ignored, and tasks changed by others
+// meanwhile are skipped
+func RequeueStuck(store Store, filter Filter) (int, error) {
+	filter.States = []TaskState{TaskStucked}
+	tasks, err := ListTasks(store, filter)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, task := range tasks {
+		if RequeueResetsRetries {
+			task.Retries = 0
+		}
+		if task.Stats != nil {
+			task.Stats.WorkerID = ""
+		}
+		if err = task.Transition(TaskPending); err != nil {
+			return count, err
+		}
+		if err = SaveTask(store, task); errors.Is(err, ErrStaleTask) {
+			// changed since listed, e.g. already requeued
+			continue
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// RedrivePolicy automatically requeues stucked tasks, the delay is
+// counted from when the Sweeper finds a task stucked, and doubles on
+// each redrive
+type RedrivePolicy struct {
+	After        time.Duration // delay of the first redrive
+	MaxRedrives  int           // max redrives of a task, 0 disables redrive
+	ResetRetries bool          // reset the retries of a redriven task
+}
+
+// applies determines if the stucked task may be redriven
+func (p RedrivePolicy) applies(task *Task) bool {
+	return p.MaxRedrives > 0 && task.State == TaskStucked && task.Redrives < p.MaxRedrives
+}
+
+// due determines if the stucked task found dead since the recorded time
+// should be redriven at the time
+func (p RedrivePolicy) due(task *Task, now time.Time) bool {
+	return !now.Before(task.Stats.DeadSince.Add(p.After << uint(task.Redrives)))
+}
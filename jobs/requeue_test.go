@@ -0,0 +1,49 @@
+package jobs
+
+import "testing"
+
+// stuckTask builds a task stucked after retries in the job
+func stuckTask(jobID string) *Task {
+	task := newRunnable("requeue")
+	task.JobID = jobID
+	task.Retries = 3
+	task.Transition(TaskRunning)
+	task.ensureStats().WorkerID = "w1"
+	task.Transition(TaskStucked)
+	return task
+}
+
+func TestRequeueStuck(t *testing.T) {
+	store := newMemStore()
+	a, b, other := stuckTask("j1"), stuckTask("j1"), stuckTask("j2")
+	pending := newRunnable("requeue")
+	pending.JobID = "j1"
+	saveTasks(t, store, a, b, other, pending)
+
+	n, err := RequeueStuck(store, Filter{JobID: "j1", States: []TaskState{TaskPending}})
+	if err != nil || n != 2 {
+		t.Fatalf("expect 2 requeued, got %d, %v", n, err)
+	}
+	for _, task := range []*Task{a, b} {
+		stored := loadTask(t, store, task.ID)
+		if stored.State != TaskPending || stored.Retries != 0 || stored.Stats.WorkerID != "" {
+			t.Errorf("task %s: expect pending with retries reset, got %s/%d/%q", task.ID, stored.State, stored.Retries, stored.Stats.WorkerID)
+		}
+	}
+	if stored := loadTask(t, store, other.ID); stored.State != TaskStucked {
+		t.Errorf("expect a task outside the filter skipped, got %s", stored.State)
+	}
+	if n, err = RequeueStuck(store, Filter{JobID: "j1"}); err != nil || n != 0 {
+		t.Errorf("expect nothing left to requeue, got %d, %v", n, err)
+	}
+
+	saved := RequeueResetsRetries
+	RequeueResetsRetries = false
+	t.Cleanup(func() { RequeueResetsRetries = saved })
+	if n, err = RequeueStuck(store, Filter{JobID: "j2"}); err != nil || n != 1 {
+		t.Fatalf("expect 1 requeued, got %d, %v", n, err)
+	}
+	if stored := loadTask(t, store, other.ID); stored.Retries != 3 {
+		t.Errorf("expect retries kept, got %d", stored.Retries)
+	}
+}
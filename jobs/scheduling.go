@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+)
+
+// SchedulingStrategy picks the next task to run from the pending tasks
+type SchedulingStrategy interface {
+	// Pick returns the index of the next task in pending which is
+	// in submission order and never empty
+	Pick(pending []*Task) int
+}
+
+// FIFOScheduling picks tasks in submission order
+type FIFOScheduling struct{}
+
+// Pick implements SchedulingStrategy
+func (FIFOScheduling) Pick(pending []*Task) int {
+	return 0
+}
+
+// FairScheduling round-robins across jobs so no single job monopolizes
+// workers, tasks of the same job are picked in submission order
+type FairScheduling struct {
+	lock       sync.Mutex
+	seq        uint64
+	lastPicked map[string]uint64
+}
+
+// Pick implements SchedulingStrategy
+func (s *FairScheduling) Pick(pending []*Task) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	picked, lastPicked := 0, make(map[string]uint64)
+	for i, task := range pending {
+		seq, seen := lastPicked[task.JobID]
+		if !seen {
+			seq = s.lastPicked[task.JobID]
+			lastPicked[task.JobID] = seq
+		}
+		if seq < lastPicked[pending[picked].JobID] {
+			picked = i
+		}
+	}
+	s.seq++
+	lastPicked[pending[picked].JobID] = s.seq
+	// forget the jobs without pending tasks
+	s.lastPicked = lastPicked
+	return picked
+}
+
+// PriorityScheduling picks the task with the highest effective priority,
+// tasks of the same effective priority are picked in submission order
+// The effective priority grows while a task is pending so low priority
+// tasks are not starved
+type PriorityScheduling struct {
+	// AgingRate is the increase of priority per second pending,
+	// 0 disables aging
+	AgingRate float64
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+// Pick implements SchedulingStrategy
+func (s *PriorityScheduling) Pick(pending []*Task) int {
+	now := s.now()
+	picked, highest := 0, s.EffectivePriority(pending[0], now)
+	for i := 1; i < len(pending); i++ {
+		if priority := s.EffectivePriority(pending[i], now); priority > highest {
+			picked, highest = i, priority
+		}
+	}
+	return picked
+}
+
+// EffectivePriority calculates the priority of the task aged by the
+// duration it has been pending, the task is not changed, and a task not
+// known when it became pending isn't aged
+func (s *PriorityScheduling) EffectivePriority(task *Task, now time.Time) float64 {
+	priority := float64(task.Priority)
+	if s.AgingRate <= 0 {
+		return priority
+	}
+	since := task.pendingSince()
+	if since.IsZero() {
+		return priority
+	}
+	if pending := now.Sub(since); pending > 0 {
+		priority += s.AgingRate * pending.Seconds()
+	}
+	return priority
+}
+
+func (s *PriorityScheduling) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fetchJobs submits tasks of the jobs in order into a MemQueue using the
+// scheduler and returns the jobs of the fetched tasks in order
+func fetchJobs(t *testing.T, scheduler SchedulingStrategy, jobs ...string) string {
+	t.Helper()
+	q := &MemQueue{Scheduler: scheduler}
+	for _, jobID := range jobs {
+		task := NewTask("scheduled").Build()
+		task.JobID = jobID
+		if err := q.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var fetched []string
+	for task := q.Fetch(); task != nil; task = q.Fetch() {
+		fetched = append(fetched, task.JobID)
+	}
+	return strings.Join(fetched, "")
+}
+
+func TestFairScheduling(t *testing.T) {
+	jobs := []string{"A", "A", "A", "B", "B", "C"}
+	if got := fetchJobs(t, nil, jobs...); got != "AAABBC" {
+		t.Errorf("expect FIFO by default, got %s", got)
+	}
+	if got := fetchJobs(t, FIFOScheduling{}, jobs...); got != "AAABBC" {
+		t.Errorf("expect FIFO, got %s", got)
+	}
+	if got := fetchJobs(t, &FairScheduling{}, jobs...); got != "ABCABA" {
+		t.Errorf("expect jobs interleaved, got %s", got)
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	clock := newFakeClock()
+	enqueued := func(name string, priority int) *Task {
+		task := NewTask(name).WithPriority(priority).Build()
+		task.EnqueuedAt = clock.Now()
+		return task
+	}
+	if got := (&PriorityScheduling{}).Pick([]*Task{enqueued("low", 1), enqueued("high", 10)}); got != 1 {
+		t.Errorf("expect the high priority picked, got %d", got)
+	}
+
+	s := &PriorityScheduling{AgingRate: 0.1, Now: clock.Now}
+	low := enqueued("low", 1)
+	var overtakenAfter time.Duration
+	for i := 1; i <= 120; i++ {
+		clock.Advance(time.Second)
+		// a fresh high priority task arrives every second
+		pending := []*Task{low, enqueued("high", 10)}
+		if pending[s.Pick(pending)] == low {
+			overtakenAfter = time.Duration(i) * time.Second
+			break
+		}
+	}
+	if overtakenAfter != 90*time.Second {
+		t.Errorf("expect the aged low priority task picked once caught up after 90s, got %s", overtakenAfter)
+	}
+	if low.Priority != 1 {
+		t.Errorf("expect the stored priority unchanged, got %d", low.Priority)
+	}
+	if priority := s.EffectivePriority(low, clock.Now()); priority != 10 {
+		t.Errorf("expect the effective priority aged to 10, got %f", priority)
+	}
+	if priority := s.EffectivePriority(&Task{Priority: 3}, clock.Now()); priority != 3 {
+		t.Errorf("expect a task without pending time not aged, got %f", priority)
+	}
+}
@@ -0,0 +1,190 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// GenerateParamsSchema generates a JSON schema from a sample of params
+// Non-pointer fields without omitempty are required, and a field
+// tagged with `enum:"a,b"` only accepts the listed values
+func GenerateParamsSchema(sample interface{}) ([]byte, error) {
+	schema := schemaOf(reflect.TypeOf(sample))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	return json.Marshal(schema)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		return structSchemaOf(t)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchemaOf(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for _, f := range paramFields(t) {
+		prop := schemaOf(f.Type)
+		if values := fieldEnum(f.StructField); values != nil {
+			prop["enum"] = values
+		}
+		props[f.name] = prop
+		if f.required {
+			required = append(required, f.name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// paramField is a struct field encoded in params
+type paramField struct {
+	reflect.StructField
+	name     string // name of the JSON key
+	required bool   // non-pointer without omitempty
+}
+
+// paramFields lists the fields of a struct as encoded by encoding/json
+func paramFields(t reflect.Type) []paramField {
+	var fields []paramField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, nf := range paramFields(ft) {
+					nf.Index = append([]int{i}, nf.Index...)
+					fields = append(fields, nf)
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, paramField{
+			StructField: f,
+			name:        name,
+			required:    f.Type.Kind() != reflect.Ptr && !strings.Contains(opts, "omitempty"),
+		})
+	}
+	return fields
+}
+
+func fieldEnum(f reflect.StructField) []string {
+	tag, ok := f.Tag.Lookup("enum")
+	if !ok {
+		return nil
+	}
+	return strings.Split(tag, ",")
+}
+
+// ParamsSchema generates the JSON schema of Params
+// It returns nil if Params is not specified
+func (e *TaskExec) ParamsSchema() ([]byte, error) {
+	if e.Params == nil {
+		return nil, nil
+	}
+	return GenerateParamsSchema(e.Params)
+}
+
+// BindParams decodes the params and validates them against the rules
+// of GenerateParamsSchema, violations are reported as ValidationError
+func (t *Task) BindParams(p interface{}) error {
+	if err := t.GetParams(p); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(p)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	var present map[string]json.RawMessage
+	if err := t.GetParams(&present); err != nil {
+		return err
+	}
+	fields := make(map[string]string)
+	for _, f := range paramFields(v.Type()) {
+		if _, ok := present[f.name]; !ok {
+			if f.required {
+				fields[f.name] = "required"
+			}
+			continue
+		}
+		values := fieldEnum(f.StructField)
+		if values == nil {
+			continue
+		}
+		fv, err := v.FieldByIndexErr(f.Index)
+		if err != nil {
+			continue
+		}
+		if !containsString(values, fmt.Sprint(fv.Interface())) {
+			fields[f.name] = fmt.Sprintf("must be one of %s", strings.Join(values, ", "))
+		}
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
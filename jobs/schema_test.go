@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type schemaParams struct {
+	Name    string            `json:"name"`
+	Count   int               `json:"count"`
+	Mode    string            `json:"mode" enum:"fast,slow"`
+	Note    *string           `json:"note"`
+	Tags    []string          `json:"tags,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Ignored string            `json:"-"`
+	hidden  string
+}
+
+func TestGenerateParamsSchema(t *testing.T) {
+	encoded, err := GenerateParamsSchema(schemaParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Type       string                     `json:"type"`
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err = json.Unmarshal(encoded, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.Type != "object" {
+		t.Errorf("expect an object, got %s", schema.Type)
+	}
+	if want := []string{"name", "count", "mode"}; !reflect.DeepEqual(schema.Required, want) {
+		t.Errorf("expect required %v, got %v", want, schema.Required)
+	}
+	props := map[string]string{
+		"name":   `{"type":"string"}`,
+		"count":  `{"type":"integer"}`,
+		"mode":   `{"enum":["fast","slow"],"type":"string"}`,
+		"note":   `{"type":"string"}`,
+		"tags":   `{"items":{"type":"string"},"type":"array"}`,
+		"labels": `{"additionalProperties":{"type":"string"},"type":"object"}`,
+	}
+	if len(schema.Properties) != len(props) {
+		t.Errorf("expect %d properties, got %d", len(props), len(schema.Properties))
+	}
+	for name, want := range props {
+		if got := string(schema.Properties[name]); got != want {
+			t.Errorf("property %s: expect %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestParamsSchemaByName(t *testing.T) {
+	d := &Dispatcher{}
+	d.AddTaskExecs(
+		&TaskExec{Name: "with-params", Stages: []Stage{{Name: "run"}}, Params: &schemaParams{}},
+		&TaskExec{Name: "without-params", Stages: []Stage{{Name: "run"}}},
+	)
+	if schema, err := d.ParamsSchema("with-params"); err != nil || len(schema) == 0 {
+		t.Errorf("expect a schema, got %s, %v", schema, err)
+	}
+	for _, name := range []string{"without-params", "unknown"} {
+		if schema, err := d.ParamsSchema(name); err != nil || schema != nil {
+			t.Errorf("%s: expect no schema, got %s, %v", name, schema, err)
+		}
+	}
+}
+
+func TestBindParamsViolations(t *testing.T) {
+	task := NewTask("bind").With(map[string]interface{}{"mode": "medium", "note": "n"}).Build()
+	var p schemaParams
+	err := task.BindParams(&p)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expect ValidationError, got %v", err)
+	}
+	want := map[string]string{
+		"name":  "required",
+		"count": "required",
+		"mode":  "must be one of fast, slow",
+	}
+	if !reflect.DeepEqual(invalid.Fields, want) {
+		t.Errorf("expect %v, got %v", want, invalid.Fields)
+	}
+	encoded, err := json.Marshal(invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"error":"invalid params","fields":{"count":"required","mode":"must be one of fast, slow","name":"required"}}`; string(encoded) != want {
+		t.Errorf("expect %s, got %s", want, encoded)
+	}
+
+	task = NewTask("bind").With(map[string]interface{}{"name": "x", "count": 1, "mode": "fast"}).Build()
+	if err = task.BindParams(&p); err != nil || p.Name != "x" || p.Mode != "fast" {
+		t.Errorf("expect valid params bound, got %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,32 @@
+package jobs
+
+import "encoding/json"
+
+// Signal unblocks a blocked task in the store making it pending, and
+// saves the payload as the data of the task, encoded as JSON so it's
+// retrieved by GetData into a []byte
+func Signal(store Store, taskID string, payload []byte) error {
+	task, err := LoadTask(store, taskID)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return ErrTaskNotFound
+	}
+	if err = signalTask(task, payload); err != nil {
+		return err
+	}
+	return SaveTask(store, task)
+}
+
+func signalTask(task *Task, payload []byte) error {
+	if task.State != TaskBlocked {
+		return ErrTaskNotBlocked
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	task.Data = encoded
+	return task.Transition(TaskPending)
+}
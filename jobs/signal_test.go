@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignal(t *testing.T) {
+	store := newMemStore()
+	task, err := (&TaskBuilder{Submitter: storeSubmitter{store}, Name: "signaled"}).WaitForSignal().Submit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := loadTask(t, store, task.ID); stored.State != TaskBlocked {
+		t.Fatalf("expect submitted blocked, got %s", stored.State)
+	}
+	if err = Signal(store, task.ID, []byte(`{"file":"a.csv"}`)); err != nil {
+		t.Fatal(err)
+	}
+	stored := loadTask(t, store, task.ID)
+	var payload []byte
+	if err = stored.GetData(&payload); err != nil || string(payload) != `{"file":"a.csv"}` {
+		t.Errorf("expect the payload in data, got %s, %v", payload, err)
+	}
+	if stored.State != TaskPending || stored.EnqueuedAt.IsZero() {
+		t.Errorf("expect pending once signaled, got %s", stored.State)
+	}
+	if err = Signal(store, task.ID, nil); !errors.Is(err, ErrTaskNotBlocked) {
+		t.Errorf("expect ErrTaskNotBlocked, got %v", err)
+	}
+	if err = Signal(store, "unknown", nil); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("expect ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestMemQueueSignal(t *testing.T) {
+	q := &MemQueue{}
+	task := NewTask("signaled").WaitForSignal().Build()
+	if err := q.SubmitTask(task); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.Peek(time.Now()); ok {
+		t.Fatal("expect a blocked task not runnable")
+	}
+	if err := q.Signal(task.ID, []byte("go")); err != nil {
+		t.Fatal(err)
+	}
+	if peeked, ok := q.Peek(time.Now()); !ok || peeked != task {
+		t.Fatal("expect the task runnable once signaled")
+	}
+	if err := q.Signal("unknown", nil); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("expect ErrTaskNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sweeper fixes up tasks which can't make progress by themselves
+type Sweeper struct {
+	Store Store
+	// WaitTimeout is the max duration a task waits for sub tasks before
+	// it's stucked, 0 means no limit
+	WaitTimeout time.Duration
+	// HeartbeatTimeout is the max duration since the last heartbeat of a
+	// running task before it's reclaimed, 0 means no limit
+	HeartbeatTimeout time.Duration
+	// Redrive requeues stucked tasks automatically
+	Redrive RedrivePolicy
+	// Now returns the current time, time.Now is used if nil
+	Now func() time.Time
+}
+
+// Sweep scans the tasks once and saves the ones changed, each task is
+// swept according to its NextAction
+func (s *Sweeper) Sweep() error {
+	tasks, err := ListTasks(s.Store, Filter{})
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	for _, task := range tasks {
+		var changed bool
+		switch task.NextAction(now, nil).Type {
+		case ActionWait:
+			changed = s.sweepWaiting(task, now) || s.sweepHeartbeat(task, now)
+		case ActionAbort:
+			changed = s.sweepExpired(task, now)
+		case ActionDead:
+			changed = s.sweepStucked(task, now)
+		}
+		if changed {
+			// a task changed by others meanwhile is swept next time
+			if err = SaveTask(s.Store, task); err != nil && !errors.Is(err, ErrStaleTask) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Sweeper) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// sweepWaiting stucks the task which waits longer than WaitTimeout
+func (s *Sweeper) sweepWaiting(task *Task, now time.Time) bool {
+	if s.WaitTimeout <= 0 || task.State != TaskWaiting || task.Stats == nil ||
+		task.Stats.WaitingSince.IsZero() || now.Sub(task.Stats.WaitingSince) <= s.WaitTimeout {
+		return false
+	}
+	msg := fmt.Sprintf("waiting for sub tasks longer than %s", s.WaitTimeout)
+	return task.AppendError(task.NewError(TaskErrStuck).SetMessage(msg)) == nil &&
+		task.TransitionAt(TaskStucked, now) == nil
+}
+
+// sweepHeartbeat makes the running task pending again if its worker
+// hasn't reported heartbeat longer than HeartbeatTimeout, the heartbeat
+// of a task run by a local worker is read through its guard
+func (s *Sweeper) sweepHeartbeat(task *Task, now time.Time) bool {
+	if s.HeartbeatTimeout <= 0 || task.State != TaskRunning || task.Stats == nil {
+		return false
+	}
+	last := task.Stats.LastHeartbeat
+	if g := runningGuard(task.ID); g != nil {
+		// the task is run by a local worker, whose heartbeats may not
+		// be persisted yet
+		g.Read(func(t *Task) {
+			if t.Stats != nil && t.Stats.LastHeartbeat.After(last) {
+				last = t.Stats.LastHeartbeat
+			}
+		})
+	}
+	if last.IsZero() {
+		last = task.Stats.ClaimedAt
+	}
+	if last.IsZero() || now.Sub(last) <= s.HeartbeatTimeout {
+		return false
+	}
+	worker := task.Stats.WorkerID
+	task.Stats.WorkerID = ""
+	task.Annotate("sweeper", fmt.Sprintf("reclaimed from worker %q without heartbeat since %s",
+		worker, last.Format(time.RFC3339)))
+	return task.TransitionAt(TaskPending, now) == nil
+}
+
+// sweepExpired aborts the task not running which is past NotAfter
+func (s *Sweeper) sweepExpired(task *Task, now time.Time) bool {
+	task.Result = TaskAborted
+	task.CancelReason = "expired"
+	task.Annotate("sweeper", "expired after "+task.NotAfter.Format(time.RFC3339))
+	return task.TransitionAt(TaskCompleted, now) == nil
+}
+
+// sweepStucked requeues the stucked task according to Redrive, the
+// time the task is first found stucked is recorded by the clock of the
+// Sweeper to count the delay
+func (s *Sweeper) sweepStucked(task *Task, now time.Time) bool {
+	if !s.Redrive.applies(task) {
+		return false
+	}
+	stats := task.ensureStats()
+	if stats.DeadSince.IsZero() {
+		stats.DeadSince = now
+		return true
+	}
+	if !s.Redrive.due(task, now) {
+		return false
+	}
+	task.Redrives++
+	if s.Redrive.ResetRetries {
+		task.Retries = 0
+	}
+	stats.WorkerID = ""
+	task.Annotate("sweeper", fmt.Sprintf("redrive %d/%d", task.Redrives, s.Redrive.MaxRedrives))
+	return task.TransitionAt(TaskPending, now) == nil
+}
@@ -0,0 +1,186 @@
+package jobs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// sweepOnce saves the task, sweeps the store and reloads the task
+func sweepOnce(t *testing.T, s *Sweeper, task *Task) *Task {
+	t.Helper()
+	if err := SaveTask(s.Store, task); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	swept, err := LoadTask(s.Store, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return swept
+}
+
+func TestSweepWaitTimeout(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), WaitTimeout: time.Hour, Now: clock.Now}
+	task := newRunnable("parent")
+	task.TransitionAt(TaskWaiting, clock.Now())
+
+	clock.Advance(time.Hour)
+	task = sweepOnce(t, s, task)
+	if task.State != TaskWaiting {
+		t.Fatalf("expect waiting within the timeout, got %s", task.State)
+	}
+
+	clock.Advance(time.Second)
+	task = sweepOnce(t, s, task)
+	if task.State != TaskStucked {
+		t.Fatalf("expect stucked after the timeout, got %s", task.State)
+	}
+	last := task.Errors[len(task.Errors)-1]
+	if last.Type != TaskErrStuck || !strings.Contains(last.Message, "longer than 1h0m0s") {
+		t.Errorf("expect an explanatory error, got %v", last)
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), Now: clock.Now}
+	pending := newRunnable("expired")
+	pending.NotAfter = clock.Now().Add(time.Minute)
+	running := newRunnable("expired-running")
+	running.NotAfter = pending.NotAfter
+	running.Transition(TaskRunning)
+
+	if pending = sweepOnce(t, s, pending); pending.State != TaskPending {
+		t.Fatalf("expect pending before NotAfter, got %s", pending.State)
+	}
+	clock.Advance(2 * time.Minute)
+	if pending = sweepOnce(t, s, pending); pending.State != TaskCompleted || pending.Result != TaskAborted ||
+		pending.CancelReason != "expired" {
+		t.Errorf("expect aborted as expired, got %s/%s", pending.State, pending.Result)
+	}
+	if running = sweepOnce(t, s, running); running.State != TaskRunning {
+		t.Errorf("expect a running task left to its worker, got %s", running.State)
+	}
+}
+
+func TestSweepStaleHeartbeat(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), HeartbeatTimeout: time.Minute, Now: clock.Now}
+	task := newRunnable("heartbeat")
+	task.Transition(TaskRunning)
+	task.claimed(clock.Now())
+	task.Stats.WorkerID = "w1"
+
+	clock.Advance(time.Minute)
+	if task = sweepOnce(t, s, task); task.State != TaskRunning {
+		t.Fatalf("expect running with a fresh heartbeat, got %s", task.State)
+	}
+	clock.Advance(time.Second)
+	if task = sweepOnce(t, s, task); task.State != TaskPending || task.Stats.WorkerID != "" {
+		t.Fatalf("expect reclaimed, got %s on %q", task.State, task.Stats.WorkerID)
+	}
+	if n := len(task.Annotations); n == 0 || !strings.Contains(task.Annotations[n-1].Text, `worker "w1"`) {
+		t.Errorf("expect the reclaim noted, got %+v", task.Annotations)
+	}
+}
+
+func TestSweepLocalHeartbeat(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), HeartbeatTimeout: time.Minute, Now: clock.Now}
+	task := newRunnable("heartbeat-local")
+	task.Transition(TaskRunning)
+	task.claimed(clock.Now())
+	saveTasks(t, s.Store, task)
+
+	// the worker in this process has a newer heartbeat not persisted yet
+	running := task.Clone()
+	g := Guard(running)
+	registerRunning(running.ID, g)
+	defer unregisterRunning(running.ID, g)
+	clock.Advance(2 * time.Minute)
+	running.Stats.LastHeartbeat = clock.Now()
+	if task = sweepOnce(t, s, task); task.State != TaskRunning {
+		t.Errorf("expect the local heartbeat respected, got %s", task.State)
+	}
+}
+
+func TestSweepRedrive(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), Redrive: RedrivePolicy{After: time.Minute, MaxRedrives: 2}, Now: clock.Now}
+	task := newRunnable("redrive")
+	stuck := func() {
+		task.Transition(TaskRunning)
+		task.Retries = 3
+		task.Transition(TaskStucked)
+	}
+
+	stuck()
+	// the delay counts from when the task is first swept
+	if task = sweepOnce(t, s, task); task.State != TaskStucked || !task.Stats.DeadSince.Equal(clock.Now()) {
+		t.Fatalf("expect the dead time recorded by the sweeper clock, got %s/%s", task.State, task.Stats.DeadSince)
+	}
+	clock.Advance(time.Minute - time.Second)
+	if task = sweepOnce(t, s, task); task.State != TaskStucked {
+		t.Fatalf("expect stucked before the delay, got %s", task.State)
+	}
+	clock.Advance(time.Second)
+	if task = sweepOnce(t, s, task); task.State != TaskPending || task.Redrives != 1 {
+		t.Fatalf("expect the first redrive, got %s/%d", task.State, task.Redrives)
+	}
+	if !task.Stats.DeadSince.IsZero() || task.Retries != 3 {
+		t.Errorf("expect the dead time cleared and retries kept, got %s/%d", task.Stats.DeadSince, task.Retries)
+	}
+
+	// the delay doubles on the next redrive
+	stuck()
+	clock.Advance(time.Hour)
+	task = sweepOnce(t, s, task)
+	clock.Advance(time.Minute)
+	if task = sweepOnce(t, s, task); task.State != TaskStucked {
+		t.Fatalf("expect stucked within the doubled delay, got %s", task.State)
+	}
+	clock.Advance(time.Minute)
+	if task = sweepOnce(t, s, task); task.State != TaskPending || task.Redrives != 2 {
+		t.Fatalf("expect the second redrive, got %s/%d", task.State, task.Redrives)
+	}
+
+	// permanently dead after the cap
+	stuck()
+	for i := 0; i < 3; i++ {
+		clock.Advance(24 * time.Hour)
+		task = sweepOnce(t, s, task)
+	}
+	if task.State != TaskStucked || task.Redrives != 2 || !task.Stats.DeadSince.IsZero() {
+		t.Errorf("expect dead after the cap, got %s/%d", task.State, task.Redrives)
+	}
+}
+
+func TestSweepRedriveResetRetries(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), Redrive: RedrivePolicy{MaxRedrives: 1, ResetRetries: true}, Now: clock.Now}
+	task := newRunnable("redrive-reset")
+	task.Transition(TaskRunning)
+	task.Retries = 3
+	task.Transition(TaskStucked)
+	task = sweepOnce(t, s, task)
+	if task = sweepOnce(t, s, task); task.State != TaskPending || task.Retries != 0 {
+		t.Errorf("expect redriven with retries reset, got %s/%d", task.State, task.Retries)
+	}
+}
+
+func TestSweepRedriveDisabled(t *testing.T) {
+	clock := newFakeClock()
+	s := &Sweeper{Store: newMemStore(), Now: clock.Now}
+	task := newRunnable("no-redrive")
+	task.Transition(TaskRunning)
+	task.Transition(TaskStucked)
+	task = sweepOnce(t, s, task)
+	clock.Advance(24 * time.Hour)
+	if task = sweepOnce(t, s, task); task.State != TaskStucked || task.Redrives != 0 {
+		t.Errorf("expect no redrive without a policy, got %s/%d", task.State, task.Redrives)
+	}
+}
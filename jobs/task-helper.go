@@ -12,6 +12,19 @@ func Revertable(fwd, rev TaskFn) TaskFn {
 	}
 }
 
+// RevertableWithCause builds a TaskFn like Revertable, rev receives the
+// error triggered the rollback, see Context.RevertCause
+func RevertableWithCause(fwd TaskFn, rev func(Context, *TaskError) error) TaskFn {
+	return func(ctx Context) error {
+		if !ctx.IsRollback() {
+			return fwd(ctx)
+		} else if rev != nil {
+			return rev(ctx, ctx.RevertCause())
+		}
+		return nil
+	}
+}
+
 // NonRevertable builds a TaskFn fails on rollback
 func NonRevertable(fn TaskFn) TaskFn {
 	return func(ctx Context) error {
@@ -21,3 +34,36 @@ func NonRevertable(fn TaskFn) TaskFn {
 		return fn(ctx)
 	}
 }
+
+// Typed builds a TaskFn which decodes params into a new instance of P
+// before invoking the handler, decoding error fails the task
+func Typed[P any](handler func(Context, *P) error) TaskFn {
+	return func(ctx Context) error {
+		params := new(P)
+		if err := ctx.GetParams(params); err != nil {
+			return ctx.Fail(err)
+		}
+		return handler(ctx, params)
+	}
+}
+
+// Validated builds a TaskFn like Typed, and the params are also validated
+// by BindParams, a ValidationError fails the task
+func Validated[P any](handler func(Context, *P) error) TaskFn {
+	return func(ctx Context) error {
+		params := new(P)
+		if err := ctx.BindParams(params); err != nil {
+			return ctx.Fail(err)
+		}
+		return handler(ctx, params)
+	}
+}
+
+// Register builds a single stage TaskExec with a typed handler
+func Register[P any](name string, handler func(Context, *P) error) *TaskExec {
+	return &TaskExec{
+		Name:   name,
+		Stages: []Stage{{Fn: Typed(handler)}},
+		Params: new(P),
+	}
+}
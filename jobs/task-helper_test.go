@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+)
+
+type typedParams struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestRegisterTyped(t *testing.T) {
+	var got *typedParams
+	d := &Dispatcher{}
+	d.AddTaskExecs(Register("typed", func(ctx Context, p *typedParams) error {
+		got = p
+		return nil
+	}))
+	task := newRunnable("typed")
+	task.setParams(map[string]interface{}{"name": "x", "count": 2})
+	if h := runOnce(d, task); h.err != nil {
+		t.Fatalf("expect success, got %v", h.err)
+	}
+	if got == nil || got.Name != "x" || got.Count != 2 {
+		t.Errorf("expect params decoded, got %+v", got)
+	}
+
+	got = nil
+	task = newRunnable("typed")
+	task.setParams(map[string]interface{}{"count": "two"})
+	if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrFail {
+		t.Errorf("expect a decoding error to fail the task, got %v", h.err)
+	}
+	if got != nil {
+		t.Error("expect the handler not invoked")
+	}
+}
+
+func TestValidated(t *testing.T) {
+	var typed, validated int
+	d := &Dispatcher{}
+	d.AddTaskExecs(
+		singleStage("typed-loose", Typed(func(ctx Context, p *schemaParams) error {
+			typed++
+			return nil
+		})),
+		singleStage("validated", Validated(func(ctx Context, p *schemaParams) error {
+			validated++
+			return nil
+		})),
+	)
+	for _, name := range []string{"typed-loose", "validated"} {
+		task := newRunnable(name)
+		task.setParams(map[string]string{"name": "x"})
+		h := runOnce(d, task)
+		if name == "typed-loose" && h.err != nil {
+			t.Errorf("expect Typed not to validate, got %v", h.err)
+		}
+		if name == "validated" && (h.err == nil || h.err.Type != TaskErrFail || !errors.Is(h.err, ErrInvalidParams)) {
+			t.Errorf("expect Validated to fail invalid params, got %v", h.err)
+		}
+	}
+	if typed != 1 || validated != 0 {
+		t.Errorf("expect only the typed handler invoked, got %d/%d", typed, validated)
+	}
+}
+
+func TestRevertableWithCause(t *testing.T) {
+	errQuota, errTimeout := errors.New("quota exceeded"), errors.New("timeout")
+	var fail error
+	var branch string
+	d := &Dispatcher{}
+	d.AddTaskExecs(singleStage("provision", RevertableWithCause(
+		func(ctx Context) error {
+			if ctx.RevertCause() != nil {
+				t.Error("expect no revert cause in forward direction")
+			}
+			return ctx.FailRollback(fail)
+		},
+		func(ctx Context, cause *TaskError) error {
+			switch {
+			case cause == nil:
+				branch = "none"
+			case errors.Is(cause, errQuota):
+				// the resource was never created
+				branch = "skip"
+			case errors.Is(cause, errTimeout):
+				branch = "delete"
+			default:
+				branch = "unknown"
+			}
+			return nil
+		},
+	)))
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{errQuota, "skip"},
+		{errTimeout, "delete"},
+		{errors.New("other"), "unknown"},
+	} {
+		fail, branch = c.err, ""
+		task := newRunnable("provision")
+		if h := runOnce(d, task); h.err == nil || h.err.Type != TaskErrRevert || !task.Revert {
+			t.Fatalf("%v: expect rollback, got %v", c.err, h.err)
+		}
+		if h := runOnce(d, task); h.err != nil {
+			t.Fatalf("%v: expect compensated, got %v", c.err, h.err)
+		}
+		if branch != c.want {
+			t.Errorf("%v: expect compensation %s, got %s", c.err, c.want, branch)
+		}
+	}
+
+	// the cause stays when the compensation retries
+	errFlaky := errors.New("flaky")
+	var causes []error
+	d = &Dispatcher{}
+	d.AddTaskExecs(singleStage("provision-retried", RevertableWithCause(
+		func(ctx Context) error { return ctx.FailRollback(errQuota) },
+		func(ctx Context, cause *TaskError) error {
+			causes = append(causes, cause)
+			if len(causes) == 1 {
+				return ctx.FailRetry(errFlaky)
+			}
+			return nil
+		},
+	)))
+	task := newRunnable("provision-retried")
+	for i := 0; i < 3; i++ {
+		runOnce(d, task)
+	}
+	if len(causes) != 2 || !errors.Is(causes[0], errQuota) || !errors.Is(causes[1], errQuota) {
+		t.Errorf("expect the rollback error as the cause of each attempt, got %v", causes)
+	}
+
+	var canceled bool
+	store := newMemStore()
+	d = &Dispatcher{Store: store}
+	d.AddTaskExecs(&TaskExec{Name: "provision-canceled", Stages: []Stage{
+		{Name: "create", Fn: RevertableWithCause(nil, func(ctx Context, cause *TaskError) error {
+			canceled = errors.Is(cause, ErrTaskCanceled)
+			return nil
+		})},
+		{Name: "use", Fn: func(ctx Context) error { return nil }},
+	}})
+	task = newRunnable("provision-canceled")
+	task.Stage = "use"
+	saveTasks(t, store, task)
+	if err := CancelAndRevert(store, task.ID, "user"); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(d, loadTask(t, store, task.ID))
+	if !canceled {
+		t.Error("expect the cancellation as the revert cause")
+	}
+}
@@ -0,0 +1,347 @@
+package jobs
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TasksBucket is the name of the bucket storing tasks
+const TasksBucket = "tasks"
+
+// TaskWatcher is optionally implemented by a Store which notifies
+// task changes
+type TaskWatcher interface {
+	// WatchTask streams updates of a task until ctx is done
+	WatchTask(ctx context.Context, id string) (<-chan *Task, error)
+}
+
+// BatchUpdater is optionally implemented by a Store which updates
+// tasks in batch efficiently, with the same semantics as UpdateBatch
+type BatchUpdater interface {
+	UpdateBatch(tasks []*Task) error
+}
+
+// TaskPager is optionally implemented by a Store which lists tasks by
+// pages efficiently, with the same semantics as ListTasksPage
+type TaskPager interface {
+	ListTasksPage(filter Filter, page Page) ([]*Task, Cursor, error)
+}
+
+// LoadTask loads a task from the store, returns nil if not found
+func LoadTask(store Store, id string) (*Task, error) {
+	val, err := store.Bucket(TasksBucket).Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil || !val.Valid() {
+		return nil, nil
+	}
+	var task Task
+	if err = val.Unmarshal(&task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// SaveTask saves a task into the store if its Version matches the
+// stored one, and increments the Version, otherwise it fails with
+// ErrStaleTask as the task was changed by another writer since loaded,
+// a task not in the store is saved regardless of its Version
+func SaveTask(store Store, task *Task) error {
+	lock := store.Acquire(taskLockName(task.ID))
+	if lock != nil {
+		if !lock.Acquired() {
+			return ErrLockBusy
+		}
+		defer lock.Release()
+	}
+	stored, err := LoadTask(store, task.ID)
+	if err != nil {
+		return err
+	}
+	if stored != nil && stored.Version != task.Version {
+		return ErrStaleTask
+	}
+	return putTask(store, task)
+}
+
+// putTask saves the task with the Version incremented, the Version is
+// restored on failure
+func putTask(store Store, task *Task) error {
+	task.Version++
+	if err := store.Bucket(TasksBucket).Put(task.ID, task); err != nil {
+		task.Version--
+		return err
+	}
+	return nil
+}
+
+func taskLockName(id string) string {
+	return TasksBucket + "/" + id
+}
+
+// UpdateBatch saves the tasks whose Version matches the stored ones and
+// increments their Version, stale or missing tasks are skipped and
+// reported by BatchError while the others still apply
+// Without BatchUpdater, the locks of all tasks are held for the batch
+func UpdateBatch(store Store, tasks []*Task) error {
+	if updater, ok := store.(BatchUpdater); ok {
+		return updater.UpdateBatch(tasks)
+	}
+	failed := make(map[string]error)
+	defer lockTasks(store, tasks, failed)()
+	for _, task := range tasks {
+		if failed[task.ID] != nil {
+			continue
+		}
+		stored, err := LoadTask(store, task.ID)
+		switch {
+		case err != nil:
+		case stored == nil:
+			err = ErrTaskNotFound
+		case stored.Version != task.Version:
+			err = ErrStaleTask
+		default:
+			err = putTask(store, task)
+		}
+		if err != nil {
+			failed[task.ID] = err
+		}
+	}
+	return batchError(failed)
+}
+
+// lockTasks acquires the locks of the tasks in the order of IDs to avoid
+// deadlocks, tasks whose locks are busy are reported in failed with
+// ErrLockBusy, the returned func releases the acquired locks
+func lockTasks(store Store, tasks []*Task, failed map[string]error) func() {
+	ids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	sort.Strings(ids)
+	var held []Acquisition
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		lock := store.Acquire(taskLockName(id))
+		if lock == nil {
+			continue
+		}
+		if !lock.Acquired() {
+			failed[id] = ErrLockBusy
+			continue
+		}
+		held = append(held, lock)
+	}
+	return func() {
+		for _, lock := range held {
+			lock.Release()
+		}
+	}
+}
+
+// batchError reports the failed tasks, nil if none
+func batchError(failed map[string]error) error {
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
+	return nil
+}
+
+// ListPageSize is the page size used when enumerating tasks
+var ListPageSize = 100
+
+// Filter selects tasks, empty fields match all
+type Filter struct {
+	JobID    string      // job id
+	ParentID string      // parent task id
+	Name     string      // task name
+	GroupID  string      // group id
+	States   []TaskState // any of the states
+}
+
+// Match determines if the task is selected by the filter
+func (f Filter) Match(t *Task) bool {
+	if f.JobID != "" && t.JobID != f.JobID ||
+		f.ParentID != "" && t.ParentID != f.ParentID ||
+		f.Name != "" && t.Name != f.Name ||
+		f.GroupID != "" && t.GroupID != f.GroupID {
+		return false
+	}
+	if len(f.States) == 0 {
+		return true
+	}
+	for _, state := range f.States {
+		if t.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// ListTasks lists all tasks in the store selected by the filter
+func ListTasks(store Store, filter Filter) ([]*Task, error) {
+	enum := store.Bucket(TasksBucket).Enumerate(EnumOptions{PageSize: ListPageSize})
+	var tasks []*Task
+	for {
+		vals, err := enum.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 {
+			return tasks, nil
+		}
+		for _, val := range vals {
+			if !val.Valid() {
+				continue
+			}
+			task := &Task{}
+			if err = val.Unmarshal(task); err != nil {
+				return nil, err
+			}
+			if filter.Match(task) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+}
+
+// Cursor is an opaque position in tasks ordered by CreatedAt and ID
+type Cursor string
+
+// Page selects a page of tasks
+type Page struct {
+	Limit  int    // max number of tasks, ListPageSize if not positive
+	Cursor Cursor // position after which the page starts, empty for the first page
+}
+
+// ListTasksPage lists a page of tasks selected by the filter, ordered by
+// CreatedAt and ID, next is empty when there are no more tasks
+func ListTasksPage(store Store, filter Filter, page Page) (tasks []*Task, next Cursor, err error) {
+	if pager, ok := store.(TaskPager); ok {
+		return pager.ListTasksPage(filter, page)
+	}
+	after, afterID, err := page.Cursor.decode()
+	if err != nil {
+		return nil, "", err
+	}
+	all, err := ListTasks(store, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return taskBefore(all[i], all[j].CreatedAt, all[j].ID)
+	})
+	start := 0
+	if page.Cursor != "" {
+		start = sort.Search(len(all), func(i int) bool {
+			return !taskBefore(all[i], after, afterID) && all[i].ID != afterID
+		})
+	}
+	limit := page.Limit
+	if limit <= 0 {
+		limit = ListPageSize
+	}
+	tasks = all[start:]
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+		next = cursorOf(tasks[limit-1])
+	}
+	return tasks, next, nil
+}
+
+// taskBefore determines if the task is ordered before the position
+func taskBefore(task *Task, createdAt time.Time, id string) bool {
+	if !task.CreatedAt.Equal(createdAt) {
+		return task.CreatedAt.Before(createdAt)
+	}
+	return task.ID < id
+}
+
+func cursorOf(task *Task) Cursor {
+	pos := task.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + task.ID
+	return Cursor(base64.RawURLEncoding.EncodeToString([]byte(pos)))
+}
+
+func (c Cursor) decode() (time.Time, string, error) {
+	if c == "" {
+		return time.Time{}, "", nil
+	}
+	pos, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid cursor: %w", err)
+	}
+	parts := strings.SplitN(string(pos), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", fmt.Errorf("invalid cursor %q", c)
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid cursor: %w", err)
+	}
+	return createdAt, parts[1], nil
+}
+
+// FindCachedResult finds another task with the same Fingerprint which
+// has completed successfully and kept its output, see RetainOutput
+func FindCachedResult(store Store, t *Task) (*Task, bool, error) {
+	candidates, err := ListTasks(store, Filter{Name: t.Name, States: []TaskState{TaskCompleted}})
+	if err != nil {
+		return nil, false, err
+	}
+	fingerprint := t.Fingerprint()
+	for _, c := range candidates {
+		// a task whose output was dropped by RetainOutput has nothing to reuse
+		if c.ID != t.ID && c.Result == TaskSuccess && !c.OutputCleared && c.Fingerprint() == fingerprint {
+			return c, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// OldestPending finds the pending task which has been runnable for the
+// longest time, returns nil if no task is pending
+func OldestPending(store Store) (*Task, error) {
+	tasks, err := ListTasks(store, Filter{States: []TaskState{TaskPending}})
+	if err != nil {
+		return nil, err
+	}
+	var oldest *Task
+	for _, task := range tasks {
+		if oldest == nil || task.pendingSince().Before(oldest.pendingSince()) {
+			oldest = task
+		}
+	}
+	return oldest, nil
+}
+
+// PendingAge returns how long the oldest pending task has been runnable,
+// returns 0 if no task is pending
+func PendingAge(store Store) (time.Duration, error) {
+	oldest, err := OldestPending(store)
+	if err != nil || oldest == nil {
+		return 0, err
+	}
+	if age := time.Since(oldest.pendingSince()); age > 0 {
+		return age, nil
+	}
+	return 0, nil
+}
+
+// pendingSince is the time since when the task is runnable, zero if
+// unknown
+func (t *Task) pendingSince() time.Time {
+	if !t.EnqueuedAt.IsZero() {
+		return t.EnqueuedAt
+	}
+	if t.Stats != nil && !t.Stats.ScheduledAt.IsZero() {
+		return t.Stats.ScheduledAt
+	}
+	return t.CreatedAt
+}
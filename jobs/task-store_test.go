@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPendingAge(t *testing.T) {
+	store := newMemStore()
+	if oldest, err := OldestPending(store); err != nil || oldest != nil {
+		t.Fatalf("expect none pending, got %v, %v", oldest, err)
+	}
+	if age, err := PendingAge(store); err != nil || age != 0 {
+		t.Fatalf("expect zero age, got %s, %v", age, err)
+	}
+
+	now := time.Now()
+	var tasks []*Task
+	for _, age := range []time.Duration{time.Minute, time.Hour, 10 * time.Minute} {
+		task := newRunnable("pending")
+		task.EnqueuedAt = now.Add(-age)
+		tasks = append(tasks, task)
+	}
+	running := newRunnable("running")
+	running.EnqueuedAt = now.Add(-24 * time.Hour)
+	running.Transition(TaskRunning)
+	future := newRunnable("future")
+	future.EnqueuedAt = now.Add(time.Hour)
+	saveTasks(t, store, append(tasks, running, future)...)
+
+	oldest, err := OldestPending(store)
+	if err != nil || oldest == nil || oldest.ID != tasks[1].ID {
+		t.Fatalf("expect the task pending for an hour, got %v, %v", oldest, err)
+	}
+	age, err := PendingAge(store)
+	if err != nil || age < time.Hour || age > time.Hour+time.Minute {
+		t.Errorf("expect about an hour, got %s, %v", age, err)
+	}
+}
+
+// plainStore hides the optional interfaces of a Store
+type plainStore struct {
+	Store
+}
+
+func TestUpdateBatch(t *testing.T) {
+	t.Run("batch updater", func(t *testing.T) { testUpdateBatch(t, newMemStore()) })
+	t.Run("fallback", func(t *testing.T) { testUpdateBatch(t, plainStore{newMemStore()}) })
+}
+
+func testUpdateBatch(t *testing.T, store Store) {
+	a, b, stale := newRunnable("batch"), newRunnable("batch"), newRunnable("batch")
+	saveTasks(t, store, a, b, stale)
+	// stale is changed by another writer since loaded
+	saveTasks(t, store, loadTask(t, store, stale.ID))
+	missing := newRunnable("batch")
+
+	for _, task := range []*Task{a, b, stale, missing} {
+		task.Transition(TaskCompleted)
+	}
+	err := UpdateBatch(store, []*Task{a, stale, b, missing})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 2 {
+		t.Fatalf("expect 2 failures reported, got %v", err)
+	}
+	if !errors.Is(batchErr.Failed[stale.ID], ErrStaleTask) || !errors.Is(batchErr.Failed[missing.ID], ErrTaskNotFound) {
+		t.Errorf("unexpected failures %v", batchErr.Failed)
+	}
+	for _, task := range []*Task{a, b} {
+		if stored := loadTask(t, store, task.ID); stored.State != TaskCompleted {
+			t.Errorf("task %s: expect updated, got %s", task.ID, stored.State)
+		}
+	}
+	if stored := loadTask(t, store, stale.ID); stored.State != TaskPending {
+		t.Errorf("expect the stale task not updated, got %s", stored.State)
+	}
+	if stored, _ := LoadTask(store, missing.ID); stored != nil {
+		t.Error("expect a missing task not created")
+	}
+	if stored := loadTask(t, store, a.ID); stored.Version != a.Version {
+		t.Errorf("expect the version bumped, got %d/%d", stored.Version, a.Version)
+	}
+}
+
+func TestUpdateBatchHoldsLocks(t *testing.T) {
+	store := plainStore{newMemStore()}
+	task := newRunnable("batch-locked")
+	saveTasks(t, store, task)
+	lock := store.Acquire(taskLockName(task.ID))
+	done := make(chan error, 1)
+	go func() {
+		task.Transition(TaskCompleted)
+		done <- UpdateBatch(store, []*Task{task})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expect the batch waiting for the lock, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// a writer holding the lock wins, the batch finds the task stale
+	if err := putTask(store, loadTask(t, store, task.ID)); err != nil {
+		t.Fatal(err)
+	}
+	lock.Release()
+	var batchErr *BatchError
+	if err := <-done; !errors.As(err, &batchErr) || !errors.Is(batchErr.Failed[task.ID], ErrStaleTask) {
+		t.Errorf("expect the task stale after the concurrent save, got %v", err)
+	}
+}
+
+func TestCachedResult(t *testing.T) {
+	store := newMemStore()
+	d := &Dispatcher{Store: store}
+	runs := 0
+	exec := singleStage("cached", func(ctx Context) error {
+		runs++
+		var n int
+		if err := ctx.GetParams(&n); err != nil {
+			return err
+		}
+		return ctx.Complete(n * 2)
+	})
+	exec.CacheResults = true
+	d.AddTaskExecs(exec)
+	submit := func(n int) *Task {
+		task := NewTask("cached").With(n).Build()
+		task.enqueue()
+		saveTasks(t, store, task)
+		return task
+	}
+
+	first := submit(21)
+	if _, found, err := FindCachedResult(store, first); err != nil || found {
+		t.Fatalf("expect a cache miss, got %v, %v", found, err)
+	}
+	runOnce(d, first)
+	second := submit(21)
+	cached, found, err := FindCachedResult(store, second)
+	if err != nil || !found || cached.ID != first.ID {
+		t.Fatalf("expect the first task found, got %v, %v", cached, err)
+	}
+	runOnce(d, second)
+	var output int
+	if err = second.GetOutput(&output); err != nil || output != 42 || second.Result != TaskSuccess || runs != 1 {
+		t.Errorf("expect the output copied without executing, got %d, %s after %d runs", output, second.Result, runs)
+	}
+	if n := len(second.Annotations); n == 0 || second.Annotations[n-1].Text != "output cached from task "+first.ID {
+		t.Errorf("expect the cache hit annotated, got %+v", second.Annotations)
+	}
+
+	if runOnce(d, submit(5)); runs != 2 {
+		t.Errorf("expect other params executed, got %d runs", runs)
+	}
+	failed := NewTask("cached").With(7).Build()
+	failed.enqueue()
+	failed.Result = TaskFailure
+	failed.Transition(TaskCompleted)
+	saveTasks(t, store, failed)
+	if _, found, _ := FindCachedResult(store, submit(7)); found {
+		t.Error("expect a failed task not reused")
+	}
+
+	uncached := 0
+	d.AddTaskExecs(singleStage("uncached", func(ctx Context) error {
+		uncached++
+		return ctx.Complete(1)
+	}))
+	for i := 0; i < 2; i++ {
+		task := newRunnable("uncached")
+		saveTasks(t, store, task)
+		runOnce(d, task)
+	}
+	if uncached != 2 {
+		t.Errorf("expect the cache opt-in, got %d runs", uncached)
+	}
+}
+
+func TestListTasksPage(t *testing.T) {
+	store := newMemStore()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := make(map[string]bool)
+	for i := 0; i < 21; i++ {
+		task := NewTask("paged").Build()
+		// tasks created at the same time are ordered by IDs
+		task.CreatedAt = base.Add(time.Duration(i/3) * time.Second)
+		saveTasks(t, store, task)
+		want[task.ID] = true
+	}
+	saveTasks(t, store, NewTask("unpaged").Build())
+
+	var pages int
+	var last *Task
+	seen := make(map[string]bool)
+	page := Page{Limit: 4}
+	for {
+		tasks, next, err := ListTasksPage(store, Filter{Name: "paged"}, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, task := range tasks {
+			if seen[task.ID] {
+				t.Fatalf("duplicated task %s", task.ID)
+			}
+			if last != nil && !taskBefore(last, task.CreatedAt, task.ID) {
+				t.Fatalf("expect ordered by CreatedAt and ID, got %s after %s", task.ID, last.ID)
+			}
+			seen[task.ID], last = true, task
+		}
+		if next == "" {
+			break
+		}
+		if len(tasks) != 4 {
+			t.Fatalf("expect full pages before the last, got %d", len(tasks))
+		}
+		page.Cursor = next
+	}
+	if pages != 6 || len(seen) != len(want) {
+		t.Errorf("expect all %d tasks in 6 pages, got %d in %d", len(want), len(seen), pages)
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("task %s missing", id)
+		}
+	}
+
+	if tasks, next, err := ListTasksPage(store, Filter{Name: "paged"}, Page{Limit: 21}); err != nil || len(tasks) != 21 || next != "" {
+		t.Errorf("expect a single exact page, got %d, %q, %v", len(tasks), next, err)
+	}
+	if _, _, err := ListTasksPage(store, Filter{}, Page{Cursor: "!"}); err == nil {
+		t.Error("expect an invalid cursor rejected")
+	}
+}
+
+func TestCachedResultSkipsClearedOutput(t *testing.T) {
+	saved := RetainOutput
+	t.Cleanup(func() { RetainOutput = saved })
+	RetainOutput = RetainNever
+	store := newMemStore()
+	completed := newRunnable("cleared-cache")
+	completed.Output = []byte(`"result"`)
+	completed.Transition(TaskCompleted)
+	saveTasks(t, store, completed)
+	if !completed.OutputCleared {
+		t.Fatal("expect the output cleared on completion")
+	}
+	task := newRunnable("cleared-cache")
+	if _, found, err := FindCachedResult(store, task); err != nil || found {
+		t.Errorf("expect a task with cleared output not reused, got %v, %v", found, err)
+	}
+}
@@ -1,8 +1,15 @@
 package jobs
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	mrand "math/rand"
+	"reflect"
 	"time"
 )
 
@@ -17,8 +24,39 @@ const (
 	TaskWaiting                    // task is waiting for sub-tasks
 	TaskStucked                    // error state, unable to retry or rollback
 	TaskCompleted                  // task completed
+	TaskBlocked                    // task is waiting for an external signal
 )
 
+func (s TaskState) valid() bool {
+	return s >= TaskCreated && s <= TaskBlocked
+}
+
+// String implements fmt.Stringer
+func (s TaskState) String() string {
+	switch s {
+	case TaskCreated:
+		return "Created"
+	case TaskPending:
+		return "Pending"
+	case TaskRunning:
+		return "Running"
+	case TaskWaiting:
+		return "Waiting"
+	case TaskStucked:
+		return "Stucked"
+	case TaskCompleted:
+		return "Completed"
+	case TaskBlocked:
+		return "Blocked"
+	}
+	return fmt.Sprintf("TaskState(%d)", int(s))
+}
+
+// IsTerminal determines if the task will never run again
+func (s TaskState) IsTerminal() bool {
+	return s == TaskCompleted
+}
+
 // TaskResult is the result when task is completed
 type TaskResult int
 
@@ -29,6 +67,19 @@ const (
 	TaskAborted
 )
 
+// String implements fmt.Stringer
+func (r TaskResult) String() string {
+	switch r {
+	case TaskSuccess:
+		return "success"
+	case TaskFailure:
+		return "failure"
+	case TaskAborted:
+		return "aborted"
+	}
+	return fmt.Sprintf("TaskResult(%d)", int(r))
+}
+
 // TaskErrorType indicates the error type
 type TaskErrorType int
 
@@ -47,8 +98,12 @@ type TaskError struct {
 	Type       TaskErrorType `json:"type"`        // error type
 	Message    string        `json:"message"`     // error Message
 	Output     []byte        `json:"output"`      // arbitrary output
-	Cause      error         `json:"cause"`       // cause of the error
+	Cause      error         `json:"cause"`       // cause of the error, decoded as CauseError
+	Causes     []error       `json:"causes"`      // more causes after Cause, decoded as CauseError
 	HappenedAt time.Time     `json:"happened-at"` // time when task failed
+
+	RetryAfter       time.Duration `json:"retry-after"`       // overrides retry delay
+	RemainingRetries *uint         `json:"remaining-retries"` // overrides retry budget
 }
 
 // NewTaskError constructs a TaskError
@@ -72,18 +127,74 @@ func (e *TaskError) SetOutput(output []byte) *TaskError {
 	return e
 }
 
+// SetStructuredOutput encodes and saves the output of the error
+func (e *TaskError) SetStructuredOutput(v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.Output = encoded
+	return nil
+}
+
+// GetStructuredOutput decodes the output of the error
+func (e *TaskError) GetStructuredOutput(v interface{}) error {
+	if e.Output == nil {
+		return nil
+	}
+	return json.Unmarshal(e.Output, v)
+}
+
 // CausedBy sets the cause
 func (e *TaskError) CausedBy(err error) *TaskError {
 	e.Cause = err
 	return e
 }
 
+// AddCause appends a contributing cause, the first one is Cause
+func (e *TaskError) AddCause(err error) *TaskError {
+	if e.Cause == nil {
+		e.Cause = err
+	} else {
+		e.Causes = append(e.Causes, err)
+	}
+	return e
+}
+
+// Unwrap returns all the causes
+func (e *TaskError) Unwrap() []error {
+	var causes []error
+	if e.Cause != nil {
+		causes = append(causes, e.Cause)
+	}
+	for _, cause := range e.Causes {
+		if cause != nil {
+			causes = append(causes, cause)
+		}
+	}
+	return causes
+}
+
+// SetRetryAfter specifies the delay before retrying
+func (e *TaskError) SetRetryAfter(d time.Duration) *TaskError {
+	e.RetryAfter = d
+	return e
+}
+
+// SetRemainingRetries overrides the number of retries left when the
+// error is handled, it's not sticky: MaxRetries of the task is unchanged
+// and later errors without the override use MaxRetries again
+func (e *TaskError) SetRemainingRetries(n uint) *TaskError {
+	e.RemainingRetries = &n
+	return e
+}
+
 // Error implements error
 func (e *TaskError) Error() string {
 	msg := fmt.Sprintf("Task[%s]: %d: %s @%s",
 		e.TaskID, e.Type, e.Message, e.HappenedAt.Format(time.RFC3339))
-	if e.Cause != nil {
-		msg += "\nCaused by: " + e.Cause.Error()
+	for _, cause := range e.Unwrap() {
+		msg += "\nCaused by: " + cause.Error()
 	}
 	if e.Output != nil {
 		msg += "\nOutput:\n" + string(e.Output)
@@ -96,8 +207,32 @@ type TaskStats struct {
 	WorkerID    string    `json:"worker-id"`    // assign to a worker
 	ScheduledAt time.Time `json:"scheduled-at"` // scheduled exec time
 	ExpireAt    time.Time `json:"expire-at"`    // expiration
+
+	WaitingSince  time.Time `json:"waiting-since"`  // when started waiting for sub tasks
+	ClaimedAt     time.Time `json:"claimed-at"`     // when last claimed by a worker
+	LastHeartbeat time.Time `json:"last-heartbeat"` // when the worker last reported alive
+	DeadSince     time.Time `json:"dead-since"`     // when the Sweeper found it stucked
+}
+
+// Annotation is an informational note attached to a task
+type Annotation struct {
+	Author string    `json:"author"` // who wrote the note
+	Text   string    `json:"text"`   // content of the note
+	At     time.Time `json:"at"`     // when the note was written
+}
+
+// Attempt records an execution of a task
+type Attempt struct {
+	Number    uint       `json:"number"`     // sequence number starting from 1
+	WorkerID  string     `json:"worker-id"`  // worker executed the task
+	StartedAt time.Time  `json:"started-at"` // when execution started
+	EndedAt   time.Time  `json:"ended-at"`   // when execution ended
+	Err       *TaskError `json:"error"`      // error if failed
 }
 
+// MaxAttempts is the max number of latest attempts kept in a task
+var MaxAttempts = 20
+
 // Task defines the details of a task`
 type Task struct {
 	ID         string      `json:"id"`          // globally unique task id
@@ -117,71 +252,703 @@ type Task struct {
 	CreatedAt  time.Time   `json:"created-at"`  // task creation time
 	UpdatedAt  time.Time   `json:"updated-at"`  // last modification time
 	Stats      *TaskStats  `json:"stats"`       // runtime stats
+
+	Annotations  []Annotation               `json:"annotations"`   // operator notes
+	StageOutputs map[string]json.RawMessage `json:"stage-outputs"` // named outputs of stages
+	ParamsRef    string                     `json:"params-ref"`    // blob ref of large params
+	OutputRef    string                     `json:"output-ref"`    // blob ref of large output
+	ParamsDigest string                     `json:"params-digest"` // digest of params in Blobs
+	ParamsBytes  int                        `json:"params-bytes"`  // size of params in Blobs
+	OutputBytes  int                        `json:"output-bytes"`  // size of output in Blobs
+	Frozen       bool                       `json:"frozen"`        // terminal, no more mutation
+	TraceID      string                     `json:"trace-id"`      // shared by the task tree
+	Canceling    bool                       `json:"canceling"`     // cancellation requested
+	CancelReason string                     `json:"cancel-reason"` // why it's canceled
+
+	IdempotencyKey  string             `json:"idempotency-key"`  // identifies the same task
+	OutputDropped   int                `json:"output-dropped"`   // bytes dropped from emitted output
+	TTL             time.Duration      `json:"ttl"`              // max duration since first claimed
+	GroupID         string             `json:"group-id"`         // ad-hoc group of tasks
+	Labels          map[string]string  `json:"labels"`           // arbitrary labels
+	EnqueuedAt      time.Time          `json:"enqueued-at"`      // when last became pending
+	Summary         string             `json:"summary"`          // one-line summary when completed
+	Version         uint64             `json:"version"`          // incremented by SaveTask and UpdateBatch
+	Attempts        []Attempt          `json:"attempts"`         // latest execution attempts
+	Priority        int                `json:"priority"`         // higher runs first
+	Queue           string             `json:"queue"`            // routes to workers, DefaultQueue if empty
+	Progress        int                `json:"progress"`         // percentage of completion
+	Metrics         map[string]float64 `json:"metrics"`          // resource usage for accounting
+	Flags           map[string]bool    `json:"flags"`            // feature flags, unset means off
+	OutputOffset    int                `json:"output-offset"`    // emitted bytes before the current stage
+	CompletedStages map[string]bool    `json:"completed-stages"` // stages not to run again
+	Depth           int                `json:"depth"`            // depth in the task tree, root is 0
+	Requirements    map[string]string  `json:"requirements"`     // capabilities required on workers
+	NotBefore       time.Time          `json:"not-before"`       // never runs before
+	NotAfter        time.Time          `json:"not-after"`        // aborted as expired after
+	Redrives        int                `json:"redrives"`         // times revived from stucked automatically
+	OutputCleared   bool               `json:"output-cleared"`   // output dropped by RetainOutput
+	RevertCause     *TaskError         `json:"revert-cause"`     // error triggered the rollback
+
+	emitReplay  int  // bytes to skip when a resumed stage emits again
+	idGenerated bool // ID generated by TaskBuilder.Build
+	dryRun      bool // run or submitted in dry-run, hooks are suppressed
+	completing  bool // completed by Context.Complete, remaining stages are skipped
+}
+
+// Clone makes a deep copy of the task
+func (t *Task) Clone() *Task {
+	c := *t
+	c.Params = cloneBytes(t.Params)
+	c.Data = cloneBytes(t.Data)
+	c.Output = cloneBytes(t.Output)
+	if t.Errors != nil {
+		c.Errors = make([]TaskError, len(t.Errors))
+		for i := range t.Errors {
+			c.Errors[i] = t.Errors[i]
+			c.Errors[i].Output = cloneBytes(t.Errors[i].Output)
+		}
+	}
+	if t.Stats != nil {
+		stats := *t.Stats
+		c.Stats = &stats
+	}
+	if t.Annotations != nil {
+		c.Annotations = append([]Annotation(nil), t.Annotations...)
+	}
+	if t.RevertCause != nil {
+		cause := *t.RevertCause
+		cause.Output = cloneBytes(t.RevertCause.Output)
+		c.RevertCause = &cause
+	}
+	if t.Attempts != nil {
+		c.Attempts = make([]Attempt, len(t.Attempts))
+		for i, a := range t.Attempts {
+			if a.Err != nil {
+				err := *a.Err
+				err.Output = cloneBytes(a.Err.Output)
+				a.Err = &err
+			}
+			c.Attempts[i] = a
+		}
+	}
+	c.Requirements = copyMap(t.Requirements)
+	c.CompletedStages = copyMap(t.CompletedStages)
+	c.Flags = copyMap(t.Flags)
+	c.Metrics = copyMap(t.Metrics)
+	c.Labels = copyMap(t.Labels)
+	if t.StageOutputs != nil {
+		c.StageOutputs = make(map[string]json.RawMessage, len(t.StageOutputs))
+		for k, v := range t.StageOutputs {
+			c.StageOutputs[k] = cloneBytes(v)
+		}
+	}
+	return &c
+}
+
+// DebugString formats the task in a compact line for logging
+func (t *Task) DebugString() string {
+	result := "-"
+	if t.State == TaskCompleted {
+		result = t.Result.String()
+	}
+	return fmt.Sprintf("Task[%s %s] state=%s result=%s retries=%d/%d job=%s stage=%s",
+		t.ID, t.Name, t.State, result, t.Retries, t.MaxRetries, t.JobID, t.Stage)
+}
+
+// Fingerprint is the digest of name and params of the task, the same
+// params produce the same Fingerprint whether inline or in Blobs
+func (t *Task) Fingerprint() string {
+	h := sha256.New()
+	h.Write([]byte(t.Name))
+	h.Write([]byte{0})
+	switch {
+	case t.ParamsRef == "":
+		h.Write([]byte(payloadDigest(t.Params)))
+	case t.ParamsDigest != "":
+		h.Write([]byte(t.ParamsDigest))
+	default:
+		// without a digest, the params are identified by the ref
+		h.Write([]byte(t.ParamsRef))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ParamsSize returns the size in bytes of the encoded params, params
+// externalized to Blobs are sized by the size recorded when stored
+func (t *Task) ParamsSize() int {
+	if t.ParamsRef != "" {
+		return t.ParamsBytes
+	}
+	return len(t.Params)
+}
+
+// DataSize returns the size in bytes of the data
+func (t *Task) DataSize() int {
+	return len(t.Data)
+}
+
+// OutputSize returns the size in bytes of the encoded output, output
+// externalized to Blobs is sized by the size recorded when stored
+func (t *Task) OutputSize() int {
+	if t.OutputRef != "" {
+		return t.OutputBytes
+	}
+	return len(t.Output)
+}
+
+// StoredSize returns the size in bytes of the payloads stored inline in
+// the task, excluding the ones externalized to Blobs
+func (t *Task) StoredSize() int {
+	return len(t.Params) + len(t.Data) + len(t.Output)
+}
+
+// Annotate appends an operator note to the task
+func (t *Task) Annotate(author, text string) *Task {
+	t.Annotations = append(t.Annotations, Annotation{
+		Author: author,
+		Text:   text,
+		At:     time.Now(),
+	})
+	return t
 }
 
 // GetParams extracts the parameters
+// Absent, empty or JSON null params leave p unchanged without error
 func (t *Task) GetParams(p interface{}) error {
-	params := t.Params
-	if params == nil {
-		return nil
+	params, err := loadPayload(t.Params, t.ParamsRef)
+	if err != nil || isNullPayload(params) {
+		return err
 	}
 	return json.Unmarshal(params, p)
 }
 
 // GetData retieves and decodes the data
+// Absent, empty or JSON null data leave d unchanged without error
 func (t *Task) GetData(d interface{}) error {
-	data := t.Data
-	if data == nil {
+	if isNullPayload(t.Data) {
 		return nil
 	}
-	return json.Unmarshal(data, d)
+	return json.Unmarshal(t.Data, d)
 }
 
 // SetData encodes and saves the data
+// It panics with TaskFrozenError if the task is frozen, and encoding
+// errors are handled according to PanicOnCodecError, use TrySetData
+// to handle the errors
 func (t *Task) SetData(d interface{}) *Task {
+	if err := t.TrySetData(d); err != nil {
+		codecError(err)
+	}
+	return t
+}
+
+// TrySetData is SetData returning TaskFrozenError or the encoding error
+func (t *Task) TrySetData(d interface{}) error {
+	if err := t.checkFrozen(); err != nil {
+		return err
+	}
 	encoded, err := json.Marshal(d)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	t.Data = encoded
-	return t
+	return nil
 }
 
 // GetOutput decodes the output
+// Absent, empty or JSON null output leave p unchanged without error
 func (t *Task) GetOutput(p interface{}) error {
-	output := t.Output
-	if output == nil {
-		return nil
+	output, err := loadPayload(t.Output, t.OutputRef)
+	if err != nil || isNullPayload(output) {
+		return err
 	}
 	return json.Unmarshal(output, p)
 }
 
 // SetOutput encodes and saves the output
+// It panics with TaskFrozenError if the task is frozen, and encoding
+// errors are handled according to PanicOnCodecError, use TrySetOutput
+// to handle the errors
 func (t *Task) SetOutput(p interface{}) *Task {
+	if err := t.TrySetOutput(p); err != nil {
+		codecError(err)
+	}
+	return t
+}
+
+// TrySetOutput is SetOutput returning TaskFrozenError or the encoding
+// error
+func (t *Task) TrySetOutput(p interface{}) error {
+	if err := t.checkFrozen(); err != nil {
+		return err
+	}
 	encoded, err := json.Marshal(p)
 	if err != nil {
+		return err
+	}
+	if err = t.storeOutput(encoded); err != nil {
+		return err
+	}
+	// the emitted output is replaced
+	t.OutputDropped, t.OutputOffset, t.emitReplay = 0, 0, 0
+	return nil
+}
+
+// GetStageOutput decodes the named output of a stage
+func (t *Task) GetStageOutput(stage string, p interface{}) error {
+	output, ok := t.StageOutputs[stage]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(output, p)
+}
+
+// PutStageOutput encodes and saves the named output of a stage
+func (t *Task) PutStageOutput(stage string, p interface{}) error {
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if t.StageOutputs == nil {
+		t.StageOutputs = make(map[string]json.RawMessage)
+	}
+	t.StageOutputs[stage] = encoded
+	return nil
+}
+
+// OutputLimit is the max number of bytes of emitted output kept in a
+// task, 0 means unlimited
+var OutputLimit = 0
+
+// Emit appends a chunk to the output, only the tail of OutputLimit bytes
+// is kept with a marker of dropped bytes prefixed
+// Emit is used for streamed output like logs, and SetOutput for
+// structured output which is never truncated
+// It panics with TaskFrozenError if the task is frozen, see TryEmit
+func (t *Task) Emit(chunk []byte) *Task {
+	if err := t.TryEmit(chunk); err != nil {
 		panic(err)
 	}
-	t.Output = encoded
 	return t
 }
 
+// TryEmit is Emit returning TaskFrozenError
+func (t *Task) TryEmit(chunk []byte) error {
+	if err := t.checkFrozen(); err != nil {
+		return err
+	}
+	if t.emitReplay > 0 {
+		// already emitted before the stage was resumed
+		skip := t.emitReplay
+		if skip > len(chunk) {
+			skip = len(chunk)
+		}
+		t.emitReplay -= skip
+		if chunk = chunk[skip:]; len(chunk) == 0 {
+			return nil
+		}
+	}
+	_, body := t.emittedOutput()
+	body = append(body, chunk...)
+	if OutputLimit > 0 && len(body) > OutputLimit {
+		drop := len(body) - OutputLimit
+		t.OutputDropped += drop
+		body = append([]byte(droppedMarker(t.OutputDropped)), body[drop:]...)
+	} else if t.OutputDropped > 0 {
+		body = append([]byte(droppedMarker(t.OutputDropped)), body...)
+	}
+	t.Output = body
+	return nil
+}
+
+// emittedOutput returns the offset of the kept output in all emitted
+// bytes, and the kept output without the marker, output not prefixed
+// by the marker, e.g. replaced by SetOutput, is returned as is
+func (t *Task) emittedOutput() (int, []byte) {
+	if t.OutputDropped == 0 {
+		return 0, t.Output
+	}
+	marker := droppedMarker(t.OutputDropped)
+	if !bytes.HasPrefix(t.Output, []byte(marker)) {
+		return 0, t.Output
+	}
+	return t.OutputDropped, t.Output[len(marker):]
+}
+
+// emittedLen returns the number of all emitted bytes including dropped
+func (t *Task) emittedLen() int {
+	offset, body := t.emittedOutput()
+	return offset + len(body)
+}
+
+// beginStage prepares emitting output of the current stage, the bytes
+// emitted beyond OutputOffset by an interrupted run of the stage are
+// skipped when the stage emits them again
+func (t *Task) beginStage() {
+	if t.emitReplay = t.emittedLen() - t.OutputOffset; t.emitReplay < 0 {
+		t.emitReplay = 0
+	}
+}
+
+// endStage records the output emitted by the completed stage
+func (t *Task) endStage() {
+	t.OutputOffset = t.emittedLen()
+	t.emitReplay = 0
+}
+
+// markStageCompleted records the stage completed so a replay skips it,
+// the marker is persisted with the next checkpoint
+func (t *Task) markStageCompleted(stage string, completed bool) {
+	if !completed {
+		delete(t.CompletedStages, stage)
+		return
+	}
+	if t.CompletedStages == nil {
+		t.CompletedStages = make(map[string]bool)
+	}
+	t.CompletedStages[stage] = true
+}
+
+func droppedMarker(n int) string {
+	return fmt.Sprintf("...[%d earlier bytes dropped]", n)
+}
+
 // NewError constructs a TaskError
 func (t *Task) NewError(errType TaskErrorType) *TaskError {
 	return NewTaskError(t.ID, errType)
 }
 
+// AppendError records an error happened to the task, the first error
+// triggering the rollback is kept as the cause of it
+func (t *Task) AppendError(err *TaskError) error {
+	if e := t.checkFrozen(); e != nil {
+		return e
+	}
+	t.Errors = append(t.Errors, *err)
+	if err.Type == TaskErrRevert && t.RevertCause == nil {
+		cause := *err
+		t.RevertCause = &cause
+	}
+	return nil
+}
+
+// Transition changes the state of the task, the task is frozen
+// when entering a terminal state
+func (t *Task) Transition(state TaskState) error {
+	return t.TransitionAt(state, time.Now())
+}
+
+// TransitionAt changes the state of the task at the time given by
+// the caller's clock
+func (t *Task) TransitionAt(state TaskState, now time.Time) error {
+	if err := t.checkFrozen(); err != nil {
+		return err
+	}
+	if state == TaskWaiting && t.State != TaskWaiting {
+		t.ensureStats().WaitingSince = now
+	}
+	if state == TaskPending && t.State != TaskPending {
+		// a delayed task becomes runnable when scheduled
+		t.EnqueuedAt = now
+		if t.Stats != nil && t.Stats.ScheduledAt.After(now) {
+			t.EnqueuedAt = t.Stats.ScheduledAt
+		}
+	}
+	if t.State == TaskStucked && state != TaskStucked && t.Stats != nil {
+		t.Stats.DeadSince = time.Time{}
+	}
+	from := t.State
+	t.State = state
+	t.UpdatedAt = now
+	transitioned(t, from, state)
+	t.Frozen = state.IsTerminal()
+	if t.Frozen {
+		completed(t)
+		t.retainOutput()
+	}
+	return nil
+}
+
+// OutputRetention defines whether the output of a terminal task is kept
+type OutputRetention int
+
+// Output retention policies
+const (
+	RetainAlways    OutputRetention = iota // keep the output
+	RetainOnFailure                        // keep the output unless succeeded
+	RetainNever                            // drop the output
+)
+
+// RetainOutput is the policy applied when a task enters a terminal
+// state, after completion hooks run, Errors are always kept
+var RetainOutput = RetainAlways
+
+func (t *Task) retainOutput() {
+	switch RetainOutput {
+	case RetainOnFailure:
+		if t.Result != TaskSuccess {
+			return
+		}
+	case RetainNever:
+	default:
+		return
+	}
+	t.Output, t.OutputRef, t.OutputBytes = nil, "", 0
+	t.OutputDropped, t.OutputOffset, t.emitReplay = 0, 0, 0
+	t.OutputCleared = true
+}
+
+// Cancel requests cancellation of the task with the reason
+func (t *Task) Cancel(reason string) error {
+	if err := t.checkFrozen(); err != nil {
+		return err
+	}
+	t.Canceling = true
+	t.CancelReason = reason
+	t.UpdatedAt = time.Now()
+	return nil
+}
+
+// mergeCancel takes a cancellation request from the stored copy of the
+// running task, and the Version of the stored copy unless the task was
+// reclaimed by another worker, so the worker's next save isn't stale
+func (t *Task) mergeCancel(stored *Task) {
+	if stored.Version <= t.Version {
+		return
+	}
+	if stored.Canceling && !t.Canceling {
+		t.Canceling, t.CancelReason = true, stored.CancelReason
+		t.Revert = t.Revert || stored.Revert
+		t.UpdatedAt = stored.UpdatedAt
+	}
+	if stored.Stats == nil || t.Stats == nil || stored.Stats.WorkerID == t.Stats.WorkerID {
+		t.Version = stored.Version
+	}
+}
+
+// claimed updates the runtime stats when the task is claimed by a worker
+// ExpireAt is derived from TTL on the first claim unless specified
+func (t *Task) claimed(now time.Time) {
+	stats := t.ensureStats()
+	stats.ClaimedAt = now
+	stats.LastHeartbeat = now
+	if t.TTL > 0 && stats.ExpireAt.IsZero() {
+		stats.ExpireAt = now.Add(t.TTL)
+	}
+}
+
+// ensureStats initializes Stats if absent, it must be used before
+// mutating Stats
+func (t *Task) ensureStats() *TaskStats {
+	if t.Stats == nil {
+		t.Stats = &TaskStats{}
+	}
+	return t.Stats
+}
+
+// SetProgress reports the percentage of completion, clamped to [0, 100]
+func (t *Task) SetProgress(percent int) *Task {
+	switch {
+	case percent < 0:
+		percent = 0
+	case percent > 100:
+		percent = 100
+	}
+	t.Progress = percent
+	return t
+}
+
+// AddMetric accumulates delta to the usage counter of the key
+func (t *Task) AddMetric(key string, delta float64) *Task {
+	if t.Metrics == nil {
+		t.Metrics = make(map[string]float64)
+	}
+	t.Metrics[key] += delta
+	return t
+}
+
+// DefaultQueue is the queue of tasks without one
+const DefaultQueue = "default"
+
+// QueueName returns the queue the task is routed to
+func (t *Task) QueueName() string {
+	if t.Queue == "" {
+		return DefaultQueue
+	}
+	return t.Queue
+}
+
+// inQueues determines if the task is routed to one of the queues, empty
+// queues match all
+func (t *Task) inQueues(queues []string) bool {
+	if len(queues) == 0 {
+		return true
+	}
+	return containsString(queues, t.QueueName())
+}
+
+// InWindow determines if the task is allowed to run at the time by
+// NotBefore and NotAfter
+func (t *Task) InWindow(now time.Time) bool {
+	return !now.Before(t.NotBefore) && !t.expired(now)
+}
+
+func (t *Task) expired(now time.Time) bool {
+	return !t.NotAfter.IsZero() && now.After(t.NotAfter)
+}
+
+// SatisfiedBy determines if the capabilities meet all the requirements
+// of the task
+func (t *Task) SatisfiedBy(capabilities map[string]string) bool {
+	for k, v := range t.Requirements {
+		if capability, ok := capabilities[k]; !ok || capability != v {
+			return false
+		}
+	}
+	return true
+}
+
+// recordAttempt appends an execution attempt, only the latest
+// MaxAttempts are kept
+func (t *Task) recordAttempt(a Attempt) {
+	a.Number = 1
+	if n := len(t.Attempts); n > 0 {
+		a.Number = t.Attempts[n-1].Number + 1
+	}
+	t.Attempts = append(t.Attempts, a)
+	if MaxAttempts > 0 && len(t.Attempts) > MaxAttempts {
+		t.Attempts = append([]Attempt(nil), t.Attempts[len(t.Attempts)-MaxAttempts:]...)
+	}
+}
+
+// PreviousWorker returns the worker executed the latest attempt of the
+// task, which is kept after Stats.WorkerID is cleared for a retry
+func (t *Task) PreviousWorker() string {
+	if n := len(t.Attempts); n > 0 {
+		return t.Attempts[n-1].WorkerID
+	}
+	return ""
+}
+
+// Heartbeat records the running task is alive
+func (t *Task) Heartbeat() *Task {
+	t.ensureStats().LastHeartbeat = time.Now()
+	return t
+}
+
+// Revive unfreezes a terminal task and makes it pending again
+func (t *Task) Revive() *Task {
+	t.Frozen, t.OutputCleared = false, false
+	t.Transition(TaskPending)
+	return t
+}
+
+// enqueue makes a created task pending on submission, which is when it
+// becomes runnable unless scheduled later, a blocked task stays blocked
+func (t *Task) enqueue() error {
+	if t.State != TaskCreated {
+		return nil
+	}
+	return t.Transition(TaskPending)
+}
+
+// QueueLatency is the duration from the task became pending till
+// claimed by a worker
+func (t *Task) QueueLatency() time.Duration {
+	if t.Stats == nil || t.Stats.ClaimedAt.IsZero() || t.EnqueuedAt.IsZero() {
+		return 0
+	}
+	return t.Stats.ClaimedAt.Sub(t.EnqueuedAt)
+}
+
+func (t *Task) checkFrozen() error {
+	if t.Frozen {
+		return &TaskFrozenError{TaskID: t.ID}
+	}
+	return nil
+}
+
+// newID generates a random unique ID
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// cloneValue makes a deep copy of a value through JSON encoding
+func cloneValue(v interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	copied := reflect.New(reflect.TypeOf(v))
+	if err = json.Unmarshal(encoded, copied.Interface()); err != nil {
+		return nil, err
+	}
+	return copied.Elem().Interface(), nil
+}
+
+// isNullPayload determines if an encoded payload carries no value
+func isNullPayload(payload []byte) bool {
+	payload = bytes.TrimSpace(payload)
+	return len(payload) == 0 || bytes.Equal(payload, []byte("null"))
+}
+
+// copyMap makes a shallow copy of a map, nil is kept as nil
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
 // TaskSubmitter defines the contract which submits a task
 type TaskSubmitter interface {
 	SubmitTask(*Task) error
 }
 
+// ContextSubmitter is optionally implemented by TaskSubmitter to
+// submit a task with a context
+type ContextSubmitter interface {
+	SubmitTaskContext(context.Context, *Task) error
+}
+
 // TaskBuilder is a helper to build a task
 type TaskBuilder struct {
-	Submitter TaskSubmitter
-	ID        string
-	Name      string
-	Params    interface{}
+	Submitter      TaskSubmitter
+	ID             string
+	Name           string
+	Params         interface{}
+	IdempotencyKey string
+	TTL            time.Duration
+	GroupID        string
+	Labels         map[string]string
+	MaxRetries     *uint
+	ScheduledAt    time.Time
+	Jitter         time.Duration
+	Rand           *mrand.Rand // source of jitter, the global source if nil
+	WaitSignal     bool
+	Priority       int
+	Queue          string
+	Flags          map[string]bool
+	Requirements   map[string]string
+	NotBefore      time.Time
+	NotAfter       time.Time
+
+	err error
 }
 
 // NewTask starts defining a task
@@ -189,12 +956,146 @@ func NewTask(name string) *TaskBuilder {
 	return &TaskBuilder{Name: name}
 }
 
+// Clone makes a deep copy of the builder for variations, the params are
+// copied through JSON encoding, and the ID is not copied
+func (b *TaskBuilder) Clone() *TaskBuilder {
+	c := *b
+	c.ID = ""
+	c.Labels = copyMap(b.Labels)
+	c.Flags = copyMap(b.Flags)
+	c.Requirements = copyMap(b.Requirements)
+	if b.MaxRetries != nil {
+		n := *b.MaxRetries
+		c.MaxRetries = &n
+	}
+	if b.Params != nil && c.err == nil {
+		c.Params, c.err = cloneValue(b.Params)
+	}
+	return &c
+}
+
 // SetID specifies the globally unqiue ID of task
 func (b *TaskBuilder) SetID(id string) *TaskBuilder {
 	b.ID = id
 	return b
 }
 
+// SetIdempotencyKey specifies the key identifying the same task
+func (b *TaskBuilder) SetIdempotencyKey(key string) *TaskBuilder {
+	b.IdempotencyKey = key
+	return b
+}
+
+// SetMaxRetries specifies the max count of retries, overriding the
+// default of the task name
+func (b *TaskBuilder) SetMaxRetries(n uint) *TaskBuilder {
+	b.MaxRetries = &n
+	return b
+}
+
+// WaitForSignal makes the task blocked until signaled, see Signal
+func (b *TaskBuilder) WaitForSignal() *TaskBuilder {
+	b.WaitSignal = true
+	return b
+}
+
+// ScheduleAt specifies the time to run the task
+func (b *TaskBuilder) ScheduleAt(t time.Time) *TaskBuilder {
+	b.ScheduledAt = t
+	return b
+}
+
+// RunBetween restricts the task to run within the window, the task is
+// scheduled no earlier than start, and aborted as expired after end,
+// a zero time leaves the side open
+func (b *TaskBuilder) RunBetween(start, end time.Time) *TaskBuilder {
+	b.NotBefore, b.NotAfter = start, end
+	return b
+}
+
+// WithScheduleJitter randomizes the scheduled time within ±d to avoid
+// stampedes of tasks scheduled at the same time, the randomized time is
+// never in the past
+func (b *TaskBuilder) WithScheduleJitter(d time.Duration) *TaskBuilder {
+	b.Jitter = d
+	return b
+}
+
+// scheduledAt computes the scheduled time with jitter
+func (b *TaskBuilder) scheduledAt(now time.Time) time.Time {
+	at := b.ScheduledAt
+	if b.Jitter <= 0 {
+		return at
+	}
+	if at.IsZero() {
+		at = now
+	}
+	n := int64(2*b.Jitter) + 1
+	var offset int64
+	if b.Rand != nil {
+		offset = b.Rand.Int63n(n)
+	} else {
+		offset = mrand.Int63n(n)
+	}
+	at = at.Add(time.Duration(offset) - b.Jitter)
+	if at.Before(now) {
+		at = now
+	}
+	return at
+}
+
+// WithTTL specifies the max duration to finish the task since it's
+// claimed by a worker, unlike an absolute ExpireAt
+func (b *TaskBuilder) WithTTL(d time.Duration) *TaskBuilder {
+	b.TTL = d
+	return b
+}
+
+// InGroup adds the task to a group which can be cancelled together
+func (b *TaskBuilder) InGroup(id string) *TaskBuilder {
+	b.GroupID = id
+	return b
+}
+
+// WithPriority sets the priority, higher runs first
+func (b *TaskBuilder) WithPriority(priority int) *TaskBuilder {
+	b.Priority = priority
+	return b
+}
+
+// InQueue routes the task to workers of the queue
+func (b *TaskBuilder) InQueue(queue string) *TaskBuilder {
+	b.Queue = queue
+	return b
+}
+
+// WithFlag turns a feature flag of the task on or off
+func (b *TaskBuilder) WithFlag(name string, on bool) *TaskBuilder {
+	if b.Flags == nil {
+		b.Flags = make(map[string]bool)
+	}
+	b.Flags[name] = on
+	return b
+}
+
+// Require restricts the task to workers with the capability
+func (b *TaskBuilder) Require(capability, value string) *TaskBuilder {
+	if b.Requirements == nil {
+		b.Requirements = make(map[string]string)
+	}
+	b.Requirements[capability] = value
+	return b
+}
+
+// WithLabel adds a label to the task
+func (b *TaskBuilder) WithLabel(key, value string) *TaskBuilder {
+	if b.Labels == nil {
+		b.Labels = make(map[string]string)
+	}
+	b.Labels[key] = value
+	return b
+}
+
 // With specifies the parameters which will be encoded later
 func (b *TaskBuilder) With(params interface{}) *TaskBuilder {
 	b.Params = params
@@ -203,24 +1104,139 @@ func (b *TaskBuilder) With(params interface{}) *TaskBuilder {
 
 // Build builds the task
 func (b *TaskBuilder) Build() *Task {
-	task := &Task{ID: b.ID}
+	if b.err != nil {
+		panic(b.err)
+	}
+	now := time.Now()
+	task := &Task{
+		ID:             b.ID,
+		Name:           NormalizeName(b.Name),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		IdempotencyKey: b.IdempotencyKey,
+		TTL:            b.TTL,
+		GroupID:        b.GroupID,
+		Priority:       b.Priority,
+		Queue:          b.Queue,
+		NotBefore:      b.NotBefore,
+		NotAfter:       b.NotAfter,
+		MaxRetries:     DefaultMaxRetries(b.Name),
+	}
+	if b.MaxRetries != nil {
+		task.MaxRetries = *b.MaxRetries
+	}
+	if b.WaitSignal {
+		task.State = TaskBlocked
+	}
+	at := b.scheduledAt(now)
+	if b.NotBefore.After(at) {
+		at = b.NotBefore
+	}
+	if !at.IsZero() {
+		task.ensureStats().ScheduledAt = at
+	}
+	task.Labels = copyMap(b.Labels)
+	task.Flags = copyMap(b.Flags)
+	task.Requirements = copyMap(b.Requirements)
 	if task.ID == "" {
-		// TODO generate a unique ID
+		task.ID, task.idGenerated = newID(), true
 	}
 	if b.Params != nil {
-		encoded, err := json.Marshal(b.Params)
-		if err != nil {
-			panic(err)
+		if err := task.setParams(b.Params); err != nil {
+			codecError(err)
 		}
-		task.Params = encoded
 	}
 	return task
 }
 
+func (t *Task) setParams(p interface{}) error {
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return t.storeParams(encoded)
+}
+
 // Submit submits the task for execution
+// Submit hooks are invoked before the task is handed to the submitter,
+// and the submission is limited by Quota
 func (b *TaskBuilder) Submit() (*Task, error) {
+	task, _, err := b.SubmitContext(context.Background())
+	return task, err
+}
+
+// CancelFunc requests cancellation of a submitted task with the reason
+type CancelFunc func(reason string) error
+
+// SubmitContext submits the task with a context, the returned CancelFunc
+// cancels the task without looking it up by ID later
+// If the submitter is also a Store, the task is re-read from the store
+// to reflect the assigned ID and initial state
+func (b *TaskBuilder) SubmitContext(ctx context.Context) (*Task, CancelFunc, error) {
+	if b.err != nil {
+		return nil, nil, b.err
+	}
 	task := b.Build()
-	return task, b.Submitter.SubmitTask(task)
+	if c, ok := b.Submitter.(Context); ok {
+		task.dryRun = c.dryRun
+	}
+	if err := runSubmitHooks(task); err != nil {
+		return task, nil, err
+	}
+	if err := task.enqueue(); err != nil {
+		return task, nil, err
+	}
+	quota := Quota
+	if err := quota.Consume(task); err != nil {
+		return task, nil, err
+	}
+	var err error
+	if submitter, ok := b.Submitter.(ContextSubmitter); ok {
+		err = submitter.SubmitTaskContext(ctx, task)
+	} else {
+		err = b.Submitter.SubmitTask(task)
+	}
+	if err != nil {
+		quota.Refund(task)
+		return task, nil, err
+	}
+	cancel := b.cancelFunc(task)
+	if store, ok := b.Submitter.(Store); ok {
+		stored, err := LoadTask(store, task.ID)
+		if err != nil {
+			return task, cancel, err
+		}
+		if stored != nil {
+			task = stored
+		}
+	}
+	return task, cancel, nil
+}
+
+// cancelFunc creates a CancelFunc of the submitted task, the task is
+// cancelled in the store if the submitter is backed by one, which the
+// worker picks up on heartbeats and checkpoints, otherwise the submitted
+// task is shared with the worker in the same process and is cancelled in
+// place through the guard of the worker
+func (b *TaskBuilder) cancelFunc(task *Task) CancelFunc {
+	var store Store
+	switch submitter := b.Submitter.(type) {
+	case Store:
+		store = submitter
+	case Context:
+		if !submitter.dryRun {
+			store = submitter.store
+		}
+	}
+	if store == nil {
+		return func(reason string) error {
+			return cancelLocal(task, reason)
+		}
+	}
+	id := task.ID
+	return func(reason string) error {
+		return Cancel(store, id, reason)
+	}
 }
 
 // TaskFn is the function to execute the task
@@ -228,12 +1244,197 @@ type TaskFn func(Context) error
 
 // Stage defines a named stage with specified task function
 type Stage struct {
-	Name string // name of the stage
-	Fn   TaskFn // task function
+	Name     string   // name of the stage
+	Fn       TaskFn   // task function
+	Requires []string // keys required in params or data
+	After    []string // stages which must run before this one
+	// Fallback runs when Fn fails with a retry error and the task has
+	// exhausted retries, the stage succeeds if Fallback succeeds
+	Fallback TaskFn
+	// Checkpoint forces persisting the task before the stage regardless
+	// of the PersistPolicy, for risky or long stages
+	Checkpoint bool
+	// Weight is the relative duration for calculating progress, values
+	// not positive count as 1
+	Weight float64
+	// Timeout is the max duration of the stage, 0 uses the default
+	Timeout time.Duration
+}
+
+// Durations are the default timeouts when not specified by tasks or stages
+type Durations struct {
+	Task  time.Duration // max duration of a task since claimed, 0 means no limit
+	Stage time.Duration // max duration of a stage, 0 means no limit
+}
+
+// EffectiveDeadline resolves the deadline of running the stage from now,
+// which is the earliest of
+//   - the task deadline: ExpireAt, or claimed time plus defaults.Task if
+//     ExpireAt is not set
+//   - the stage deadline: now plus the stage Timeout, or defaults.Stage
+//     if Timeout is not set
+//
+// It returns false if none applies, and stage may be nil for the task
+// deadline only
+func (t *Task) EffectiveDeadline(stage *Stage, defaults Durations) (time.Time, bool) {
+	var deadline time.Time
+	if t.Stats != nil && !t.Stats.ExpireAt.IsZero() {
+		deadline = t.Stats.ExpireAt
+	} else if defaults.Task > 0 && t.Stats != nil && !t.Stats.ClaimedAt.IsZero() {
+		deadline = t.Stats.ClaimedAt.Add(defaults.Task)
+	}
+	timeout := defaults.Stage
+	if stage != nil && stage.Timeout > 0 {
+		timeout = stage.Timeout
+	}
+	if timeout > 0 {
+		if stageDeadline := time.Now().Add(timeout); deadline.IsZero() || stageDeadline.Before(deadline) {
+			deadline = stageDeadline
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+func (s *Stage) weight() float64 {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// stagesProgress calculates the percentage of completion when the stages
+// up to index have completed, weighted by the stages
+func stagesProgress(stages []*Stage, index int) int {
+	var done, total float64
+	for i, stage := range stages {
+		total += stage.weight()
+		if i <= index {
+			done += stage.weight()
+		}
+	}
+	return int(done * 100 / total)
+}
+
+// missingRequired finds the first required key absent from both params
+// and data of the task, returns empty if all are present
+func (s *Stage) missingRequired(t *Task) (string, error) {
+	if len(s.Requires) == 0 {
+		return "", nil
+	}
+	var params, data map[string]json.RawMessage
+	if err := t.GetParams(&params); err != nil {
+		return "", err
+	}
+	if err := t.GetData(&data); err != nil {
+		return "", err
+	}
+	for _, key := range s.Requires {
+		if _, ok := params[key]; ok {
+			continue
+		}
+		if _, ok := data[key]; ok {
+			continue
+		}
+		return key, nil
+	}
+	return "", nil
 }
 
 // TaskExec is the implemetation of the task
+// Stages run in the declared order respecting Stage.After, a task
+// resumes from the stage named by Task.Stage
 type TaskExec struct {
-	Name   string  // name of the task
-	Stages []Stage // stages in the task
+	Name   string      // name of the task
+	Stages []Stage     // stages in the task
+	Params interface{} // sample of params, optionally
+
+	// CacheResults skips executing the task by copying the output of a
+	// completed task with the same Fingerprint, see FindCachedResult
+	CacheResults bool
+
+	// Finalizers run in reverse order after the task succeeds or fails,
+	// including cancellation, but not when it's going to retry, waits for
+	// sub tasks or gets stucked
+	// Their errors fail a task which otherwise succeeded, and are
+	// annotated on a failed task
+	Finalizers []TaskFn
+}
+
+// StageNames returns the names of stages in execution order, or in the
+// declared order if the dependencies among stages are invalid
+func (e *TaskExec) StageNames() []string {
+	names := make([]string, 0, len(e.Stages))
+	stages, err := e.orderedStages()
+	if err != nil {
+		for i := range e.Stages {
+			names = append(names, e.Stages[i].Name)
+		}
+		return names
+	}
+	for _, stage := range stages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
+
+// orderedStages sorts the stages so each runs after the stages in its
+// After list, independent stages keep the declared order
+func (e *TaskExec) orderedStages() ([]*Stage, error) {
+	index := make(map[string]int, len(e.Stages))
+	for i := range e.Stages {
+		index[e.Stages[i].Name] = i
+	}
+	indegree := make([]int, len(e.Stages))
+	dependents := make([][]int, len(e.Stages))
+	for i := range e.Stages {
+		for _, dep := range e.Stages[i].After {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("task %s: stage %s after unknown stage %s",
+					e.Name, e.Stages[i].Name, dep)
+			}
+			indegree[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	stages := make([]*Stage, 0, len(e.Stages))
+	done := make([]bool, len(e.Stages))
+	for len(stages) < len(e.Stages) {
+		next := -1
+		for i := range e.Stages {
+			if !done[i] && indegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var names []string
+			for i := range e.Stages {
+				if !done[i] {
+					names = append(names, e.Stages[i].Name)
+				}
+			}
+			return nil, fmt.Errorf("task %s: cyclic dependency among stages %v", e.Name, names)
+		}
+		done[next] = true
+		stages = append(stages, &e.Stages[next])
+		for _, i := range dependents[next] {
+			indegree[i]--
+		}
+	}
+	return stages, nil
+}
+
+// stageIndex finds the index of the named stage, empty name means
+// the first stage
+func stageIndex(stages []*Stage, name string) int {
+	if name == "" && len(stages) > 0 {
+		return 0
+	}
+	for i, stage := range stages {
+		if stage.Name == name {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,521 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildGeneratesID(t *testing.T) {
+	a, b := NewTask("a").Build(), NewTask("a").Build()
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("expect unique IDs, got %q and %q", a.ID, b.ID)
+	}
+	if task := NewTask("a").SetID("given").Build(); task.ID != "given" {
+		t.Errorf("expect the given ID, got %q", task.ID)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	task := NewTask("a").Build()
+	before := time.Now()
+	task.Annotate("alice", "investigating").Annotate("bob", "resolved")
+	if len(task.Annotations) != 2 {
+		t.Fatalf("expect 2 annotations, got %d", len(task.Annotations))
+	}
+	note := task.Annotations[0]
+	if note.Author != "alice" || note.Text != "investigating" || note.At.Before(before) {
+		t.Errorf("unexpected annotation %+v", note)
+	}
+	clone := task.Clone()
+	clone.Annotate("carol", "more")
+	if len(task.Annotations) != 2 {
+		t.Error("expect annotations of a clone not shared")
+	}
+	encoded, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Task
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Annotations) != 2 || decoded.Annotations[1].Text != "resolved" ||
+		!decoded.Annotations[1].At.Equal(task.Annotations[1].At) {
+		t.Errorf("expect annotations round-trip, got %+v", decoded.Annotations)
+	}
+}
+
+func TestCloneCopiesMaps(t *testing.T) {
+	task := NewTask("a").WithLabel("tenant", "t1").WithFlag("beta", true).Require("gpu", "a100").Build()
+	task.AddMetric("cpu", 1)
+	task.markStageCompleted("s1", true)
+	clone := task.Clone()
+	clone.Labels["tenant"] = "t2"
+	clone.Flags["beta"] = false
+	clone.Requirements["gpu"] = "h100"
+	clone.Metrics["cpu"] = 2
+	clone.CompletedStages["s2"] = true
+	if task.Labels["tenant"] != "t1" || !task.Flags["beta"] || task.Requirements["gpu"] != "a100" ||
+		task.Metrics["cpu"] != 1 || task.CompletedStages["s2"] {
+		t.Errorf("expect maps of a clone not shared, got %+v", task)
+	}
+	if empty := (&Task{}).Clone(); empty.Labels != nil || empty.Flags != nil {
+		t.Error("expect nil maps kept nil")
+	}
+}
+
+func TestFrozenTask(t *testing.T) {
+	task := newRunnable("a")
+	task.SetOutput("done")
+	if err := task.Transition(TaskCompleted); err != nil {
+		t.Fatal(err)
+	}
+	if !task.Frozen {
+		t.Fatal("expect frozen on terminal transition")
+	}
+	frozen := []struct {
+		name string
+		err  error
+	}{
+		{"TrySetData", task.TrySetData(1)},
+		{"TrySetOutput", task.TrySetOutput("changed")},
+		{"TryEmit", task.TryEmit([]byte("more"))},
+		{"AppendError", task.AppendError(task.NewError(TaskErrRetry))},
+		{"Transition", task.Transition(TaskPending)},
+	}
+	for _, c := range frozen {
+		var frozenErr *TaskFrozenError
+		if !errors.As(c.err, &frozenErr) || frozenErr.TaskID != task.ID || !errors.Is(c.err, ErrTaskFrozen) {
+			t.Errorf("%s: expect TaskFrozenError, got %v", c.name, c.err)
+		}
+	}
+	var output string
+	if err := task.GetOutput(&output); err != nil || output != "done" || task.State != TaskCompleted || len(task.Errors) != 0 {
+		t.Errorf("expect the task unchanged, got %q, %s, %v", output, task.State, task.Errors)
+	}
+
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrTaskFrozen) {
+				t.Errorf("expect SetData to panic with TaskFrozenError, got %v", err)
+			}
+		}()
+		task.SetData(1)
+	}()
+
+	task.Revive()
+	if task.Frozen || task.State != TaskPending {
+		t.Fatalf("expect revived pending, got %s", task.State)
+	}
+	if err := task.TrySetData(1); err != nil {
+		t.Errorf("expect mutation after revival, got %v", err)
+	}
+}
+
+func TestEmitOutputLimit(t *testing.T) {
+	saved := OutputLimit
+	OutputLimit = 10
+	t.Cleanup(func() { OutputLimit = saved })
+
+	task := NewTask("a").Build()
+	task.Emit([]byte("01234"))
+	if string(task.Output) != "01234" {
+		t.Errorf("expect output within the limit kept, got %q", task.Output)
+	}
+	task.Emit([]byte("56789")).Emit([]byte("abcde"))
+	if want := "...[5 earlier bytes dropped]56789abcde"; string(task.Output) != want {
+		t.Errorf("expect %q, got %q", want, task.Output)
+	}
+	task.Emit([]byte("xy"))
+	if want := "...[7 earlier bytes dropped]789abcdexy"; string(task.Output) != want {
+		t.Errorf("expect %q, got %q", want, task.Output)
+	}
+
+	task.SetOutput("replaced")
+	var output string
+	if err := task.GetOutput(&output); err != nil || output != "replaced" || task.OutputDropped != 0 {
+		t.Errorf("expect the emitted output replaced, got %q, %v, dropped %d", output, err, task.OutputDropped)
+	}
+}
+
+func TestTTLFromClaim(t *testing.T) {
+	clock := newFakeClock()
+	task := NewTask("a").WithTTL(10 * time.Minute).Build()
+	if task.Stats != nil && !task.Stats.ExpireAt.IsZero() {
+		t.Fatal("expect no ExpireAt before claimed")
+	}
+	clock.Advance(time.Hour)
+	claimedAt := clock.Now()
+	task.claimed(claimedAt)
+	if want := claimedAt.Add(10 * time.Minute); !task.Stats.ExpireAt.Equal(want) {
+		t.Errorf("expect ExpireAt %s, got %s", want, task.Stats.ExpireAt)
+	}
+	clock.Advance(time.Minute)
+	task.claimed(clock.Now())
+	if want := claimedAt.Add(10 * time.Minute); !task.Stats.ExpireAt.Equal(want) {
+		t.Errorf("expect ExpireAt kept from the first claim, got %s", task.Stats.ExpireAt)
+	}
+
+	absolute := clock.Now().Add(time.Minute)
+	task = NewTask("a").WithTTL(10 * time.Minute).Build()
+	task.ensureStats().ExpireAt = absolute
+	task.claimed(clock.Now())
+	if !task.Stats.ExpireAt.Equal(absolute) {
+		t.Errorf("expect an absolute ExpireAt kept, got %s", task.Stats.ExpireAt)
+	}
+}
+
+func TestEnqueuedAt(t *testing.T) {
+	scheduled := time.Now().Add(time.Hour)
+	task := NewTask("a").ScheduleAt(scheduled).Build()
+	if task.CreatedAt.IsZero() || !task.EnqueuedAt.IsZero() {
+		t.Fatalf("expect only CreatedAt set on build, got %s/%s", task.CreatedAt, task.EnqueuedAt)
+	}
+	if err := task.enqueue(); err != nil {
+		t.Fatal(err)
+	}
+	if !task.EnqueuedAt.Equal(scheduled) || task.EnqueuedAt.Equal(task.CreatedAt) {
+		t.Errorf("expect a delayed task enqueued when scheduled, got %s, created at %s", task.EnqueuedAt, task.CreatedAt)
+	}
+	if latency := task.QueueLatency(); latency != 0 {
+		t.Errorf("expect no latency before claimed, got %s", latency)
+	}
+	task.claimed(scheduled.Add(5 * time.Minute))
+	if latency := task.QueueLatency(); latency != 5*time.Minute {
+		t.Errorf("expect 5m latency, got %s", latency)
+	}
+}
+
+func TestQueueLatencyEndToEnd(t *testing.T) {
+	q := &MemQueue{}
+	task, err := (&TaskBuilder{Submitter: q, Name: "latency"}).Submit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.EnqueuedAt.Before(task.CreatedAt) {
+		t.Errorf("expect enqueued on submission after created, got %s before %s", task.EnqueuedAt, task.CreatedAt)
+	}
+	time.Sleep(10 * time.Millisecond)
+	peeked, ok := q.Peek(time.Now())
+	if !ok || peeked != task {
+		t.Fatal("expect the task runnable")
+	}
+	if err = q.Claim(peeked, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	if latency := task.QueueLatency(); latency < 10*time.Millisecond {
+		t.Errorf("expect latency from enqueued to claimed, got %s", latency)
+	}
+}
+
+// enrichingStore is a Store submitting tasks enriched on the store side
+type enrichingStore struct {
+	*memStore
+}
+
+func (s enrichingStore) SubmitTask(task *Task) error {
+	stored := task.Clone()
+	stored.Labels = map[string]string{"shard": "s1"}
+	return SaveTask(s, stored)
+}
+
+func TestSubmitReturnsStoredTask(t *testing.T) {
+	store := enrichingStore{newMemStore()}
+	task, err := (&TaskBuilder{Submitter: store, Name: "stored"}).Submit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Labels["shard"] != "s1" || task.Version == 0 || task.State != TaskPending {
+		t.Errorf("expect the stored task returned, got %+v", task)
+	}
+}
+
+func TestErrorStructuredOutput(t *testing.T) {
+	type detail struct {
+		Code  int      `json:"code"`
+		Hosts []string `json:"hosts"`
+	}
+	e := NewTaskError("t1", TaskErrFail)
+	var got detail
+	if err := e.GetStructuredOutput(&got); err != nil || got.Code != 0 {
+		t.Errorf("expect nil output leaving the value unchanged, got %+v, %v", got, err)
+	}
+	if err := e.SetStructuredOutput(detail{Code: 503, Hosts: []string{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TaskError
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err = decoded.GetStructuredOutput(&got); err != nil || got.Code != 503 || len(got.Hosts) != 2 {
+		t.Errorf("expect the output round-trip, got %+v, %v", got, err)
+	}
+	if err = e.SetStructuredOutput(nil); err != nil || string(e.Output) != "null" {
+		t.Errorf("expect nil encoded as null, got %s, %v", e.Output, err)
+	}
+	if err = e.SetStructuredOutput(func() {}); err == nil {
+		t.Error("expect an encoding error")
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+	rnd := mrand.New(mrand.NewSource(1))
+	var earliest, latest time.Time
+	for i := 0; i < 200; i++ {
+		b := NewTask("a").ScheduleAt(at).WithScheduleJitter(time.Minute)
+		b.Rand = rnd
+		scheduled := b.Build().Stats.ScheduledAt
+		if scheduled.Before(at.Add(-time.Minute)) || scheduled.After(at.Add(time.Minute)) {
+			t.Fatalf("expect within ±1m of %s, got %s", at, scheduled)
+		}
+		if earliest.IsZero() || scheduled.Before(earliest) {
+			earliest = scheduled
+		}
+		if scheduled.After(latest) {
+			latest = scheduled
+		}
+	}
+	if latest.Sub(earliest) < time.Minute {
+		t.Errorf("expect scheduled times spread, got %s to %s", earliest, latest)
+	}
+
+	for i := 0; i < 50; i++ {
+		before := time.Now()
+		b := NewTask("a").WithScheduleJitter(time.Hour)
+		b.Rand = rnd
+		if scheduled := b.Build().Stats.ScheduledAt; scheduled.Before(before) {
+			t.Fatalf("expect never scheduled into the past, got %s", scheduled)
+		}
+	}
+}
+
+func TestNilStats(t *testing.T) {
+	now := time.Now()
+	fresh := func() *Task {
+		return &Task{ID: "t1", Name: "a", State: TaskPending}
+	}
+	helpers := []struct {
+		name string
+		fn   func(*Task)
+	}{
+		{"Clone", func(task *Task) { task.Clone() }},
+		{"DebugString", func(task *Task) { _ = task.DebugString() }},
+		{"QueueLatency", func(task *Task) { task.QueueLatency() }},
+		{"PreviousWorker", func(task *Task) { task.PreviousWorker() }},
+		{"NextAction", func(task *Task) { task.NextAction(now, nil) }},
+		{"EffectiveDeadline", func(task *Task) { task.EffectiveDeadline(&Stage{}, Durations{Task: time.Minute}) }},
+		{"pendingSince", func(task *Task) { task.pendingSince() }},
+		{"Heartbeat", func(task *Task) { task.Heartbeat() }},
+		{"claimed", func(task *Task) { task.claimed(now) }},
+		{"Transition", func(task *Task) {
+			task.State = TaskRunning
+			if err := task.Transition(TaskWaiting); err != nil || task.Stats.WaitingSince.IsZero() {
+				t.Errorf("expect waiting recorded, got %v", err)
+			}
+		}},
+		{"Release", func(task *Task) { (&memTaskHandle{queue: &MemQueue{}, task: task}).Release() }},
+		{"Done", func(task *Task) {
+			(&memTaskHandle{queue: &MemQueue{}, task: task}).Done(task.NewError(TaskErrRetry).SetRetryAfter(time.Minute))
+		}},
+	}
+	for _, h := range helpers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: expect no panic on nil Stats, got %v", h.name, r)
+				}
+			}()
+			h.fn(fresh())
+		}()
+	}
+	if task := fresh().Heartbeat(); task.Stats == nil || task.Stats.LastHeartbeat.IsZero() {
+		t.Error("expect Stats initialized by Heartbeat")
+	}
+}
+
+func TestBuilderClone(t *testing.T) {
+	type params struct {
+		Region string
+		Hosts  []string
+	}
+	base := NewTask("clone").SetID("base").SetMaxRetries(2).
+		With(&params{Region: "us", Hosts: []string{"a"}}).
+		WithLabel("tenant", "t1").WithFlag("beta", true).Require("gpu", "a100")
+	clone := base.Clone()
+	if clone.ID != "" {
+		t.Errorf("expect the ID not copied, got %q", clone.ID)
+	}
+	clone.Params.(*params).Hosts[0] = "b"
+	clone.Params.(*params).Region = "eu"
+	clone.WithLabel("tenant", "t2").WithFlag("beta", false).Require("gpu", "h100").SetMaxRetries(5)
+
+	task := base.Build()
+	var p params
+	if err := task.GetParams(&p); err != nil || p.Region != "us" || p.Hosts[0] != "a" {
+		t.Errorf("expect the base params unchanged, got %+v, %v", p, err)
+	}
+	if task.ID != "base" || task.MaxRetries != 2 || task.Labels["tenant"] != "t1" ||
+		!task.Flags["beta"] || task.Requirements["gpu"] != "a100" {
+		t.Errorf("expect the base unchanged, got %+v", task)
+	}
+	variant := clone.Build()
+	if err := variant.GetParams(&p); err != nil || p.Region != "eu" || p.Hosts[0] != "b" {
+		t.Errorf("expect the clone params changed, got %+v, %v", p, err)
+	}
+	if variant.ID == "" || variant.ID == task.ID || variant.MaxRetries != 5 || variant.Labels["tenant"] != "t2" {
+		t.Errorf("expect the variation built, got %+v", variant)
+	}
+}
+
+func TestDebugString(t *testing.T) {
+	running := &Task{ID: "t1", Name: "upload", State: TaskRunning, Retries: 1, MaxRetries: 3, JobID: "J1", Stage: "upload"}
+	if got, want := running.DebugString(), "Task[t1 upload] state=Running result=- retries=1/3 job=J1 stage=upload"; got != want {
+		t.Errorf("expect %q, got %q", want, got)
+	}
+	done := &Task{ID: "t2", Name: "index", State: TaskCompleted, Result: TaskFailure}
+	if got, want := done.DebugString(), "Task[t2 index] state=Completed result=failure retries=0/0 job= stage="; got != want {
+		t.Errorf("expect %q, got %q", want, got)
+	}
+	if got := TaskState(42).String(); got != "TaskState(42)" {
+		t.Errorf("expect an unknown state formatted, got %q", got)
+	}
+}
+
+func TestEffectiveDeadline(t *testing.T) {
+	now := time.Now()
+	claimedAt := now.Add(-time.Minute)
+	expireAt := now.Add(time.Hour)
+	cases := []struct {
+		name      string
+		expireAt  time.Time
+		claimed   bool
+		timeout   time.Duration
+		defaults  Durations
+		absolute  time.Time     // expected absolute deadline
+		fromNow   time.Duration // or expected deadline relative to now
+		unlimited bool
+	}{
+		{name: "none", unlimited: true},
+		{name: "default task unclaimed", defaults: Durations{Task: time.Hour}, unlimited: true},
+		{name: "expire at", expireAt: expireAt, absolute: expireAt},
+		{name: "default task", claimed: true, defaults: Durations{Task: 10 * time.Minute}, absolute: claimedAt.Add(10 * time.Minute)},
+		{name: "expire at over default task", expireAt: expireAt, claimed: true, defaults: Durations{Task: time.Minute}, absolute: expireAt},
+		{name: "default stage", defaults: Durations{Stage: time.Minute}, fromNow: time.Minute},
+		{name: "stage timeout", timeout: 2 * time.Minute, fromNow: 2 * time.Minute},
+		{name: "stage timeout over default stage", timeout: 2 * time.Hour, defaults: Durations{Stage: time.Minute}, fromNow: 2 * time.Hour},
+		{name: "stage tighter than task", expireAt: expireAt, timeout: time.Minute, fromNow: time.Minute},
+		{name: "task tighter than stage", expireAt: expireAt, timeout: 2 * time.Hour, absolute: expireAt},
+		{name: "default task tighter than default stage", claimed: true, defaults: Durations{Task: 5 * time.Minute, Stage: 10 * time.Minute}, absolute: claimedAt.Add(5 * time.Minute)},
+	}
+	for _, c := range cases {
+		task := NewTask("a").Build()
+		if !c.expireAt.IsZero() {
+			task.ensureStats().ExpireAt = c.expireAt
+		}
+		if c.claimed {
+			task.ensureStats().ClaimedAt = claimedAt
+		}
+		before := time.Now()
+		deadline, ok := task.EffectiveDeadline(&Stage{Timeout: c.timeout}, c.defaults)
+		after := time.Now()
+		switch {
+		case c.unlimited:
+			if ok {
+				t.Errorf("%s: expect no deadline, got %s", c.name, deadline)
+			}
+		case !c.absolute.IsZero():
+			if !ok || !deadline.Equal(c.absolute) {
+				t.Errorf("%s: expect %s, got %s", c.name, c.absolute, deadline)
+			}
+		default:
+			if !ok || deadline.Before(before.Add(c.fromNow)) || deadline.After(after.Add(c.fromNow)) {
+				t.Errorf("%s: expect %s from now, got %s", c.name, c.fromNow, deadline.Sub(before))
+			}
+		}
+	}
+	if deadline, ok := (&Task{}).EffectiveDeadline(nil, Durations{Stage: time.Minute}); !ok || deadline.IsZero() {
+		t.Error("expect a nil stage using the default")
+	}
+}
+
+func TestMultipleCauses(t *testing.T) {
+	primary := errors.New("primary")
+	detail := fmt.Errorf("wrapped: %w", ErrQuotaExceeded)
+	unrelated := errors.New("unrelated")
+	taskErr := (&TaskError{Type: TaskErrFail, Message: "failed"}).AddCause(primary).AddCause(nil).AddCause(detail)
+	if taskErr.Cause != primary {
+		t.Errorf("expect the first cause kept as Cause, got %v", taskErr.Cause)
+	}
+	if causes := taskErr.Unwrap(); len(causes) != 2 || causes[0] != primary || causes[1] != detail {
+		t.Errorf("expect both causes unwrapped, got %v", causes)
+	}
+	if !errors.Is(taskErr, primary) || !errors.Is(taskErr, detail) || !errors.Is(taskErr, ErrQuotaExceeded) {
+		t.Error("expect errors.Is matching any of the causes")
+	}
+	if errors.Is(taskErr, unrelated) {
+		t.Error("expect no match of an unrelated error")
+	}
+	msg := taskErr.Error()
+	if !strings.Contains(msg, "Caused by: primary") || !strings.Contains(msg, "Caused by: wrapped: ") {
+		t.Errorf("expect all causes rendered, got %q", msg)
+	}
+	if causes := (&TaskError{}).Unwrap(); len(causes) != 0 {
+		t.Errorf("expect no causes, got %v", causes)
+	}
+}
+
+func TestRetainOutput(t *testing.T) {
+	saved := RetainOutput
+	t.Cleanup(func() { RetainOutput = saved })
+	cases := []struct {
+		policy OutputRetention
+		result TaskResult
+		kept   bool
+	}{
+		{RetainAlways, TaskSuccess, true},
+		{RetainAlways, TaskFailure, true},
+		{RetainOnFailure, TaskSuccess, false},
+		{RetainOnFailure, TaskFailure, true},
+		{RetainOnFailure, TaskAborted, true},
+		{RetainNever, TaskSuccess, false},
+		{RetainNever, TaskFailure, false},
+	}
+	for _, c := range cases {
+		RetainOutput = c.policy
+		task := newRunnable("retained")
+		task.Transition(TaskRunning)
+		task.Output, task.OutputOffset = []byte("output"), 6
+		task.Errors = append(task.Errors, TaskError{Type: TaskErrFail, Message: "attempt"})
+		task.Result = c.result
+		if err := task.Transition(TaskCompleted); err != nil {
+			t.Fatal(err)
+		}
+		if kept := task.Output != nil; kept != c.kept || task.OutputCleared == c.kept {
+			t.Errorf("policy %d, result %s: expect output kept %v, got %q/%v", c.policy, c.result, c.kept, task.Output, task.OutputCleared)
+		}
+		if !c.kept && task.OutputOffset != 0 {
+			t.Errorf("policy %d, result %s: expect the output offset reset, got %d", c.policy, c.result, task.OutputOffset)
+		}
+		if len(task.Errors) != 1 {
+			t.Errorf("policy %d, result %s: expect errors kept, got %v", c.policy, c.result, task.Errors)
+		}
+	}
+
+	RetainOutput = RetainNever
+	task := newRunnable("retained")
+	task.Output = []byte("output")
+	task.Transition(TaskCompleted)
+	if task.Revive(); task.OutputCleared {
+		t.Error("expect a revived task no longer marked cleared")
+	}
+}
@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+var placeholderRe = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+// Template creates tasks from a base task whose params contain
+// placeholders in the form of "{{name}}"
+// A string which is a single placeholder is replaced by the variable
+// as is, otherwise placeholders are replaced by the formatted variables
+type Template struct {
+	Base *Task
+}
+
+// NewTemplate creates a template from the base task
+func NewTemplate(base *Task) *Template {
+	return &Template{Base: base}
+}
+
+// Instantiate creates a new task with the variables substituted
+func (t *Template) Instantiate(vars map[string]interface{}) (*Task, error) {
+	task := t.Base.Clone()
+	task.ID = newID()
+	params, err := loadPayload(task.Params, task.ParamsRef)
+	if err != nil || params == nil {
+		return task, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	var v interface{}
+	if err = dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if v, err = substitute(v, vars); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err = task.storeParams(encoded); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+func substitute(v interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return substituteString(val, vars)
+	case []interface{}:
+		for i, item := range val {
+			replaced, err := substitute(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = replaced
+		}
+	case map[string]interface{}:
+		for key, item := range val {
+			replaced, err := substitute(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			val[key] = replaced
+		}
+	}
+	return v, nil
+}
+
+func substituteString(s string, vars map[string]interface{}) (interface{}, error) {
+	if m := placeholderRe.FindStringSubmatchIndex(s); m != nil && m[0] == 0 && m[1] == len(s) {
+		name := s[m[2]:m[3]]
+		val, ok := vars[name]
+		if !ok {
+			return nil, fmt.Errorf("template: undefined variable %q", name)
+		}
+		return val, nil
+	}
+	var err error
+	replaced := placeholderRe.ReplaceAllStringFunc(s, func(p string) string {
+		name := placeholderRe.FindStringSubmatch(p)[1]
+		val, ok := vars[name]
+		if !ok {
+			err = fmt.Errorf("template: undefined variable %q", name)
+			return p
+		}
+		return fmt.Sprint(val)
+	})
+	return replaced, err
+}
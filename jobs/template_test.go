@@ -0,0 +1,53 @@
+package jobs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTemplateInstantiate(t *testing.T) {
+	tmpl := NewTemplate(NewTask("tmpl").WithLabel("team", "infra").With(map[string]interface{}{
+		"region": "{{region}}",
+		"target": map[string]interface{}{
+			"host":  "{{host}}.{{region}}.example.com",
+			"ports": []interface{}{"{{port}}", 22},
+		},
+		"fixed": 1,
+	}).Build())
+
+	a, err := tmpl.Instantiate(map[string]interface{}{"region": "us", "host": "web", "port": 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tmpl.Instantiate(map[string]interface{}{"region": "eu", "host": "db", "port": 5432})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID == "" || a.ID == b.ID || a.ID == tmpl.Base.ID {
+		t.Errorf("expect fresh IDs, got %q, %q", a.ID, b.ID)
+	}
+	if a.Labels["team"] != "infra" {
+		t.Errorf("expect the base copied, got %v", a.Labels)
+	}
+	a.Labels["team"] = "changed"
+	if tmpl.Base.Labels["team"] != "infra" {
+		t.Error("expect the base not shared")
+	}
+	for task, want := range map[*Task]string{
+		a: `{"fixed":1,"region":"us","target":{"host":"web.us.example.com","ports":[8080,22]}}`,
+		b: `{"fixed":1,"region":"eu","target":{"host":"db.eu.example.com","ports":[5432,22]}}`,
+	} {
+		if string(task.Params) != want {
+			t.Errorf("expect %s, got %s", want, task.Params)
+		}
+	}
+	var base map[string]json.RawMessage
+	if err = tmpl.Base.GetParams(&base); err != nil || string(base["region"]) != `"{{region}}"` {
+		t.Errorf("expect the base params unchanged, got %s", tmpl.Base.Params)
+	}
+
+	if _, err = tmpl.Instantiate(map[string]interface{}{"region": "us"}); err == nil || !strings.Contains(err.Error(), "undefined variable") {
+		t.Errorf("expect an undefined variable error, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+// WaitFor blocks until the task is settled or ctx is done, a task is
+// settled when terminal or stucked, as a stucked task doesn't proceed
+// without intervention, check the State of the returned task
+// It uses the watch stream if store implements TaskWatcher, otherwise
+// polls the store in the specified interval, FuturePollInterval if
+// poll is not positive
+func WaitFor(ctx context.Context, store Store, id string, poll time.Duration) (*Task, error) {
+	if watcher, ok := store.(TaskWatcher); ok {
+		return waitByWatch(ctx, watcher, id)
+	}
+	if poll <= 0 {
+		poll = FuturePollInterval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		task, err := LoadTask(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if settled(task) {
+			return task, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func settled(task *Task) bool {
+	return task != nil && (task.State.IsTerminal() || task.State == TaskStucked)
+}
+
+func waitByWatch(ctx context.Context, watcher TaskWatcher, id string) (*Task, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	updates, err := watcher.WatchTask(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case task, ok := <-updates:
+			if !ok {
+				if err = ctx.Err(); err == nil {
+					err = ErrWatchClosed
+				}
+				return nil, err
+			}
+			if settled(task) {
+				return task, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// FuturePollInterval is the interval a Future polls the store if the
+// store doesn't implement TaskWatcher
+var FuturePollInterval = time.Second
+
+// Future tracks a submitted task until it settles, see WaitFor
+type Future struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	task   *Task
+	err    error
+}
+
+// SubmitFuture submits the task and tracks it until it settles
+func (b *TaskBuilder) SubmitFuture(ctx context.Context, store Store) (*Future, error) {
+	task, err := b.Submit()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f := &Future{done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(f.done)
+		defer cancel()
+		f.task, f.err = WaitFor(ctx, store, task.ID, FuturePollInterval)
+	}()
+	return f, nil
+}
+
+// Done returns a channel which is closed when the future resolves
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result blocks until the future resolves and returns the final task
+func (f *Future) Result() (*Task, error) {
+	<-f.done
+	return f.task, f.err
+}
+
+// Cancel stops tracking the task, the task itself is not cancelled
+func (f *Future) Cancel() {
+	f.cancel()
+}
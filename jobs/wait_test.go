@@ -0,0 +1,131 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// watchStore is a memStore streaming the tasks sent to updates
+type watchStore struct {
+	*memStore
+	updates chan *Task
+}
+
+func (s *watchStore) WatchTask(ctx context.Context, id string) (<-chan *Task, error) {
+	return s.updates, nil
+}
+
+func completeLater(t *testing.T, store Store, task *Task, state TaskState) {
+	time.Sleep(20 * time.Millisecond)
+	task.Transition(state)
+	if err := SaveTask(store, task); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitForPolling(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("a")
+	if err := SaveTask(store, task); err != nil {
+		t.Fatal(err)
+	}
+	go completeLater(t, store, task.Clone(), TaskCompleted)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done, err := WaitFor(ctx, store, task.ID, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.State != TaskCompleted {
+		t.Errorf("expect completed, got %s", done.State)
+	}
+}
+
+func TestWaitForStucked(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("a")
+	task.Transition(TaskStucked)
+	if err := SaveTask(store, task); err != nil {
+		t.Fatal(err)
+	}
+	done, err := WaitFor(context.Background(), store, task.ID, time.Millisecond)
+	if err != nil || done.State != TaskStucked {
+		t.Errorf("expect a stucked task settled, got %v, %v", done, err)
+	}
+}
+
+func TestWaitForCanceled(t *testing.T) {
+	store := newMemStore()
+	task := newRunnable("a")
+	if err := SaveTask(store, task); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := WaitFor(ctx, store, task.ID, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect returned promptly, took %s", elapsed)
+	}
+}
+
+func TestWaitForWatch(t *testing.T) {
+	store := &watchStore{memStore: newMemStore(), updates: make(chan *Task, 2)}
+	task := newRunnable("a")
+	store.updates <- task.Clone()
+	task.Transition(TaskCompleted)
+	store.updates <- task
+	done, err := WaitFor(context.Background(), store, task.ID, time.Hour)
+	if err != nil || done.State != TaskCompleted {
+		t.Fatalf("expect completed from the watch stream, got %v, %v", done, err)
+	}
+	close(store.updates)
+	if _, err = WaitFor(context.Background(), store, task.ID, 0); !errors.Is(err, ErrWatchClosed) {
+		t.Errorf("expect ErrWatchClosed, got %v", err)
+	}
+}
+
+func TestSubmitFuture(t *testing.T) {
+	saved := FuturePollInterval
+	FuturePollInterval = time.Millisecond
+	defer func() { FuturePollInterval = saved }()
+
+	store := newMemStore()
+	f, err := (&TaskBuilder{Submitter: storeSubmitter{store}, Name: "a"}).SetID("future").SubmitFuture(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.Done():
+		t.Fatal("expect unresolved before the task settles")
+	default:
+	}
+	submitted, err := LoadTask(store, "future")
+	if err != nil || submitted == nil || submitted.State != TaskPending {
+		t.Fatalf("expect the task submitted, got %v, %v", submitted, err)
+	}
+	go completeLater(t, store, submitted, TaskCompleted)
+	task, err := f.Result()
+	if err != nil || task.State != TaskCompleted {
+		t.Errorf("expect completed, got %v, %v", task, err)
+	}
+}
+
+func TestFutureCancel(t *testing.T) {
+	store := newMemStore()
+	f, err := (&TaskBuilder{Submitter: storeSubmitter{store}, Name: "a"}).SubmitFuture(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Cancel()
+	if _, err = f.Result(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect canceled, got %v", err)
+	}
+}